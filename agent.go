@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentNone as the agent of a host disables agent authentication for it.
+const agentNone = "none"
+
+// agentSocket returns the socket of the default agent, AgentSocket or else
+// SSH_AUTH_SOCK, falling back to the OpenSSH agent pipe on Windows.
+func (p *Plan) agentSocket() string {
+	if p.AgentSocket != "" {
+		return p.AgentSocket
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		return sock
+	}
+	return defaultAgentSocket
+}
+
+// sshAgent returns a client for the ssh-agent to use for h, the one set for
+// it in the inventory or else the default one. It returns nil if there is
+// none.
+func (p *Plan) sshAgent(h *Host) agent.ExtendedAgent {
+	sock := p.agentSocket()
+	switch h.agentSocket {
+	case "":
+	case agentNone:
+		return nil
+	default:
+		sock = h.agentSocket
+	}
+	if sock == "" || sock == agentNone {
+		return nil
+	}
+	return p.agentAt(sock)
+}
+
+// agentAt returns a client for the agent listening on sock. Each agent is
+// connected to once and shared by all hosts.
+func (p *Plan) agentAt(sock string) agent.ExtendedAgent {
+	p.agentMu.Lock()
+	defer p.agentMu.Unlock()
+
+	if a, ok := p.agents[sock]; ok {
+		return a
+	}
+	if p.agents == nil {
+		p.agents = map[string]agent.ExtendedAgent{}
+	}
+
+	conn, err := dialAgent(sock)
+	if err != nil {
+		// like ssh, carry on with key files when the agent is unreachable
+		p.agents[sock] = nil
+		return nil
+	}
+	p.agentConns = append(p.agentConns, conn)
+	p.agents[sock] = agent.NewClient(conn)
+	return p.agents[sock]
+}
+
+// AgentKeys lists the keys held by the default agent.
+func (p *Plan) AgentKeys() ([]*agent.Key, error) {
+	sock := p.agentSocket()
+	if sock == "" || sock == agentNone {
+		return nil, errors.New("no agent is available, set SSH_AUTH_SOCK or --agent-socket")
+	}
+
+	conn, err := dialAgent(sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to agent at %s: %v", sock, err)
+	}
+	defer conn.Close()
+
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list agent keys: %v", err)
+	}
+	return keys, nil
+}
+
+// publicKeys offers signers, then the keys held by a, if not nil, then
+// defaults. They share one auth method as the ssh client tries each method
+// only once.
+func publicKeys(h *Host, signers []ssh.Signer, a agent.ExtendedAgent, defaults []ssh.Signer) ssh.AuthMethod {
+	return ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		h.authMethod = authPublicKey
+
+		all := append([]ssh.Signer{}, signers...)
+		if a == nil {
+			return append(all, defaults...), nil
+		}
+		if agentSigners, err := a.Signers(); err == nil {
+			for _, signer := range agentSigners {
+				switch signer.PublicKey().Type() {
+				case ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256:
+					signer = &securityKeySigner{Signer: signer, host: h.name}
+				}
+				all = append(all, signer)
+			}
+		}
+		// failing to list the agent's keys leaves the key files to try
+		return append(all, defaults...), nil
+	})
+}
+
+// forwardAgent forwards the local agent over client and requests forwarding
+// on session, if enabled for h by --forward-agent or ForwardAgent in the ssh
+// config.
+func (p *Plan) forwardAgent(h *Host, client *ssh.Client) error {
+	if !p.ForwardAgent && !h.forwardAgent {
+		return nil
+	}
+
+	a := p.sshAgent(h)
+	if a == nil {
+		if p.ForwardAgent {
+			return errors.New("no agent is available, set SSH_AUTH_SOCK or --agent-socket")
+		}
+		return nil
+	}
+
+	if err := agent.ForwardToAgent(client, a); err != nil {
+		return err
+	}
+	h.agentForwarded = true
+	return nil
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"net"
+
+	"github.com/danvixent/sshx/util"
+)
+
+// defaultAgentSocket is used when SSH_AUTH_SOCK is not set, there is none
+// outside of Windows.
+const defaultAgentSocket = ""
+
+func dialAgent(sock string) (io.ReadWriteCloser, error) {
+	return net.Dial("unix", util.ExpandHome(sock))
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+)
+
+// defaultAgentSocket is the named pipe of the Windows OpenSSH agent, used
+// when SSH_AUTH_SOCK is not set.
+const defaultAgentSocket = `\\.\pipe\openssh-ssh-agent`
+
+// dialAgent connects to an agent on a named pipe, as used by the Windows
+// OpenSSH agent and 1Password, or on a unix socket.
+func dialAgent(sock string) (io.ReadWriteCloser, error) {
+	if strings.HasPrefix(sock, `\\.\pipe\`) {
+		// the agent client sends one request at a time, so the pipe can be
+		// used as a plain file
+		return os.OpenFile(sock, os.O_RDWR, 0)
+	}
+	return net.Dial("unix", util.ExpandHome(sock))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AlgorithmOptions restricts the algorithms negotiated with hosts. Empty
+// lists keep the defaults of the ssh package.
+type AlgorithmOptions struct {
+	Ciphers      []string
+	KeyExchanges []string
+	MACs         []string
+	// HostKeys are the host key algorithms offered, overriding those set by
+	// HostKeyAlgorithms in the ssh config
+	HostKeys []string
+	// FIPS limits every list to FIPS 140 approved algorithms
+	FIPS bool
+}
+
+// Algorithms the ssh package implements for clients.
+var (
+	cipherAlgorithms = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc", "arcfour256", "arcfour128", "arcfour",
+	}
+	kexAlgorithms = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+		"diffie-hellman-group14-sha1", "diffie-hellman-group1-sha1",
+	}
+	macAlgorithms = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512", "hmac-sha1", "hmac-sha1-96",
+	}
+	hostKeyAlgorithms = []string{
+		ssh.CertAlgoED25519v01, ssh.CertAlgoSKED25519v01,
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoSKECDSA256v01,
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01,
+		ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521, ssh.KeyAlgoSKECDSA256,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	}
+)
+
+// FIPS 140 approved subsets, in preference order.
+var (
+	fipsCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+	}
+	fipsKeyExchanges = []string{
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group16-sha512",
+	}
+	fipsMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-512-etm@openssh.com",
+		"hmac-sha2-256", "hmac-sha2-512",
+	}
+	fipsHostKeyAlgorithms = []string{
+		ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	}
+)
+
+// validate checks that every algorithm is implemented and, with FIPS, that
+// it is approved, rather than letting the ssh package silently drop it.
+func (o *AlgorithmOptions) validate() error {
+	for _, l := range []struct {
+		kind      string
+		values    []string
+		supported []string
+		fips      []string
+	}{
+		{"cipher", o.Ciphers, cipherAlgorithms, fipsCiphers},
+		{"key exchange", o.KeyExchanges, kexAlgorithms, fipsKeyExchanges},
+		{"MAC", o.MACs, macAlgorithms, fipsMACs},
+		{"host key", o.HostKeys, hostKeyAlgorithms, fipsHostKeyAlgorithms},
+	} {
+		for _, v := range l.values {
+			if !hasString(l.supported, v) {
+				return fmt.Errorf("unsupported %s algorithm %s", l.kind, v)
+			}
+			if o.FIPS && !hasString(l.fips, v) {
+				return fmt.Errorf("%s algorithm %s is not FIPS approved", l.kind, v)
+			}
+		}
+	}
+	return nil
+}
+
+// config returns the ssh config restricted to the chosen algorithms.
+func (o *AlgorithmOptions) config() ssh.Config {
+	pick := func(values, fips []string) []string {
+		if len(values) == 0 && o.FIPS {
+			return fips
+		}
+		return values
+	}
+
+	return ssh.Config{
+		Ciphers:      pick(o.Ciphers, fipsCiphers),
+		KeyExchanges: pick(o.KeyExchanges, fipsKeyExchanges),
+		MACs:         pick(o.MACs, fipsMACs),
+	}
+}
+
+// hostKeyAlgorithms returns the host key algorithms to offer a host. The
+// configured list comes from HostKeys or the ssh config of the host and is
+// narrowed to the algorithms of keys already known for it, so a verified key
+// is negotiated. Without a configured list the known ones are offered, nil
+// meaning the defaults of the ssh package.
+func (o *AlgorithmOptions) hostKeyAlgorithms(configured, known []string) []string {
+	if len(o.HostKeys) > 0 {
+		configured = o.HostKeys
+	}
+	if o.FIPS {
+		configured = fipsOnly(configured)
+	}
+	if len(configured) == 0 {
+		if !o.FIPS {
+			return known
+		}
+		configured = fipsHostKeyAlgorithms
+	}
+
+	var out []string
+	for _, algo := range configured {
+		if hasString(known, algo) {
+			out = append(out, algo)
+		}
+	}
+	if len(out) == 0 {
+		// no known key can be negotiated, verification reports the mismatch
+		return configured
+	}
+	return out
+}
+
+func fipsOnly(algos []string) []string {
+	var out []string
+	for _, algo := range algos {
+		if hasString(fipsHostKeyAlgorithms, algo) {
+			out = append(out, algo)
+		}
+	}
+	return out
+}
+
+// sshConfigHostKeyAlgorithms parses a HostKeyAlgorithms value. Lists that
+// modify the defaults with +, - or ^ are ignored, as are algorithms the ssh
+// package doesn't implement.
+func sshConfigHostKeyAlgorithms(v string) []string {
+	if v == "" || strings.ContainsAny(v[:1], "+-^") {
+		return nil
+	}
+
+	var out []string
+	for _, algo := range strings.Split(v, ",") {
+		algo = strings.TrimSpace(algo)
+		if hasString(hostKeyAlgorithms, algo) {
+			out = append(out, algo)
+		}
+	}
+	return out
+}
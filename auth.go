@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Auth method names, as used by PreferredAuthentications in the ssh config.
+// key and agent split publickey into key files and agent keys.
+const (
+	authNone                = "none"
+	authGSSAPI              = "gssapi-with-mic"
+	authPublicKey           = "publickey"
+	authKey                 = "key"
+	authAgent               = "agent"
+	authPassword            = "password"
+	authKeyboardInteractive = "keyboard-interactive"
+)
+
+// defaultAuthOrder tries explicit keys, then the agent, then the default
+// keys, then the password and last keyboard-interactive.
+var defaultAuthOrder = []string{authGSSAPI, authPublicKey, authPassword, authKeyboardInteractive}
+
+func checkAuthOrder(order []string) error {
+	for _, m := range order {
+		switch m {
+		case authGSSAPI, authPublicKey, authKey, authAgent, authPassword, authKeyboardInteractive:
+		default:
+			return fmt.Errorf("invalid auth method %s, must be one of %s", m, strings.Join([]string{authGSSAPI, authPublicKey, authKey, authAgent, authPassword, authKeyboardInteractive}, ", "))
+		}
+	}
+	return nil
+}
+
+// authOrder returns the auth methods to try for h, in order: AuthOrder, or
+// else PreferredAuthentications from the ssh config, or else the default.
+func (p *Plan) authOrder(h *Host) []string {
+	if len(p.AuthOrder) > 0 {
+		return p.AuthOrder
+	}
+	if len(h.authOrder) > 0 {
+		return h.authOrder
+	}
+	return defaultAuthOrder
+}
+
+// sshConfigAuthOrder parses a PreferredAuthentications value, skipping
+// methods xsh doesn't implement such as hostbased.
+func sshConfigAuthOrder(v string) []string {
+	var order []string
+	for _, m := range strings.Split(v, ",") {
+		m = strings.TrimSpace(m)
+		if m != "" && checkAuthOrder([]string{m}) == nil {
+			order = append(order, m)
+		}
+	}
+	return order
+}
+
+// authMethods are the auth methods available for a host, nil if not.
+type authMethods struct {
+	gssapi   ssh.AuthMethod
+	password ssh.AuthMethod
+	ki       ssh.AuthMethod
+
+	// signers are explicit and issued keys, defaults those found in ~/.ssh
+	signers  []ssh.Signer
+	agent    agent.ExtendedAgent
+	defaults []ssh.Signer
+}
+
+// ordered returns the methods in the order given. Public keys share a single
+// method as the ssh client tries each method name only once, it goes where
+// the first of publickey, key or agent is.
+func (m *authMethods) ordered(h *Host, order []string) []ssh.AuthMethod {
+	pos := map[string]int{}
+	for i, name := range order {
+		if _, ok := pos[name]; !ok {
+			pos[name] = i
+		}
+	}
+	_, publicKey := pos[authPublicKey]
+	keyPos, key := pos[authKey]
+	agentPos, useAgent := pos[authAgent]
+
+	var auth []ssh.AuthMethod
+	addedKeys := false
+	for _, name := range order {
+		switch name {
+		case authGSSAPI:
+			if m.gssapi != nil {
+				auth = append(auth, m.gssapi)
+			}
+		case authPassword:
+			if m.password != nil {
+				auth = append(auth, m.password)
+			}
+		case authKeyboardInteractive:
+			auth = append(auth, m.ki)
+		case authPublicKey, authKey, authAgent:
+			if addedKeys {
+				continue
+			}
+			addedKeys = true
+
+			signers, a, defaults := m.signers, m.agent, m.defaults
+			files := append(append([]ssh.Signer{}, signers...), defaults...)
+			switch {
+			case publicKey:
+				// like ssh, explicit keys, then the agent, then the defaults
+			case key && useAgent && agentPos < keyPos:
+				signers, defaults = nil, files
+			case key && useAgent:
+				signers, defaults = files, nil
+			case key:
+				a = nil
+			default:
+				signers, defaults = nil, nil
+			}
+			auth = append(auth, publicKeys(h, signers, a, defaults))
+		}
+	}
+	return auth
+}
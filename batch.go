@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkHostCount checks a number of hosts given as N or as a percentage N%.
+func checkHostCount(name, count string) error {
+	if count == "" {
+		return nil
+	}
+	if _, err := hostCount(count, 1); err != nil {
+		return fmt.Errorf("invalid %s %s, %v", name, count, err)
+	}
+	return nil
+}
+
+// hostCount returns how many of total hosts count, N or N%, is. Percentages
+// round up, so they are at least one host.
+func hostCount(count string, total int) (int, error) {
+	digits, percent := strings.CutSuffix(count, "%")
+	n, err := strconv.Atoi(digits)
+	if err != nil || n < 1 || (percent && n > 100) {
+		return 0, fmt.Errorf("must be a number of hosts or a percentage of them")
+	}
+	if percent {
+		return (total*n + 99) / 100, nil
+	}
+	return n, nil
+}
+
+// batches splits hosts into the waves BatchSize runs them in, or returns them
+// as one batch.
+func (p *Plan) batches(hosts []*Host) [][]*Host {
+	size := len(hosts)
+	if p.BatchSize != "" {
+		// checked by OpenConns
+		size, _ = hostCount(p.BatchSize, len(hosts))
+	}
+	if size < 1 {
+		return [][]*Host{hosts}
+	}
+
+	var batches [][]*Host
+	for len(hosts) > size {
+		batches = append(batches, hosts[:size])
+		hosts = hosts[size:]
+	}
+	return append(batches, hosts)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// newAgentCmd returns the agent command, for inspecting the ssh-agent hosts
+// are authenticated with.
+func newAgentCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "agent",
+		Short: "Inspect the ssh-agent used to authenticate",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "ls",
+		Short:        "List the identities held by the agent, like ssh-add -l",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newPlan()
+			if err != nil {
+				return err
+			}
+
+			keys, err := p.AgentKeys()
+			if err != nil {
+				return err
+			}
+
+			printAgentKeys(os.Stdout, keys)
+			return nil
+		},
+	})
+
+	return cmd
+}
+
+func printAgentKeys(w io.Writer, keys []*agent.Key) {
+	if len(keys) == 0 {
+		fmt.Fprintln(w, "The agent has no identities.")
+		return
+	}
+
+	for _, k := range keys {
+		pub, err := ssh.ParsePublicKey(k.Marshal())
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(w, "%d %s %s (%s)\n", keyBits(pub), ssh.FingerprintSHA256(pub), k.Comment, keyTypeName(pub.Type()))
+	}
+}
+
+// keyBits returns the size of pub, as printed by ssh-add.
+func keyBits(pub ssh.PublicKey) int {
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+
+	switch pub.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoSKED25519, ssh.KeyAlgoSKECDSA256:
+		return 256
+	}
+
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+	switch k := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	}
+	return 0
+}
+
+// keyTypeName maps a key type to the short name ssh-add prints for it.
+func keyTypeName(keyType string) string {
+	cert := strings.Contains(keyType, "-cert-")
+	name := strings.ToUpper(keyType)
+	switch {
+	case strings.Contains(keyType, "ed25519"):
+		name = "ED25519"
+	case strings.Contains(keyType, "ecdsa"):
+		name = "ECDSA"
+	case strings.Contains(keyType, "rsa"):
+		name = "RSA"
+	case strings.Contains(keyType, "dss"):
+		name = "DSA"
+	}
+
+	if strings.HasPrefix(keyType, "sk-") {
+		name += "-SK"
+	}
+	if cert {
+		name += "-CERT"
+	}
+	return name
+}
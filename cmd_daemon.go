@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// newDaemonCmd returns the daemon command, which holds connections to the
+// hosts open so later runs skip connecting and authenticating, like an
+// OpenSSH ControlMaster.
+func newDaemonCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "daemon",
+		Short: "Keep connections to the hosts open for later runs to go through",
+		Long: `Connect to the hosts and keep the connections open until interrupted.
+Runs for the same hosts go through the daemon's socket instead of connecting
+themselves, hosts it isn't connected to are connected to directly.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newPlan()
+			if err != nil {
+				return err
+			}
+			defer p.wipeSecrets()
+
+			l, err := p.ListenDaemon()
+			if err != nil {
+				return err
+			}
+			defer l.Close()
+
+			if err := p.OpenConns(); err != nil {
+				return err
+			}
+			defer close(p.stop)
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				l.Close()
+			}()
+
+			connected := p.connectErrors(os.Stderr)
+			fmt.Fprintf(os.Stderr, "xsh daemon listening on %s for %d hosts\n", l.Addr(), connected)
+			return p.ServeDaemon(l)
+		},
+	}
+}
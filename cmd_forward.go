@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// newForwardCmd returns the forward command, which forwards local ports to
+// services on the hosts for debugging them.
+func newForwardCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	var locals []string
+
+	cmd := &cobra.Command{
+		Use:   "forward",
+		Short: "Forward local ports through the hosts, like ssh -L",
+		Long: `Forward local ports through each host until interrupted. Every host gets
+its own local port, the given port for the first host and the ones after it
+for the others, or ports picked by the system if the port is 0.`,
+		Example:      "  xsh forward -L 8080:localhost:80 --hosts admin@web[01-03]",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(locals) == 0 {
+				return fmt.Errorf("no forwards given, use -L")
+			}
+
+			p, err := newPlan()
+			if err != nil {
+				return err
+			}
+			defer p.wipeSecrets()
+			// forwards need a connection of their own
+			p.DaemonSocket = daemonNone
+
+			if err := p.OpenConns(); err != nil {
+				return err
+			}
+			defer close(p.stop)
+			if p.connectErrors(os.Stderr) == 0 {
+				return fmt.Errorf("no host could be connected to")
+			}
+
+			forwards, err := p.ListenLocalForwards(locals)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			for _, f := range forwards {
+				fmt.Printf("%s -> %s via %s\n", f.Local, f.Remote, f.Host)
+				go func(f *LocalForward) {
+					if err := f.Serve(); err != nil {
+						fmt.Fprintf(os.Stderr, "forward %s stopped: %v\n", f.Local, err)
+					}
+				}(f)
+			}
+
+			<-ctx.Done()
+			for _, f := range forwards {
+				f.Close()
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringArrayVarP(&locals, "local", "L", []string{}, "forward [bind_address:]port:host:hostport, connecting to host:hostport from each host")
+	return cmd
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var errInvalidHosts = errors.New("host validation failed")
+
+// newHostsCmd returns the hosts command, for inspecting targets without
+// connecting to them.
+func newHostsCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "hosts",
+		Short: "Inspect the resolved target hosts",
+	}
+
+	cmd.AddCommand(&cobra.Command{
+		Use:          "validate",
+		Short:        "Resolve every host source and report duplicate, malformed and unresolvable hosts",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newPlan()
+			if err != nil {
+				return err
+			}
+
+			report, err := p.ValidateHosts(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			report.Print(os.Stdout)
+			if !report.OK() {
+				// the report already says what is wrong, only the exit
+				// status is left
+				cmd.SilenceErrors = true
+				return errInvalidHosts
+			}
+			return nil
+		},
+	})
+
+	return cmd
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// newJobsCmd returns the jobs command, which lists the jobs started with
+// --detach.
+func newJobsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:          "jobs",
+		Short:        "List the jobs started with --detach",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jobs, err := LoadJobs()
+			if err != nil {
+				return err
+			}
+			for _, job := range jobs {
+				fmt.Printf("%s\t%s\t%d hosts\t%s\n", job.ID, job.Started.Format(time.RFC3339), len(job.Hosts), strings.ReplaceAll(job.Command, "\n", " "))
+			}
+			return nil
+		},
+	}
+}
+
+// newAttachCmd returns the attach command, which checks on a detached job and
+// shows its output so far.
+func newAttachCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "attach <id>",
+		Short: "Show how a job started with --detach is doing and its output so far",
+		Long: `Connect to the hosts a detached job was started on and show, for each
+of them, whether it is still running or how it exited, and the output it has
+written so far. The hosts are reached at the addresses the job recorded, with
+the connection options given here.`,
+		Example:      "  xsh attach 3f9a0c1e",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return checkJob(cmd, newPlan, args[0], false, false)
+		},
+	}
+}
+
+// newReapCmd returns the reap command, which collects the output of a
+// detached job and removes it from its hosts.
+func newReapCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	var kill bool
+
+	cmd := &cobra.Command{
+		Use:   "reap <id>",
+		Short: "Collect the output of a job started with --detach and clean it up",
+		Long: `Show the output of a detached job like attach, then remove it from the
+hosts it is done on. Hosts it still runs on are left alone unless --kill is
+given, and the job is only forgotten here once it is done on all of them.`,
+		Example:      "  xsh reap 3f9a0c1e",
+		Args:         cobra.ExactArgs(1),
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return checkJob(cmd, newPlan, args[0], true, kill)
+		},
+	}
+
+	cmd.Flags().BoolVar(&kill, "kill", false, "kill the job where it still runs, with SIGTERM then SIGKILL")
+	return cmd
+}
+
+func checkJob(cmd *cobra.Command, newPlan func() (*Plan, error), id string, reap, kill bool) error {
+	job, err := LoadJob(id)
+	if err != nil {
+		return err
+	}
+
+	p, err := newPlan()
+	if err != nil {
+		return err
+	}
+	defer p.wipeSecrets()
+
+	statuses, err := p.CheckJob(cmd.Context(), job, reap, kill)
+	PrintJobStatuses(os.Stdout, statuses)
+	return err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var errUnreachableHosts = errors.New("not every host could be logged in to")
+
+// newPingCmd returns the ping command, a pre-flight check that every host
+// answers and lets us in before running anything on them.
+func newPingCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	return &cobra.Command{
+		Use:   "ping",
+		Short: "Check that every host is reachable and accepts our credentials",
+		Long: `Connect to every host in parallel, read the ssh version it announces and
+try to log in, without running anything. Each host is reported as reachable,
+auth-required if it answered but turned down our credentials, or unreachable.
+Exits non-zero unless every host is reachable.`,
+		Example:      "  xsh ping --hosts admin@web[01-20]",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newPlan()
+			if err != nil {
+				return err
+			}
+			defer p.wipeSecrets()
+			// the point is to check the hosts themselves
+			p.DaemonSocket = daemonNone
+
+			report, err := p.Ping(cmd.Context())
+			if err != nil {
+				return err
+			}
+
+			report.Print(os.Stdout)
+			if !report.OK() {
+				return errUnreachableHosts
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// newSOCKSCmd returns the socks command, a local SOCKS5 proxy through a host.
+func newSOCKSCmd(newPlan func() (*Plan, error)) *cobra.Command {
+	var via string
+	var dynamic string
+
+	cmd := &cobra.Command{
+		Use:          "socks",
+		Short:        "Open a local SOCKS5 proxy tunnelled through a host, like ssh -D",
+		Example:      "  xsh socks --via admin@bastion.example.com -D 1080",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			addr, err := socksListenAddr(dynamic)
+			if err != nil {
+				return err
+			}
+
+			p, err := newPlan()
+			if err != nil {
+				return err
+			}
+			defer p.wipeSecrets()
+			if via != "" {
+				p.PlainHosts = []string{via}
+			}
+			// the proxy needs a connection of its own
+			p.DaemonSocket = daemonNone
+			p.RequireAll = true
+
+			if err := p.ResolveHosts(); err != nil {
+				return err
+			}
+			if len(p.hosts) != 1 {
+				return fmt.Errorf("a SOCKS proxy goes through one host, %d selected, use --via", len(p.hosts))
+			}
+
+			if err := p.OpenConns(); err != nil {
+				return err
+			}
+			defer close(p.stop)
+
+			s, err := p.ListenSOCKS(addr)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				<-ctx.Done()
+				s.Close()
+			}()
+
+			fmt.Printf("SOCKS5 proxy on %s via %s\n", s.Local, s.Host)
+			return s.Serve()
+		},
+	}
+
+	cmd.Flags().StringVar(&via, "via", "", "[user@]host[:port] to tunnel through, instead of the selected hosts")
+	cmd.Flags().StringVarP(&dynamic, "dynamic", "D", "1080", "[bind_address:]port to listen on for SOCKS5 clients")
+	return cmd
+}
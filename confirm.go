@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// defaultConfirmAbove is how many hosts a run may target before xsh asks to
+// confirm it, unless --confirm-above says otherwise.
+const defaultConfirmAbove = 20
+
+// maxConfirmHosts caps how many of the targeted hosts are listed when asking
+// to confirm a run.
+const maxConfirmHosts = 50
+
+// ErrNotConfirmed is returned by Confirm when the run wasn't confirmed.
+var ErrNotConfirmed = errors.New("run not confirmed")
+
+// Confirm shows the hosts and commands of the run and asks for the number of
+// hosts to be typed to go on with it, if it targets more than ConfirmAbove
+// hosts. Yes skips asking.
+func (p *Plan) Confirm() error {
+	if p.Yes || p.ConfirmAbove <= 0 || len(p.hosts) <= p.ConfirmAbove {
+		return nil
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "About to run on %d hosts:\n", len(p.hosts))
+	for i := range p.hosts {
+		if i == maxConfirmHosts {
+			fmt.Fprintf(&b, "  ... and %d more\n", len(p.hosts)-i)
+			break
+		}
+		fmt.Fprintf(&b, "  %s\n", p.hosts[i].name)
+	}
+	if p.Script != "" {
+		fmt.Fprintf(&b, "script: %s %s\n", p.Script, strings.Join(p.ScriptArgs, " "))
+	}
+	if p.Command != "" {
+		fmt.Fprintf(&b, "command: %s\n", p.Command)
+	}
+	for _, group := range sortedKeys(p.groupCommands) {
+		fmt.Fprintf(&b, "command for %s: %s\n", group, p.groupCommands[group])
+	}
+	for _, step := range p.Steps {
+		fmt.Fprintf(&b, "command: %s\n", step)
+	}
+	fmt.Fprintf(&b, "Type %d to continue: ", len(p.hosts))
+
+	p.promptMu.Lock()
+	defer p.promptMu.Unlock()
+	answer, err := readTerminal(b.String(), true)
+	if err != nil {
+		return fmt.Errorf("%w: %v, use --yes to run without asking", ErrNotConfirmed, err)
+	}
+	if strings.TrimSpace(answer) != strconv.Itoa(len(p.hosts)) {
+		return ErrNotConfirmed
+	}
+	return nil
+}
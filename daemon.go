@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/danvixent/sshx/util"
+	"golang.org/x/crypto/ssh"
+)
+
+// defaultDaemonSocket is where xsh daemon listens and where runs look for it.
+const defaultDaemonSocket = "~/.xsh/daemon.sock"
+
+// daemonNone as the daemon socket stops runs from using a daemon.
+const daemonNone = "none"
+
+// Requests a daemon answers, one per connection.
+const (
+	daemonOpHosts = "hosts"
+	daemonOpRun   = "run"
+)
+
+type daemonRequest struct {
+	Op      string `json:"op"`
+	Host    string `json:"host,omitempty"`
+	Command string `json:"command,omitempty"`
+	// Sudo answers the sudo prompt of the command
+	Sudo *sudoExchange `json:"sudo,omitempty"`
+}
+
+type daemonResponse struct {
+	// Hosts maps the hosts the daemon is connected to, to the auth method
+	// they accepted
+	Hosts      map[string]string `json:"hosts,omitempty"`
+	Output     []byte            `json:"output,omitempty"`
+	Stderr     []byte            `json:"stderr,omitempty"`
+	ExitStatus int               `json:"exit_status,omitempty"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// daemonExitError is returned for commands run through a daemon that exited
+// with a non-zero status, like ssh.ExitError is for those run directly.
+type daemonExitError struct {
+	status int
+}
+
+func (e *daemonExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.status)
+}
+
+func (e *daemonExitError) ExitStatus() int { return e.status }
+
+// daemonKey identifies a connection the daemon holds, runs resolve hosts to
+// the same key to find it.
+func daemonKey(h *Host) string {
+	return h.user + "@" + h.host
+}
+
+// daemonSocket returns the socket of the daemon to run through, or "" to
+// connect directly. The default socket is only used if it exists.
+func (p *Plan) daemonSocket() string {
+	if p.serving {
+		// a daemon connects to hosts itself
+		return ""
+	}
+
+	switch p.DaemonSocket {
+	case daemonNone:
+		return ""
+	case "":
+		sock := util.ExpandHome(defaultDaemonSocket)
+		if _, err := os.Stat(sock); err != nil {
+			return ""
+		}
+		return sock
+	default:
+		return util.ExpandHome(p.DaemonSocket)
+	}
+}
+
+// daemonHosts returns the hosts the daemon is connected to. A daemon that
+// was asked for explicitly must answer, a stale default socket is ignored.
+func (p *Plan) daemonHosts() (map[string]string, error) {
+	sock := p.daemonSocket()
+	if sock == "" {
+		return nil, nil
+	}
+
+	resp, err := daemonCall(sock, daemonRequest{Op: daemonOpHosts})
+	if err != nil {
+		if p.DaemonSocket == "" {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to reach daemon at %s: %v", sock, err)
+	}
+	return resp.Hosts, nil
+}
+
+// useDaemon routes the hosts the daemon is connected to through it, and
+// reports whether that is all of them.
+func (p *Plan) useDaemon() (bool, error) {
+	if len(p.RemoteForwards) > 0 {
+		// forwards are set up on a connection of the run's own
+		return false, nil
+	}
+
+	held, err := p.daemonHosts()
+	if err != nil {
+		return false, err
+	}
+
+	all := true
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		method, ok := held[daemonKey(h)]
+		if !ok {
+			all = false
+			continue
+		}
+		h.daemon = p.daemonSocket()
+		h.authMethod = method
+	}
+	return all, nil
+}
+
+// runDaemon runs command on h through the daemon holding its connection, and
+// returns what it wrote to stdout and stderr.
+func (p *Plan) runDaemon(ctx context.Context, h *Host, command string) ([]byte, []byte, error) {
+	type output struct {
+		resp *daemonResponse
+		err  error
+	}
+	done := make(chan output, 1)
+	conn, err := net.Dial("unix", h.daemon)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reach daemon: %v", err)
+	}
+	defer conn.Close()
+
+	go func() {
+		resp, err := daemonRoundTrip(conn, daemonRequest{Op: daemonOpRun, Host: daemonKey(h), Command: command, Sudo: p.sudo})
+		done <- output{resp, err}
+	}()
+
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return nil, nil, fmt.Errorf("failed to run through daemon: %v", o.err)
+		}
+		if o.resp.ExitStatus != 0 {
+			return o.resp.Output, o.resp.Stderr, &daemonExitError{status: o.resp.ExitStatus}
+		}
+		if o.resp.Error != "" {
+			return o.resp.Output, o.resp.Stderr, errors.New(o.resp.Error)
+		}
+		return o.resp.Output, o.resp.Stderr, nil
+	case <-ctx.Done():
+		// the daemon stops the command when we hang up
+		return nil, nil, fmt.Errorf("command stopped: %v", ctx.Err())
+	}
+}
+
+func daemonCall(sock string, req daemonRequest) (*daemonResponse, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return daemonRoundTrip(conn, req)
+}
+
+func daemonRoundTrip(conn net.Conn, req daemonRequest) (*daemonResponse, error) {
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp daemonResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ListenDaemon listens on the daemon socket, replacing a stale one. Only the
+// user can connect to it.
+func (p *Plan) ListenDaemon() (net.Listener, error) {
+	sock := util.ExpandHome(defaultDaemonSocket)
+	if p.DaemonSocket != "" && p.DaemonSocket != daemonNone {
+		sock = util.ExpandHome(p.DaemonSocket)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sock), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	if _, err := daemonCall(sock, daemonRequest{Op: daemonOpHosts}); err == nil {
+		return nil, fmt.Errorf("a daemon is already listening on %s", sock)
+	}
+	_ = os.Remove(sock)
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", sock, err)
+	}
+	if err := os.Chmod(sock, 0o600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("failed to restrict socket: %v", err)
+	}
+	p.serving = true
+	return l, nil
+}
+
+// ServeDaemon answers runs on l with the connections opened by OpenConns,
+// until l is closed.
+func (p *Plan) ServeDaemon(l net.Listener) error {
+	hosts := map[string]*Host{}
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		if h.client == nil {
+			continue
+		}
+		// sessions are opened per request
+		if h.session != nil {
+			_ = h.session.Close()
+			h.session = nil
+		}
+		hosts[daemonKey(h)] = h
+	}
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			p.serveDaemonConn(conn, hosts)
+		}()
+	}
+}
+
+func (p *Plan) serveDaemonConn(conn net.Conn, hosts map[string]*Host) {
+	var req daemonRequest
+	dec := json.NewDecoder(conn)
+	if err := dec.Decode(&req); err != nil {
+		return
+	}
+
+	var resp daemonResponse
+	switch req.Op {
+	case daemonOpHosts:
+		resp.Hosts = make(map[string]string, len(hosts))
+		for key, h := range hosts {
+			if h.connectionLost() == nil {
+				resp.Hosts[key] = h.authMethod
+			}
+		}
+	case daemonOpRun:
+		h, ok := hosts[req.Host]
+		if !ok {
+			resp.Error = fmt.Sprintf("daemon is not connected to %s", req.Host)
+			break
+		}
+		resp = p.serveDaemonRun(h, req, dec)
+	default:
+		resp.Error = fmt.Sprintf("unknown daemon request %q", req.Op)
+	}
+
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+// serveDaemonRun runs the command of req on h, stopping it if the run that
+// asked for it hangs up first.
+func (p *Plan) serveDaemonRun(h *Host, req daemonRequest, dec *json.Decoder) daemonResponse {
+	session, err := p.daemonSession(h)
+	if err != nil {
+		if lost := h.connectionLost(); lost != nil {
+			err = lost
+		}
+		return daemonResponse{Error: fmt.Sprintf("failed to start ssh session: %v", err)}
+	}
+	defer p.daemonSessionDone(h)
+	defer session.Close()
+
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		// nothing more is sent, so this returns when the run hangs up
+		var v struct{}
+		if err := dec.Decode(&v); err != nil {
+			stopSession(session, exited)
+		}
+	}()
+
+	var out, stderr []byte
+	if req.Sudo != nil {
+		out, stderr, err = req.Sudo.run(session, req.Command, nil, nil)
+	} else {
+		var errBuf bytes.Buffer
+		session.Stderr = &errBuf
+		out, err = session.Output(req.Command)
+		stderr = errBuf.Bytes()
+	}
+	var resp daemonResponse
+	resp.Output, resp.Stderr = out, stderr
+	var exitErr *ssh.ExitError
+	switch {
+	case errors.As(err, &exitErr) && exitErr.ExitStatus() != 0:
+		resp.ExitStatus = exitErr.ExitStatus()
+	case err != nil:
+		if lost := h.connectionLost(); lost != nil {
+			err = lost
+		}
+		resp.Error = err.Error()
+	}
+	return resp
+}
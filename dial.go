@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// Dialer opens network connections, such as a net.Dialer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// commandConn is a connection over the stdin and stdout of a local command,
+// such as a proxy client that tunnels to the host.
+type commandConn struct {
+	addr   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+// dialCommand starts the named command and returns a connection to addr over
+// its stdio. The command's stderr goes to ours, like it does with ssh.
+func dialCommand(addr, name string, args ...string) (net.Conn, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("%s not found in PATH", name)
+		}
+		return nil, err
+	}
+
+	return &commandConn{addr: addr, cmd: cmd, stdin: stdin, stdout: stdout}, nil
+}
+
+// dialProxyCommand runs an OpenSSH style ProxyCommand through the shell and
+// returns a connection over its stdio.
+func dialProxyCommand(addr, command string) (net.Conn, error) {
+	if runtime.GOOS == "windows" {
+		return dialCommand(addr, "cmd", "/c", command)
+	}
+	// like ssh, exec so the shell doesn't linger
+	return dialCommand(addr, "/bin/sh", "-c", "exec "+command)
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+// Close closes the command's stdin and stops it.
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+	_ = c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr("") }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr(c.addr) }
+
+// deadlines are not supported, the ssh package doesn't set any
+func (c *commandConn) SetDeadline(time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(time.Time) error { return nil }
+
+// commandAddr is the host:port a command or tunnel connects to, as host key
+// checks need one.
+type commandAddr string
+
+func (a commandAddr) Network() string { return "command" }
+func (a commandAddr) String() string  { return string(a) }
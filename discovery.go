@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// discoverHosts queries every dynamic inventory source configured on the
+// plan, such as cloud provider APIs.
+func (p *Plan) discoverHosts() ([]hostSpec, error) {
+	var specs []hostSpec
+
+	if p.AWS.enabled() {
+		aws, err := p.AWS.hosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover aws hosts: %v", err)
+		}
+		specs = append(specs, aws...)
+	}
+
+	if p.GCP.enabled() {
+		gcp, err := p.GCP.hosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover gcp hosts: %v", err)
+		}
+		specs = append(specs, gcp...)
+	}
+
+	if p.Azure.enabled() {
+		azure, err := p.Azure.hosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover azure hosts: %v", err)
+		}
+		specs = append(specs, azure...)
+	}
+
+	if p.Consul.enabled() {
+		consul, err := p.Consul.hosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover consul hosts: %v", err)
+		}
+		specs = append(specs, consul...)
+	}
+
+	if p.Kubernetes.enabled() {
+		k8s, err := p.Kubernetes.hosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover kubernetes nodes: %v", err)
+		}
+		specs = append(specs, k8s...)
+	}
+
+	if p.Terraform.enabled() {
+		tf, err := p.Terraform.hosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read terraform state: %v", err)
+		}
+		specs = append(specs, tf...)
+	}
+
+	if p.Vagrant.enabled() {
+		vagrant, err := p.vagrantHosts()
+		if err != nil {
+			return nil, fmt.Errorf("failed to discover vagrant machines: %v", err)
+		}
+		specs = append(specs, vagrant...)
+	}
+
+	if p.FromKnownHosts != "" {
+		known, err := knownHostsTargets(defaultKnownHostsFile, p.FromKnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read known hosts: %v", err)
+		}
+		specs = append(specs, known...)
+	}
+
+	return specs, nil
+}
+
+// Discovered tags and labels are stored in the host vars under these
+// prefixes, like tag.Name. Anyone able to tag a machine sets them, so they
+// must not reach the connection vars inventories set, such as
+// ansible_password or xsh_proxy.
+const (
+	tagVarPrefix   = "tag."
+	labelVarPrefix = "label."
+)
+
+// addPrefixedVars copies m into vars, prefixing every key with prefix.
+func addPrefixedVars(vars map[string]string, prefix string, m map[string]string) {
+	for k, v := range m {
+		vars[prefix+k] = v
+	}
+}
+
+// execJSON runs the named command and decodes its JSON output into v.
+// Provider CLIs are used instead of SDKs so their existing credential setup
+// is reused as is.
+func execJSON(v any, name string, args ...string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%s not found in PATH", name)
+		}
+		return fmt.Errorf("%s %s: %v: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), v); err != nil {
+		return fmt.Errorf("failed to decode %s output: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AWSOptions selects EC2 instances to target by tag.
+type AWSOptions struct {
+	// Tags are Key=Value filters, values may contain * wildcards. A bare
+	// Key matches any instance that has the tag.
+	Tags    []string
+	Region  string
+	Profile string
+	// User is the login user for every discovered instance
+	User string
+	// Address is either "private" or "public"
+	Address string
+	// InstanceConnect pushes a throwaway key to every instance with EC2
+	// Instance Connect right before dialing it
+	InstanceConnect bool
+}
+
+type ec2Output struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceId       string
+			PrivateIpAddress string
+			PublicIpAddress  string
+			Tags             []struct {
+				Key   string
+				Value string
+			}
+		}
+	}
+}
+
+func (o *AWSOptions) enabled() bool { return len(o.Tags) > 0 }
+
+// hosts lists running EC2 instances matching the tag filters using the aws cli.
+func (o *AWSOptions) hosts() ([]hostSpec, error) {
+	if o.Address != "" && o.Address != "private" && o.Address != "public" {
+		return nil, fmt.Errorf("invalid address type %s, must be private or public", o.Address)
+	}
+
+	args := []string{"ec2", "describe-instances", "--output", "json", "--filters", "Name=instance-state-name,Values=running"}
+	for _, tag := range o.Tags {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			args = append(args, "Name=tag-key,Values="+key)
+			continue
+		}
+		args = append(args, fmt.Sprintf("Name=tag:%s,Values=%s", key, value))
+	}
+	if o.Region != "" {
+		args = append(args, "--region", o.Region)
+	}
+	if o.Profile != "" {
+		args = append(args, "--profile", o.Profile)
+	}
+
+	var out ec2Output
+	if err := execJSON(&out, "aws", args...); err != nil {
+		return nil, err
+	}
+
+	var specs []hostSpec
+	for _, r := range out.Reservations {
+		for _, i := range r.Instances {
+			addr := i.PrivateIpAddress
+			if o.Address == "public" {
+				addr = i.PublicIpAddress
+			}
+			if addr == "" {
+				continue
+			}
+
+			vars := map[string]string{varInstanceID: i.InstanceId}
+			for _, t := range i.Tags {
+				vars[tagVarPrefix+t.Key] = t.Value
+			}
+
+			spec := addr
+			if o.User != "" {
+				spec = o.User + "@" + addr
+			}
+			specs = append(specs, hostSpec{spec: spec, name: i.InstanceId, vars: vars})
+		}
+	}
+
+	return specs, nil
+}
+
+// varInstanceID is set on discovered EC2 instances and can be set on
+// inventory hosts to use EC2 Instance Connect with them.
+const varInstanceID = "instance_id"
+
+type sendSSHPublicKeyOutput struct {
+	RequestId string
+	Success   bool
+}
+
+// setupInstanceConnect generates the key pushed to instances for this run.
+// The key only ever lives in memory.
+func (p *Plan) setupInstanceConnect() error {
+	if !p.AWS.InstanceConnect {
+		return nil
+	}
+
+	signer, err := ephemeralSigner()
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+	p.instanceConnectSigner = signer
+	return nil
+}
+
+// pushInstanceConnectKey authorizes the run's key for the login user of h
+// using the aws cli. Instance Connect keys are only valid for 60 seconds, so
+// this is done right before dialing.
+func (p *Plan) pushInstanceConnectKey(h *Host) error {
+	if p.instanceConnectSigner == nil {
+		return nil
+	}
+
+	id := h.vars[varInstanceID]
+	if id == "" {
+		return fmt.Errorf("no instance id for host %s, set %s in the inventory", h.name, varInstanceID)
+	}
+
+	args := []string{"ec2-instance-connect", "send-ssh-public-key", "--output", "json",
+		"--instance-id", id,
+		"--instance-os-user", h.user,
+		"--ssh-public-key", strings.TrimSpace(string(ssh.MarshalAuthorizedKey(p.instanceConnectSigner.PublicKey()))),
+	}
+	if p.AWS.Region != "" {
+		args = append(args, "--region", p.AWS.Region)
+	}
+	if p.AWS.Profile != "" {
+		args = append(args, "--profile", p.AWS.Profile)
+	}
+
+	var out sendSSHPublicKeyOutput
+	if err := execJSON(&out, "aws", args...); err != nil {
+		return err
+	}
+	if !out.Success {
+		return fmt.Errorf("request %s was not successful", out.RequestId)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// AzureOptions selects Azure VMs to target by resource group and/or tag.
+type AzureOptions struct {
+	ResourceGroup string
+	// Tags are Key=Value filters, values may contain * wildcards. A bare
+	// Key matches any VM that has the tag.
+	Tags         []string
+	Subscription string
+	// User is the login user for every discovered VM
+	User string
+	// Address is either "private" or "public"
+	Address string
+}
+
+type azureVM struct {
+	Name          string
+	ResourceGroup string
+	Location      string
+	Tags          map[string]string
+	PowerState    string
+	// PrivateIps and PublicIps are comma separated lists
+	PrivateIps string
+	PublicIps  string
+}
+
+func (o *AzureOptions) enabled() bool { return o.ResourceGroup != "" || len(o.Tags) > 0 }
+
+// hosts lists running Azure VMs using the az cli.
+func (o *AzureOptions) hosts() ([]hostSpec, error) {
+	if o.Address != "" && o.Address != "private" && o.Address != "public" {
+		return nil, fmt.Errorf("invalid address type %s, must be private or public", o.Address)
+	}
+
+	args := []string{"vm", "list", "--show-details", "--output", "json"}
+	if o.ResourceGroup != "" {
+		args = append(args, "--resource-group", o.ResourceGroup)
+	}
+	if o.Subscription != "" {
+		args = append(args, "--subscription", o.Subscription)
+	}
+
+	var vms []azureVM
+	if err := execJSON(&vms, "az", args...); err != nil {
+		return nil, err
+	}
+
+	var specs []hostSpec
+	for _, vm := range vms {
+		if vm.PowerState != "" && vm.PowerState != "VM running" {
+			continue
+		}
+		if !o.matchesTags(vm.Tags) {
+			continue
+		}
+
+		ips := vm.PrivateIps
+		if o.Address == "public" {
+			ips = vm.PublicIps
+		}
+		addr, _, _ := strings.Cut(ips, ",")
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+
+		vars := map[string]string{"resource_group": vm.ResourceGroup, "location": vm.Location}
+		addPrefixedVars(vars, tagVarPrefix, vm.Tags)
+
+		spec := addr
+		if o.User != "" {
+			spec = o.User + "@" + addr
+		}
+		specs = append(specs, hostSpec{spec: spec, name: vm.Name, vars: vars})
+	}
+
+	return specs, nil
+}
+
+func (o *AzureOptions) matchesTags(tags map[string]string) bool {
+	for _, tag := range o.Tags {
+		key, pattern, hasValue := strings.Cut(tag, "=")
+		value, ok := tags[key]
+		if !ok {
+			return false
+		}
+		if !hasValue {
+			continue
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const defaultConsulAddr = "http://127.0.0.1:8500"
+
+// ConsulOptions selects the nodes of a Consul service to target.
+type ConsulOptions struct {
+	Service string
+	// Addr is the Consul HTTP API address, defaulting to CONSUL_HTTP_ADDR
+	Addr       string
+	Datacenter string
+	Tags       []string
+	// User is the login user for every discovered node
+	User string
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Node       string
+		Address    string
+		Datacenter string
+	}
+	Service struct {
+		ID      string
+		Address string
+	}
+}
+
+func (o *ConsulOptions) enabled() bool { return o.Service != "" }
+
+// hosts lists the nodes providing the service whose health checks pass.
+func (o *ConsulOptions) hosts() ([]hostSpec, error) {
+	addr := o.Addr
+	if addr == "" {
+		addr = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if addr == "" {
+		addr = defaultConsulAddr
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+
+	q := url.Values{"passing": {"true"}}
+	if o.Datacenter != "" {
+		q.Set("dc", o.Datacenter)
+	}
+	for _, t := range o.Tags {
+		q.Add("tag", t)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(addr, "/"), url.PathEscape(o.Service), q.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("failed to decode consul response: %v", err)
+	}
+
+	var specs []hostSpec
+	for _, e := range entries {
+		// the service address is for the service itself, ssh runs on the node
+		addr := e.Node.Address
+		if addr == "" {
+			continue
+		}
+
+		spec := addr
+		if o.User != "" {
+			spec = o.User + "@" + addr
+		}
+		specs = append(specs, hostSpec{
+			spec: spec,
+			name: e.Node.Node,
+			vars: map[string]string{"datacenter": e.Node.Datacenter, "service_id": e.Service.ID},
+		})
+	}
+
+	return specs, nil
+}
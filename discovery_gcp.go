@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// osLoginKeyTTL is how long keys added to the OS Login profile stay valid,
+// they are only used to connect at the start of the run.
+const osLoginKeyTTL = "1h"
+
+// GCPOptions selects Compute Engine instances to target.
+type GCPOptions struct {
+	Project string
+	// Filter is a gcloud filter expression, e.g. labels.role=web
+	Filter string
+	// User is the login user for every discovered instance
+	User string
+	// OSLogin resolves the login user from the caller's OS Login profile and
+	// adds a throwaway key to it for the run
+	OSLogin bool
+	// Address is either "private" or "public"
+	Address string
+}
+
+type gcpInstance struct {
+	Name              string
+	Zone              string
+	Labels            map[string]string
+	NetworkInterfaces []struct {
+		NetworkIP     string
+		AccessConfigs []struct {
+			NatIP string
+		}
+	}
+}
+
+type gcpOSLoginProfile struct {
+	PosixAccounts []struct {
+		Username string
+		Primary  bool
+	}
+}
+
+type gcpImportSSHKeyOutput struct {
+	LoginProfile gcpOSLoginProfile
+}
+
+func (o *GCPOptions) enabled() bool { return o.Project != "" || o.Filter != "" }
+
+// hosts lists running Compute Engine instances using the gcloud cli.
+func (o *GCPOptions) hosts() ([]hostSpec, error) {
+	if o.Address != "" && o.Address != "private" && o.Address != "public" {
+		return nil, fmt.Errorf("invalid address type %s, must be private or public", o.Address)
+	}
+
+	filter := "status=RUNNING"
+	if o.Filter != "" {
+		filter = fmt.Sprintf("(%s) AND %s", o.Filter, filter)
+	}
+
+	args := []string{"compute", "instances", "list", "--format=json", "--filter=" + filter}
+	if o.Project != "" {
+		args = append(args, "--project="+o.Project)
+	}
+
+	var instances []gcpInstance
+	if err := execJSON(&instances, "gcloud", args...); err != nil {
+		return nil, err
+	}
+
+	user := o.User
+	if user == "" && o.OSLogin {
+		var err error
+		user, err = o.osLoginUser()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var specs []hostSpec
+	for _, i := range instances {
+		addr := i.address(o.Address == "public")
+		if addr == "" {
+			continue
+		}
+
+		vars := map[string]string{"zone": i.Zone[strings.LastIndex(i.Zone, "/")+1:]}
+		addPrefixedVars(vars, labelVarPrefix, i.Labels)
+
+		spec := addr
+		if user != "" {
+			spec = user + "@" + addr
+		}
+		specs = append(specs, hostSpec{spec: spec, name: i.Name, vars: vars})
+	}
+
+	return specs, nil
+}
+
+func (i *gcpInstance) address(public bool) string {
+	for _, nic := range i.NetworkInterfaces {
+		if !public {
+			return nic.NetworkIP
+		}
+		for _, ac := range nic.AccessConfigs {
+			if ac.NatIP != "" {
+				return ac.NatIP
+			}
+		}
+	}
+	return ""
+}
+
+// osLoginUser returns the POSIX username OS Login assigned to the active
+// gcloud account.
+func (o *GCPOptions) osLoginUser() (string, error) {
+	args := []string{"compute", "os-login", "describe-profile", "--format=json"}
+	if o.Project != "" {
+		args = append(args, "--project="+o.Project)
+	}
+
+	var profile gcpOSLoginProfile
+	if err := execJSON(&profile, "gcloud", args...); err != nil {
+		return "", fmt.Errorf("failed to get os login profile: %v", err)
+	}
+
+	return profile.username()
+}
+
+func (profile *gcpOSLoginProfile) username() (string, error) {
+	for _, a := range profile.PosixAccounts {
+		if a.Primary {
+			return a.Username, nil
+		}
+	}
+	if len(profile.PosixAccounts) > 0 {
+		return profile.PosixAccounts[0].Username, nil
+	}
+
+	return "", fmt.Errorf("os login profile has no posix accounts")
+}
+
+// setupOSLogin generates a throwaway key and adds it to the OS Login profile
+// of the active gcloud account, so instances accept it without any key being
+// distributed. The private key only ever lives in memory.
+func (p *Plan) setupOSLogin() error {
+	if !p.GCP.OSLogin {
+		return nil
+	}
+
+	signer, err := ephemeralSigner()
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	args := []string{"compute", "os-login", "ssh-keys", "add", "--format=json", "--ttl=" + osLoginKeyTTL,
+		"--key=" + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))),
+	}
+	if p.GCP.Project != "" {
+		args = append(args, "--project="+p.GCP.Project)
+	}
+
+	var out gcpImportSSHKeyOutput
+	if err := execJSON(&out, "gcloud", args...); err != nil {
+		return fmt.Errorf("failed to add key to os login profile: %v", err)
+	}
+	if _, err := out.LoginProfile.username(); err != nil {
+		return err
+	}
+
+	p.osLoginSigner = signer
+	return nil
+}
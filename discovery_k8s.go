@@ -0,0 +1,85 @@
+package main
+
+import "fmt"
+
+// KubernetesOptions selects cluster nodes to target.
+type KubernetesOptions struct {
+	Nodes bool
+	// Selector is a label selector such as node-role.kubernetes.io/worker
+	Selector   string
+	Kubeconfig string
+	Context    string
+	// User is the login user for every node
+	User string
+	// Address is either "internal" or "external"
+	Address string
+}
+
+type k8sNodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name   string
+			Labels map[string]string
+		}
+		Status struct {
+			Addresses []struct {
+				Type    string
+				Address string
+			}
+		}
+	}
+}
+
+func (o *KubernetesOptions) enabled() bool { return o.Nodes }
+
+// hosts lists the cluster nodes matching the selector using kubectl.
+func (o *KubernetesOptions) hosts() ([]hostSpec, error) {
+	addrType := "InternalIP"
+	switch o.Address {
+	case "", "internal":
+	case "external":
+		addrType = "ExternalIP"
+	default:
+		return nil, fmt.Errorf("invalid address type %s, must be internal or external", o.Address)
+	}
+
+	args := []string{"get", "nodes", "--output=json"}
+	if o.Selector != "" {
+		args = append(args, "--selector="+o.Selector)
+	}
+	if o.Kubeconfig != "" {
+		args = append(args, "--kubeconfig="+o.Kubeconfig)
+	}
+	if o.Context != "" {
+		args = append(args, "--context="+o.Context)
+	}
+
+	var nodes k8sNodeList
+	if err := execJSON(&nodes, "kubectl", args...); err != nil {
+		return nil, err
+	}
+
+	var specs []hostSpec
+	for _, n := range nodes.Items {
+		var addr string
+		for _, a := range n.Status.Addresses {
+			if a.Type == addrType {
+				addr = a.Address
+				break
+			}
+		}
+		if addr == "" {
+			continue
+		}
+
+		spec := addr
+		if o.User != "" {
+			spec = o.User + "@" + addr
+		}
+		vars := map[string]string{}
+		addPrefixedVars(vars, labelVarPrefix, n.Metadata.Labels)
+		specs = append(specs, hostSpec{spec: spec, name: n.Metadata.Name, vars: vars})
+	}
+
+	return specs, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+)
+
+const defaultKnownHostsFile = "~/.ssh/known_hosts"
+
+// knownHostsTargets reads the hosts recorded in the user's known_hosts file
+// that match pattern. Hashed entries can't be read back and are skipped, as
+// are wildcard entries and @cert-authority/@revoked lines.
+func knownHostsTargets(path, pattern string) ([]hostSpec, error) {
+	hp, err := compileHostPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(util.ExpandHome(path))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var specs []hostSpec
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "@") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+
+		for _, name := range strings.Split(fields[0], ",") {
+			if strings.HasPrefix(name, "|") || strings.ContainsAny(name, "*?!") || seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			host, _ := splitAddr(name)
+			if !hp.match(host) && !hp.match(name) {
+				continue
+			}
+			specs = append(specs, hostSpec{spec: name})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	return specs, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TerraformOptions selects hosts from the compute resources in a Terraform
+// state file.
+type TerraformOptions struct {
+	StatePath string
+	// User is the login user for every discovered host
+	User string
+	// Address is either "private" or "public". Resources that only have the
+	// other kind of address fall back to it.
+	Address string
+}
+
+type terraformState struct {
+	Version   int
+	Resources []struct {
+		Module    string
+		Mode      string
+		Type      string
+		Name      string
+		Instances []struct {
+			IndexKey   any `json:"index_key"`
+			Attributes map[string]any
+		}
+	}
+}
+
+// terraformAddrAttrs maps supported resource types to the attribute paths
+// holding their private and public addresses.
+var terraformAddrAttrs = map[string]struct{ private, public string }{
+	"aws_instance":                  {"private_ip", "public_ip"},
+	"google_compute_instance":       {"network_interface.0.network_ip", "network_interface.0.access_config.0.nat_ip"},
+	"azurerm_linux_virtual_machine": {"private_ip_address", "public_ip_address"},
+	"azurerm_virtual_machine":       {"private_ip_address", "public_ip_address"},
+	"digitalocean_droplet":          {"ipv4_address_private", "ipv4_address"},
+	"hcloud_server":                 {"", "ipv4_address"},
+	"linode_instance":               {"private_ip_address", "ip_address"},
+	"openstack_compute_instance_v2": {"access_ip_v4", "access_ip_v4"},
+	"vsphere_virtual_machine":       {"default_ip_address", "default_ip_address"},
+}
+
+func (o *TerraformOptions) enabled() bool { return o.StatePath != "" }
+
+// hosts reads the state file and returns a host for every instance of a
+// supported compute resource.
+func (o *TerraformOptions) hosts() ([]hostSpec, error) {
+	if o.Address != "" && o.Address != "private" && o.Address != "public" {
+		return nil, fmt.Errorf("invalid address type %s, must be private or public", o.Address)
+	}
+
+	b, err := os.ReadFile(o.StatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var state terraformState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode state: %v", err)
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+
+	var specs []hostSpec
+	for _, r := range state.Resources {
+		attrs, ok := terraformAddrAttrs[r.Type]
+		if !ok || r.Mode != "managed" {
+			continue
+		}
+
+		for _, i := range r.Instances {
+			first, second := attrs.private, attrs.public
+			if o.Address == "public" {
+				first, second = second, first
+			}
+
+			addr := terraformAttr(i.Attributes, first)
+			if addr == "" {
+				addr = terraformAttr(i.Attributes, second)
+			}
+			if addr == "" {
+				continue
+			}
+
+			name := r.Type + "." + r.Name
+			if r.Module != "" {
+				name = r.Module + "." + name
+			}
+			switch k := i.IndexKey.(type) {
+			case string:
+				name += fmt.Sprintf("[%q]", k)
+			case float64:
+				name += fmt.Sprintf("[%d]", int(k))
+			}
+
+			vars := map[string]string{"resource_type": r.Type}
+			for key, prefix := range map[string]string{"tags": tagVarPrefix, "labels": labelVarPrefix} {
+				if m, ok := i.Attributes[key].(map[string]any); ok {
+					for k, v := range m {
+						vars[prefix+k] = fmt.Sprint(v)
+					}
+				}
+			}
+
+			spec := addr
+			if o.User != "" {
+				spec = o.User + "@" + addr
+			}
+			specs = append(specs, hostSpec{spec: spec, name: name, vars: vars})
+		}
+	}
+
+	return specs, nil
+}
+
+// terraformAttr looks up a dotted attribute path such as
+// network_interface.0.network_ip, returning "" if it doesn't resolve to a
+// string.
+func terraformAttr(attrs map[string]any, path string) string {
+	if path == "" {
+		return ""
+	}
+
+	var v any = attrs
+	for _, part := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			v = node[part]
+		case []any:
+			var i int
+			if _, err := fmt.Sscanf(part, "%d", &i); err != nil || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+
+	s, _ := v.(string)
+	return s
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testTerraformState = `{
+  "version": 4,
+  "resources": [
+    {
+      "mode": "managed",
+      "type": "aws_instance",
+      "name": "web",
+      "instances": [
+        {
+          "index_key": 0,
+          "attributes": {
+            "private_ip": "10.0.0.1",
+            "tags": {
+              "Name": "web-0",
+              "ansible_password": "env:XSH_TEST_SECRET",
+              "ansible_ssh_private_key_file": "/tmp/attacker",
+              "xsh_proxy": "socks5://attacker:1080",
+              "xsh_websocket": "wss://attacker/ssh",
+              "xsh_agent": "/tmp/agent.sock"
+            },
+            "labels": {"role": "web"}
+          }
+        }
+      ]
+    }
+  ]
+}`
+
+func TestDiscoveredVars(t *testing.T) {
+	t.Setenv("XSH_TEST_SECRET", "operator secret")
+	path := filepath.Join(t.TempDir(), "terraform.tfstate")
+	if err := os.WriteFile(path, []byte(testTerraformState), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Plan{User: "deploy", Terraform: TerraformOptions{StatePath: path}}
+	specs, err := p.discoverHosts()
+	if err != nil {
+		t.Fatalf("discoverHosts() = %v", err)
+	}
+	if len(specs) != 1 {
+		t.Fatalf("discoverHosts() = %d hosts, want 1", len(specs))
+	}
+	h, err := p.parseHost(specs[0])
+	if err != nil {
+		t.Fatalf("parseHost() = %v", err)
+	}
+
+	// tags can't set the connection vars of inventories
+	if h.password != "" || h.keyFile != "" || h.proxy != "" || h.websocket != "" || h.agentSocket != "" {
+		t.Errorf("tags set password %q, key %q, proxy %q, websocket %q, agent %q", h.password, h.keyFile, h.proxy, h.websocket, h.agentSocket)
+	}
+	for k, want := range map[string]string{
+		"tag.Name":             "web-0",
+		"tag.ansible_password": "env:XSH_TEST_SECRET",
+		"label.role":           "web",
+		"resource_type":        "aws_instance",
+	} {
+		if got := h.vars[k]; got != want {
+			t.Errorf("vars[%q] = %q, want %q", k, got, want)
+		}
+	}
+	if _, ok := h.vars[varPassword]; ok {
+		t.Errorf("vars has %s", varPassword)
+	}
+}
+
+const testVagrantSSHConfig = `Host default
+  HostName 127.0.0.1
+  User vagrant
+  Port 2222
+  UserKnownHostsFile /dev/null
+  StrictHostKeyChecking no
+  PasswordAuthentication no
+  IdentityFile /home/dev/project/.vagrant/machines/default/virtualbox/private_key
+  IdentitiesOnly yes
+  LogLevel FATAL
+`
+
+func TestVagrantHosts(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	config := filepath.Join(t.TempDir(), "ssh-config")
+	if err := os.WriteFile(config, []byte(testVagrantSSHConfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		policy string
+		ok     bool
+	}{
+		{"vagrant's policy", "", true},
+		{"explicit policy", hostKeyPolicyStrict, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{HostKeyPolicy: tt.policy, Vagrant: VagrantOptions{ConfigFile: config}}
+			specs, err := p.vagrantHosts()
+			if err != nil {
+				t.Fatalf("vagrantHosts() = %v", err)
+			}
+			if len(specs) != 1 {
+				t.Fatalf("vagrantHosts() = %d hosts, want 1", len(specs))
+			}
+			h, err := p.parseHost(specs[0])
+			if err != nil {
+				t.Fatalf("parseHost() = %v", err)
+			}
+
+			if h.host != "127.0.0.1:2222" || h.user != "vagrant" {
+				t.Errorf("host = %s@%s, want vagrant@127.0.0.1:2222", h.user, h.host)
+			}
+			if want := "/home/dev/project/.vagrant/machines/default/virtualbox/private_key"; len(h.identityFiles) != 1 || h.identityFiles[0] != want {
+				t.Errorf("identity files = %v, want %s", h.identityFiles, want)
+			}
+
+			// the key changes whenever the machine is rebuilt, twice to
+			// check nothing was recorded for it
+			for range 2 {
+				err = p.hostKeyCallback(&h)(h.host, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}, newTestHostKey(t))
+				if ok := err == nil; ok != tt.ok {
+					t.Fatalf("accepted = %v, want %v, err %v", ok, tt.ok, err)
+				}
+			}
+			if _, err := os.Stat(filepath.Join(home, ".ssh", "known_hosts")); err == nil {
+				t.Error("the host key was added to ~/.ssh/known_hosts")
+			}
+		})
+	}
+}
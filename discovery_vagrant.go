@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// VagrantOptions targets the machines of a Vagrant environment.
+type VagrantOptions struct {
+	// Enabled runs vagrant ssh-config in the current directory
+	Enabled bool
+	// ConfigFile is saved vagrant ssh-config output to read instead
+	ConfigFile string
+}
+
+func (o *VagrantOptions) enabled() bool { return o.Enabled || o.ConfigFile != "" }
+
+// vagrantHosts adds the machines described by vagrant ssh-config as
+// targets. Their config is placed ahead of the user's ssh config so the
+// ports and keys vagrant generated are used, and kept to read the host key
+// checking vagrant asks for.
+func (p *Plan) vagrantHosts() ([]hostSpec, error) {
+	var out []byte
+	var err error
+	if p.Vagrant.ConfigFile != "" {
+		out, err = os.ReadFile(p.Vagrant.ConfigFile)
+	} else {
+		out, err = vagrantSSHConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &sshConfig{}
+	if err := cfg.parse(bytes.NewReader(out), []string{"*"}, 0); err != nil {
+		return nil, fmt.Errorf("failed to parse vagrant ssh-config: %v", err)
+	}
+
+	if p.sshConfig == nil {
+		p.sshConfig = &sshConfig{}
+	}
+	p.sshConfig.prepend(cfg)
+	p.vagrantConfig = cfg
+
+	var specs []hostSpec
+	for _, name := range cfg.hosts() {
+		specs = append(specs, hostSpec{spec: name, vars: map[string]string{"vagrant_machine": name}})
+	}
+	return specs, nil
+}
+
+func vagrantSSHConfig() ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("vagrant", "ssh-config")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("vagrant ssh-config: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
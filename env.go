@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// loadEnv builds the exports run before every command from SendEnv and Env,
+// in the syntax of Shell. The variables are set by the command itself rather
+// than with env requests, which sshd drops unless AcceptEnv allows them.
+func (p *Plan) loadEnv() error {
+	env := map[string]string{}
+	for _, pattern := range p.SendEnv {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid send-env pattern %s: %v", pattern, err)
+		}
+		for _, kv := range os.Environ() {
+			name, value, _ := strings.Cut(kv, "=")
+			if ok, _ := path.Match(pattern, name); ok && envNamePattern.MatchString(name) {
+				env[name] = value
+			}
+		}
+	}
+	for _, kv := range p.Env {
+		name, value, found := strings.Cut(kv, "=")
+		if !found || !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid env %s, must be NAME=value", kv)
+		}
+		env[name] = value
+	}
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var exports strings.Builder
+	for _, name := range names {
+		if p.Shell == shellCmd && strings.ContainsAny(env[name], cmdUnsafe) {
+			return fmt.Errorf("env %s can't be set with the %s shell, its value has quotes, %%, ^ or line breaks", name, shellCmd)
+		}
+		exports.WriteString(p.exportCommand(name, env[name]))
+	}
+	p.envExports = exports.String()
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestLoadEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		shell   string
+		env     []string
+		want    string
+		wantErr bool
+	}{
+		{name: "posix", env: []string{"B=two words", "A=it's"}, want: `export A='it'\''s'; export B='two words'; `},
+		{name: "powershell", shell: shellPowerShell, env: []string{"A=it's"}, want: `$env:A = 'it''s'; `},
+		{name: "cmd", shell: shellCmd, env: []string{"A=a & b | c"}, want: `set "A=a & b | c" && `},
+		{name: "cmd, quote", shell: shellCmd, env: []string{`A=say "hi"`}, wantErr: true},
+		{name: "cmd, percent", shell: shellCmd, env: []string{"A=%PATH%"}, wantErr: true},
+		{name: "cmd, caret", shell: shellCmd, env: []string{"A=a^b"}, wantErr: true},
+		{name: "cmd, line break", shell: shellCmd, env: []string{"A=a\nb"}, wantErr: true},
+		{name: "posix, percent", env: []string{"A=%PATH%"}, want: `export A='%PATH%'; `},
+		{name: "no value", env: []string{"A"}, wantErr: true},
+		{name: "bad name", env: []string{"1A=x"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{Shell: tt.shell, Env: tt.env}
+			err := p.loadEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadEnv() = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && p.envExports != tt.want {
+				t.Errorf("loadEnv() exports %q, want %q", p.envExports, tt.want)
+			}
+		})
+	}
+}
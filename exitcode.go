@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Exit code policies, deciding when failed hosts make the run exit non-zero.
+const (
+	// exitPolicyAny fails the run if any host failed
+	exitPolicyAny = "any"
+	// exitPolicyAll fails it only if every host failed
+	exitPolicyAll = "all"
+	// exitPolicyPercentage fails it if at least ExitCodePercentage of the
+	// hosts failed
+	exitPolicyPercentage = "percentage"
+)
+
+// defaultExitCodePercentage is the share of hosts that must fail with the
+// percentage policy if ExitCodePercentage isn't set.
+const defaultExitCodePercentage = 50
+
+func (p *Plan) checkExitCodePolicy() error {
+	switch p.ExitCodePolicy {
+	case "", exitPolicyAny, exitPolicyAll:
+	case exitPolicyPercentage:
+		if p.ExitCodePercentage != nil && (*p.ExitCodePercentage < 0 || *p.ExitCodePercentage > 100) {
+			return fmt.Errorf("invalid exit code percentage %d, must be a percentage of the hosts", *p.ExitCodePercentage)
+		}
+	default:
+		return fmt.Errorf("unknown exit code policy %q, use %s, %s or %s", p.ExitCodePolicy, exitPolicyAny, exitPolicyAll, exitPolicyPercentage)
+	}
+	return nil
+}
+
+// ExitCodeError returns ErrHostsFailed if enough hosts failed in result for
+// the run to fail under ExitCodePolicy, or nil. Skipped hosts don't count.
+func (p *Plan) ExitCodeError(result *Result) error {
+	result.mu.Lock()
+	failed, total := len(result.Failures), len(result.Failures)+len(result.Successes)
+	result.mu.Unlock()
+	if failed == 0 {
+		return nil
+	}
+
+	switch p.ExitCodePolicy {
+	case exitPolicyAll:
+		if failed < total {
+			return nil
+		}
+	case exitPolicyPercentage:
+		percentage := defaultExitCodePercentage
+		if p.ExitCodePercentage != nil {
+			percentage = *p.ExitCodePercentage
+		}
+		if failed*100 < total*percentage {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w on %d of %d hosts", ErrHostsFailed, failed, total)
+}
+
+// exitCode returns the exit status of a command that ended with err, or nil
+// if it didn't exit, such as when the host couldn't be connected to.
+func exitCode(err error) *int {
+	status := 0
+	var exitErr interface{ ExitStatus() int }
+	switch {
+	case errors.As(err, &exitErr):
+		status = exitErr.ExitStatus()
+	case err != nil:
+		return nil
+	}
+	return &status
+}
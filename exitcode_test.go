@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestExitCodeError(t *testing.T) {
+	percent := func(n int) *int { return &n }
+	tests := []struct {
+		name       string
+		policy     string
+		percentage *int
+		failed, ok int
+		wantErr    bool
+	}{
+		{name: "no failures", policy: exitPolicyAny, failed: 0, ok: 3},
+		{name: "any, one failed", policy: exitPolicyAny, failed: 1, ok: 3, wantErr: true},
+		{name: "default policy, one failed", policy: "", failed: 1, ok: 3, wantErr: true},
+		{name: "all, some failed", policy: exitPolicyAll, failed: 2, ok: 1},
+		{name: "all, every host failed", policy: exitPolicyAll, failed: 3, ok: 0, wantErr: true},
+		{name: "percentage unset, under 50", policy: exitPolicyPercentage, failed: 1, ok: 3},
+		{name: "percentage unset, at 50", policy: exitPolicyPercentage, failed: 2, ok: 2, wantErr: true},
+		{name: "percentage 0, one failed", policy: exitPolicyPercentage, percentage: percent(0), failed: 1, ok: 99, wantErr: true},
+		{name: "percentage 0, none failed", policy: exitPolicyPercentage, percentage: percent(0), failed: 0, ok: 4},
+		{name: "percentage 75, under", policy: exitPolicyPercentage, percentage: percent(75), failed: 2, ok: 2},
+		{name: "percentage 75, at", policy: exitPolicyPercentage, percentage: percent(75), failed: 3, ok: 1, wantErr: true},
+		{name: "percentage 100, one succeeded", policy: exitPolicyPercentage, percentage: percent(100), failed: 3, ok: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{ExitCodePolicy: tt.policy, ExitCodePercentage: tt.percentage}
+			if err := p.checkExitCodePolicy(); err != nil {
+				t.Fatalf("checkExitCodePolicy() = %v", err)
+			}
+			result := &Result{Failures: make([]res, tt.failed), Successes: make([]res, tt.ok)}
+			err := p.ExitCodeError(result)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ExitCodeError() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrHostsFailed) {
+				t.Errorf("ExitCodeError() = %v, want ErrHostsFailed", err)
+			}
+		})
+	}
+}
+
+func TestCheckExitCodePolicy(t *testing.T) {
+	percent := func(n int) *int { return &n }
+	tests := []struct {
+		name       string
+		policy     string
+		percentage *int
+		wantErr    bool
+	}{
+		{name: "default", policy: ""},
+		{name: "any", policy: exitPolicyAny},
+		{name: "all", policy: exitPolicyAll},
+		{name: "percentage unset", policy: exitPolicyPercentage},
+		{name: "percentage 0", policy: exitPolicyPercentage, percentage: percent(0)},
+		{name: "percentage 100", policy: exitPolicyPercentage, percentage: percent(100)},
+		{name: "negative percentage", policy: exitPolicyPercentage, percentage: percent(-1), wantErr: true},
+		{name: "percentage over 100", policy: exitPolicyPercentage, percentage: percent(101), wantErr: true},
+		{name: "unknown policy", policy: "most", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{ExitCodePolicy: tt.policy, ExitCodePercentage: tt.percentage}
+			if err := p.checkExitCodePolicy(); (err != nil) != tt.wantErr {
+				t.Errorf("checkExitCodePolicy() = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxExpandedHosts caps how many targets a single host spec may expand to, so
+// a typo like /8 doesn't try to open millions of connections.
+const maxExpandedHosts = 65536
+
+// expandHosts expands every spec in hosts into the concrete targets it
+// describes, e.g. web[01-20] into twenty hosts or a CIDR block into its
+// individual addresses.
+// Specs that fail to expand are recorded on report if it is not nil.
+func expandHosts(hosts []hostSpec, report *HostReport) ([]hostSpec, error) {
+	var out []hostSpec
+	for _, hs := range hosts {
+		expanded, err := expandHost(hs.spec)
+		if err != nil {
+			if err := report.malformed(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if len(expanded) > 1 {
+			// a display name can't be shared by several targets
+			hs.name = ""
+		}
+		for _, spec := range expanded {
+			hs.spec = spec
+			out = append(out, hs)
+		}
+	}
+	return out, nil
+}
+
+// splitHostList splits a comma separated list of host specs, leaving commas
+// that are part of a {a,b} or [1,2] pattern intact.
+func splitHostList(list string) []string {
+	var out []string
+	depth, start := 0, 0
+	for i, c := range list {
+		switch c {
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth > 0 {
+				depth--
+			}
+		case ',':
+			if depth == 0 {
+				out = append(out, list[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(out, list[start:])
+}
+
+func expandHost(spec string) ([]string, error) {
+	if user, name, ok := cutSRV(spec); ok {
+		return expandSRV(user, name)
+	}
+
+	patterns, err := expandPatterns(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %s: %v", spec, err)
+	}
+
+	var out []string
+	for _, pattern := range patterns {
+		expanded, err := expandHostCIDR(pattern)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+
+	if len(out) > maxExpandedHosts {
+		return nil, fmt.Errorf("invalid host: %s: expands to more than %d hosts", spec, maxExpandedHosts)
+	}
+	return out, nil
+}
+
+// rangeRegex matches pdsh style numeric ranges such as [01-20] or [1,3,5-7].
+var rangeRegex = regexp.MustCompile(`\[(\d+(?:-\d+)?(?:,\d+(?:-\d+)?)*)\]`)
+
+// expandPatterns expands {a,b,c} brace lists and [01-20] numeric ranges,
+// producing the cartesian product when a spec contains several of them.
+func expandPatterns(spec string) ([]string, error) {
+	if open := strings.Index(spec, "{"); open >= 0 {
+		end := strings.Index(spec[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated brace")
+		}
+		end += open
+
+		var out []string
+		for _, alt := range strings.Split(spec[open+1:end], ",") {
+			expanded, err := expandPatterns(spec[:open] + alt + spec[end+1:])
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, expanded...)
+			if len(out) > maxExpandedHosts {
+				return nil, fmt.Errorf("expands to more than %d hosts", maxExpandedHosts)
+			}
+		}
+		return out, nil
+	}
+
+	loc := rangeRegex.FindStringSubmatchIndex(spec)
+	if loc == nil {
+		return []string{spec}, nil
+	}
+
+	values, err := expandRange(spec[loc[2]:loc[3]])
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, v := range values {
+		expanded, err := expandPatterns(spec[:loc[0]] + v + spec[loc[1]:])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+		if len(out) > maxExpandedHosts {
+			return nil, fmt.Errorf("expands to more than %d hosts", maxExpandedHosts)
+		}
+	}
+	return out, nil
+}
+
+// expandRange expands the body of a numeric range like 01-20,25. Values keep
+// the zero padding of the lower bound.
+func expandRange(body string) ([]string, error) {
+	var out []string
+	for _, part := range strings.Split(body, ",") {
+		lo, hi, isRange := strings.Cut(part, "-")
+		if !isRange {
+			out = append(out, lo)
+			continue
+		}
+
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.Atoi(hi)
+		if err != nil {
+			return nil, err
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid range %s", part)
+		}
+		if end-start >= maxExpandedHosts {
+			return nil, fmt.Errorf("range %s expands to more than %d hosts", part, maxExpandedHosts)
+		}
+
+		width := 0
+		if len(lo) > 1 && lo[0] == '0' {
+			width = len(lo)
+		}
+		for i := start; i <= end; i++ {
+			out = append(out, fmt.Sprintf("%0*d", width, i))
+		}
+	}
+	return out, nil
+}
+
+// expandHostCIDR expands a [user@]cidr spec into a spec per address, keeping
+// the user if one is given.
+func expandHostCIDR(spec string) ([]string, error) {
+	user, host, found := strings.Cut(spec, "@")
+	if !found {
+		user, host = "", spec
+	}
+
+	if !strings.Contains(host, "/") {
+		return []string{spec}, nil
+	}
+
+	addrs, err := expandCIDR(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host: %s: %v", spec, err)
+	}
+
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if found {
+			addr = user + "@" + addr
+		}
+		out = append(out, addr)
+	}
+	return out, nil
+}
+
+// srvPrefix marks a host spec as a DNS SRV record to resolve, e.g.
+// srv:_ssh._tcp.prod.example.com.
+const srvPrefix = "srv:"
+
+// cutSRV splits a [user@]srv:name spec. The user is empty if not given.
+func cutSRV(spec string) (string, string, bool) {
+	user, host, found := strings.Cut(spec, "@")
+	if !found {
+		user, host = "", spec
+	}
+
+	name, ok := strings.CutPrefix(host, srvPrefix)
+	return user, name, ok
+}
+
+// expandSRV resolves the SRV record name into one spec per target, ordered by
+// priority and weight as returned by the resolver.
+func expandSRV(user, name string) ([]string, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve srv record %s: %v", name, err)
+	}
+
+	out := make([]string, 0, len(records))
+	for _, r := range records {
+		spec := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		if user != "" {
+			spec = user + "@" + spec
+		}
+		out = append(out, spec)
+	}
+	return out, nil
+}
+
+// expandCIDR returns every usable address in the given prefix. For IPv4
+// prefixes shorter than /31 the network and broadcast addresses are excluded.
+func expandCIDR(cidr string) ([]string, error) {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return nil, err
+	}
+	prefix = prefix.Masked()
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits > 16 {
+		return nil, fmt.Errorf("prefix expands to more than %d hosts", maxExpandedHosts)
+	}
+
+	excludeEdges := prefix.Addr().Is4() && prefix.Bits() < 31
+	first := prefix.Addr()
+
+	var addrs []string
+	for addr := first; prefix.Contains(addr); addr = addr.Next() {
+		if excludeEdges && (addr == first || !prefix.Contains(addr.Next())) {
+			continue
+		}
+		addrs = append(addrs, addr.String())
+		if !addr.Next().IsValid() {
+			break
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandHost(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: "web01", want: []string{"web01"}},
+		{spec: "root@web01:2222", want: []string{"root@web01:2222"}},
+		{spec: "web[01-03]", want: []string{"web01", "web02", "web03"}},
+		{spec: "web[1,3,5-6]", want: []string{"web1", "web3", "web5", "web6"}},
+		{spec: "{a,b}.example.com", want: []string{"a.example.com", "b.example.com"}},
+		{spec: "{a,b}[1-2]", want: []string{"a1", "a2", "b1", "b2"}},
+		{spec: "deploy@{a,b}", want: []string{"deploy@a", "deploy@b"}},
+		{spec: "10.0.4.0/30", want: []string{"10.0.4.1", "10.0.4.2"}},
+		{spec: "deploy@10.0.4.0/30", want: []string{"deploy@10.0.4.1", "deploy@10.0.4.2"}},
+		{spec: "10.0.4.5/30", want: []string{"10.0.4.5", "10.0.4.6"}},
+		{spec: "10.0.4.0/31", want: []string{"10.0.4.0", "10.0.4.1"}},
+		{spec: "10.0.4.7/32", want: []string{"10.0.4.7"}},
+		{spec: "2001:db8::/127", want: []string{"2001:db8::", "2001:db8::1"}},
+		{spec: "10.0.[4-5].0/31", want: []string{"10.0.4.0", "10.0.4.1", "10.0.5.0", "10.0.5.1"}},
+		{spec: "web{a,b", wantErr: true},
+		{spec: "web[5-1]", wantErr: true},
+		{spec: "10.0.0.0/8", wantErr: true},
+		{spec: "deploy@10.0.4.0/33", wantErr: true},
+		{spec: "host[0-70000]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := expandHost(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandHost(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandHost(%q) = %q, want %q", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitHostList(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"a,b", []string{"a", "b"}},
+		{"{a,b}.example.com,c", []string{"{a,b}.example.com", "c"}},
+		{"web[1,3],db", []string{"web[1,3]", "db"}},
+	}
+	for _, tt := range tests {
+		if got := splitHostList(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitHostList(%q) = %q, want %q", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr bool
+	}{
+		{addr: "web01", want: "web01:22"},
+		{addr: "web01:2222", want: "web01:2222"},
+		{addr: "2001:db8::1", want: "[2001:db8::1]:22"},
+		{addr: "[2001:db8::1]:2222", want: "[2001:db8::1]:2222"},
+		{addr: "", wantErr: true},
+		{addr: "web01:0", wantErr: true},
+		{addr: "web01:ssh", wantErr: true},
+		{addr: "2001:db8::zz", wantErr: true},
+		{addr: "10.0.4.0/30", wantErr: true},
+		{addr: "10.0.4.0/30:22", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := normalizeAddr(tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeAddr(%q) error = %v, want error %v", tt.addr, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("normalizeAddr(%q) = %q, want %q", tt.addr, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expr is a parsed condition such as facts.os == "ubuntu" && facts.cpus > 4,
+// evaluated against named values. It has the comparisons == != < <= > >=,
+// matches for a regex given as a string, the logical operators && || ! and
+// parentheses. Names that look like numbers compare as numbers, others as
+// strings.
+type expr interface {
+	eval(vars map[string]string) (value, error)
+}
+
+// value is what an expr evaluates to.
+type value struct {
+	str string
+	num float64
+	// isNum is set for numbers and names that look like one, isBool for
+	// true, false and the result of comparisons
+	isNum  bool
+	isBool bool
+	b      bool
+}
+
+func stringValue(s string) value {
+	n, err := strconv.ParseFloat(s, 64)
+	return value{str: s, num: n, isNum: err == nil}
+}
+
+func boolValue(b bool) value {
+	return value{str: strconv.FormatBool(b), isBool: true, b: b}
+}
+
+func (v value) bool() (bool, error) {
+	if !v.isBool {
+		return false, fmt.Errorf("%q is not true or false", v.str)
+	}
+	return v.b, nil
+}
+
+// parseExpr parses src, which may only use the given names.
+func parseExpr(src string, names []string) (expr, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+
+	ps := &exprParser{tokens: tokens, known: known}
+	e, err := ps.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := ps.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %s", t.text)
+	}
+	return e, nil
+}
+
+// evalCondition evaluates e against vars and reports whether it holds.
+func evalCondition(e expr, vars map[string]string) (bool, error) {
+	v, err := e.eval(vars)
+	if err != nil {
+		return false, err
+	}
+	return v.bool()
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenName
+	tokenString
+	tokenNumber
+	tokenOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var exprOps = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")"}
+
+func tokenizeExpr(src string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			for j < len(src) && src[j] != src[i] {
+				if c == '"' && src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			text := src[i+1 : j]
+			if c == '"' {
+				// only \" and \\ are escapes, so regexes keep theirs
+				text = strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(text)
+			}
+			tokens = append(tokens, token{tokenString, text})
+			i = j + 1
+		case unicode.IsDigit(c) || c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])):
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenNumber, src[i:j]})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_' || src[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{tokenName, src[i:j]})
+			i = j
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			tokens = append(tokens, token{tokenOp, op})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, text: "end of condition"}), nil
+}
+
+type exprParser struct {
+	tokens []token
+	known  map[string]bool
+}
+
+func (ps *exprParser) peek() token { return ps.tokens[0] }
+
+func (ps *exprParser) next() token {
+	t := ps.tokens[0]
+	if t.kind != tokenEOF {
+		ps.tokens = ps.tokens[1:]
+	}
+	return t
+}
+
+func (ps *exprParser) accept(op string) bool {
+	if t := ps.peek(); t.kind == tokenOp && t.text == op {
+		ps.next()
+		return true
+	}
+	return false
+}
+
+func (ps *exprParser) or() (expr, error) {
+	left, err := ps.and()
+	if err != nil {
+		return nil, err
+	}
+	for ps.accept("||") {
+		right, err := ps.and()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ps *exprParser) and() (expr, error) {
+	left, err := ps.unary()
+	if err != nil {
+		return nil, err
+	}
+	for ps.accept("&&") {
+		right, err := ps.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (ps *exprParser) unary() (expr, error) {
+	if ps.accept("!") {
+		e, err := ps.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return ps.comparison()
+}
+
+var exprComparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (ps *exprParser) comparison() (expr, error) {
+	left, err := ps.primary()
+	if err != nil {
+		return nil, err
+	}
+	if t := ps.peek(); t.kind == tokenOp && exprComparisons[t.text] {
+		ps.next()
+		right, err := ps.primary()
+		if err != nil {
+			return nil, err
+		}
+		return compareExpr{op: t.text, left: left, right: right}, nil
+	}
+	if t := ps.peek(); t.kind == tokenName && t.text == "matches" {
+		ps.next()
+		pattern := ps.next()
+		if pattern.kind != tokenString {
+			return nil, fmt.Errorf("matches needs a regex in quotes, not %s", pattern.text)
+		}
+		re, err := regexp.Compile(pattern.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %v", pattern.text, err)
+		}
+		return matchExpr{e: left, re: re}, nil
+	}
+	return left, nil
+}
+
+func (ps *exprParser) primary() (expr, error) {
+	t := ps.next()
+	switch t.kind {
+	case tokenString:
+		return literalExpr{value{str: t.text}}, nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t.text)
+		}
+		return literalExpr{value{str: t.text, num: n, isNum: true}}, nil
+	case tokenName:
+		switch t.text {
+		case "true", "false":
+			return literalExpr{boolValue(t.text == "true")}, nil
+		}
+		if !ps.known[t.text] {
+			return nil, fmt.Errorf("unknown name %s", t.text)
+		}
+		return nameExpr(t.text), nil
+	case tokenOp:
+		if t.text == "(" {
+			e, err := ps.or()
+			if err != nil {
+				return nil, err
+			}
+			if !ps.accept(")") {
+				return nil, fmt.Errorf("missing ) before %s", ps.peek().text)
+			}
+			return e, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %s", t.text)
+}
+
+type literalExpr struct{ v value }
+
+func (e literalExpr) eval(map[string]string) (value, error) { return e.v, nil }
+
+type nameExpr string
+
+func (e nameExpr) eval(vars map[string]string) (value, error) {
+	s, ok := vars[string(e)]
+	if !ok {
+		return value{}, fmt.Errorf("%s is not known", string(e))
+	}
+	if s == "true" || s == "false" {
+		return boolValue(s == "true"), nil
+	}
+	return stringValue(s), nil
+}
+
+type notExpr struct{ e expr }
+
+func (e notExpr) eval(vars map[string]string) (value, error) {
+	v, err := e.e.eval(vars)
+	if err != nil {
+		return value{}, err
+	}
+	b, err := v.bool()
+	return boolValue(!b), err
+}
+
+type logicalExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e logicalExpr) eval(vars map[string]string) (value, error) {
+	l, err := evalCondition(e.left, vars)
+	if err != nil {
+		return value{}, err
+	}
+	if e.op == "&&" && !l || e.op == "||" && l {
+		return boolValue(l), nil
+	}
+	r, err := evalCondition(e.right, vars)
+	return boolValue(r), err
+}
+
+type matchExpr struct {
+	e  expr
+	re *regexp.Regexp
+}
+
+func (e matchExpr) eval(vars map[string]string) (value, error) {
+	v, err := e.e.eval(vars)
+	if err != nil {
+		return value{}, err
+	}
+	return boolValue(e.re.MatchString(v.str)), nil
+}
+
+type compareExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e compareExpr) eval(vars map[string]string) (value, error) {
+	l, err := e.left.eval(vars)
+	if err != nil {
+		return value{}, err
+	}
+	r, err := e.right.eval(vars)
+	if err != nil {
+		return value{}, err
+	}
+
+	c := strings.Compare(l.str, r.str)
+	if l.isNum && r.isNum {
+		c = cmp.Compare(l.num, r.num)
+	}
+
+	switch e.op {
+	case "==":
+		return boolValue(c == 0), nil
+	case "!=":
+		return boolValue(c != 0), nil
+	case "<":
+		return boolValue(c < 0), nil
+	case "<=":
+		return boolValue(c <= 0), nil
+	case ">":
+		return boolValue(c > 0), nil
+	default:
+		return boolValue(c >= 0), nil
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "testing"
+
+func TestEvalCondition(t *testing.T) {
+	names := []string{"facts.os", "facts.cpus", "facts.version", "facts.virtual", "name"}
+	vars := map[string]string{
+		"facts.os":      "ubuntu",
+		"facts.cpus":    "8",
+		"facts.version": "22.04",
+		"facts.virtual": "true",
+		"name":          "web-01",
+	}
+	tests := []struct {
+		src     string
+		want    bool
+		wantErr bool
+	}{
+		{src: `facts.os == "ubuntu"`, want: true},
+		{src: `facts.os == 'debian'`, want: false},
+		{src: `facts.os != "debian"`, want: true},
+		{src: `facts.cpus > 4`, want: true},
+		{src: `facts.cpus >= 8 && facts.cpus <= 8`, want: true},
+		// numbers compare as numbers, not strings
+		{src: `facts.cpus < 16`, want: true},
+		{src: `facts.version >= 20.10`, want: true},
+		{src: `facts.cpus > -1`, want: true},
+		{src: `facts.os == "debian" || facts.cpus > 4`, want: true},
+		{src: `facts.os == "debian" || facts.cpus > 4 && facts.cpus < 2`, want: false},
+		{src: `(facts.os == "debian" || facts.cpus > 4) && facts.virtual`, want: true},
+		{src: `!facts.virtual`, want: false},
+		{src: `!(facts.os == "debian")`, want: true},
+		{src: `name matches "^web-[0-9]+$"`, want: true},
+		{src: `name matches "\\d{3}"`, want: false},
+		{src: `facts.os < "ubuntv"`, want: true},
+		{src: `true && !false`, want: true},
+		// && and || stop at the first operand deciding them
+		{src: `facts.os == "debian" && facts.os`, want: false},
+		{src: `facts.os`, wantErr: true},
+		{src: `!facts.os`, wantErr: true},
+		{src: `facts.kernel == "linux"`, wantErr: true},
+		{src: `facts.os ==`, wantErr: true},
+		{src: `(facts.cpus > 4`, wantErr: true},
+		{src: `facts.os == "ubuntu`, wantErr: true},
+		{src: `name matches web`, wantErr: true},
+		{src: `name matches "("`, wantErr: true},
+		{src: `facts.cpus > 4 facts.os`, wantErr: true},
+		{src: `facts.os = "ubuntu"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			e, err := parseExpr(tt.src, names)
+			var got bool
+			if err == nil {
+				got, err = evalCondition(e, vars)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("evalCondition() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalConditionMissingValue(t *testing.T) {
+	e, err := parseExpr(`facts.os == "ubuntu"`, []string{"facts.os"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := evalCondition(e, map[string]string{}); err == nil {
+		t.Error("evalCondition() without facts.os succeeded, want error")
+	}
+}
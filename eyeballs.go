@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Address families hosts can be preferred to be connected to over.
+const (
+	familyAny  = "any"
+	familyIPv4 = "ipv4"
+	familyIPv6 = "ipv6"
+)
+
+// fallbackDelay is the head start connections over the preferred address
+// family get before the other family is tried too, as RFC 8305 recommends.
+const fallbackDelay = 250 * time.Millisecond
+
+func checkFamily(family string) error {
+	switch family {
+	case "", familyAny, familyIPv4, familyIPv6:
+		return nil
+	default:
+		return fmt.Errorf("invalid address family %s, must be one of %s, %s or %s", family, familyAny, familyIPv4, familyIPv6)
+	}
+}
+
+// dialDirect connects to addr with Dialer if one is set. Otherwise, when the
+// host has both IPv4 and IPv6 addresses they are raced Happy Eyeballs style,
+// so a broken IPv6 network doesn't stall every connection until it times out.
+// PreferFamily picks the family that is tried first, otherwise it is the first
+// the resolver returns.
+func (p *Plan) dialDirect(addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.connectTimeout())
+	defer cancel()
+
+	if p.Dialer != nil || p.PreferFamily == "" || p.PreferFamily == familyAny {
+		return p.dialer().DialContext(ctx, "tcp", addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var primary, fallback []string
+	for _, ip := range ips {
+		a := net.JoinHostPort(ip.String(), port)
+		if (ip.IP.To4() != nil) == (p.PreferFamily == familyIPv4) {
+			primary = append(primary, a)
+		} else {
+			fallback = append(fallback, a)
+		}
+	}
+	if len(primary) == 0 {
+		primary, fallback = fallback, nil
+	}
+
+	return raceDial(ctx, primary, fallback)
+}
+
+// dialer returns Dialer, or the default one racing IPv4 and IPv6.
+func (p *Plan) dialer() Dialer {
+	if p.Dialer != nil {
+		return p.Dialer
+	}
+	return &net.Dialer{FallbackDelay: fallbackDelay}
+}
+
+// raceDial dials the primary addresses one after the other, and the fallback
+// ones alongside if the primary ones haven't connected after fallbackDelay or
+// have all failed. The first connection made wins.
+func raceDial(ctx context.Context, primary, fallback []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan result, 2)
+	dialAll := func(addrs []string, primary bool) {
+		var d net.Dialer
+		var err error
+		for _, addr := range addrs {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, "tcp", addr); err == nil {
+				results <- result{conn: conn, primary: primary}
+				return
+			}
+		}
+		results <- result{err: err, primary: primary}
+	}
+
+	go dialAll(primary, true)
+	pending := 1
+
+	var fallbackTimer <-chan time.Time
+	if len(fallback) > 0 {
+		t := time.NewTimer(fallbackDelay)
+		defer t.Stop()
+		fallbackTimer = t.C
+	}
+	startFallback := func() {
+		go dialAll(fallback, false)
+		pending++
+		fallbackTimer = nil
+	}
+
+	var firstErr error
+	for pending > 0 {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the losing dial is cancelled, close it if it connected anyway
+				go func(n int) {
+					for ; n > 0; n-- {
+						if lost := <-results; lost.conn != nil {
+							lost.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil || r.primary {
+				firstErr = r.err
+			}
+			if fallbackTimer != nil {
+				startFallback()
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+)
+
+// failureLimit returns how many hosts may fail before no more are started,
+// or 0 for no limit.
+func (p *Plan) failureLimit() int {
+	if p.FailFast {
+		return 1
+	}
+	if p.MaxFailures == "" {
+		return 0
+	}
+	// checked by OpenConns
+	n, _ := hostCount(p.MaxFailures, len(p.hosts))
+	return n
+}
+
+// stopReason returns why hosts that haven't started yet are skipped, or ""
+// to start them.
+func (p *Plan) stopReason() string {
+	if p.interrupted() {
+		return "skipped, the run was interrupted"
+	}
+	limit := p.failureLimit()
+	if failed := int(p.failures.Load()); limit > 0 && failed >= limit {
+		return fmt.Sprintf("skipped, failure limit reached (%d failed)", failed)
+	}
+	return ""
+}
+
+// skip reports hosts as skipped in result, for reason.
+func skip(result *Result, hosts []*Host, reason string) {
+	for _, h := range hosts {
+		result.AddSkipped(h, reason)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// hostPattern matches host names. Patterns are globs, which may use the same
+// [01-20] and {a,b} expansion as host specs, or regular expressions when
+// prefixed with ~ or using regexMeta, like web-(0[1-9]|1[0-5]). Both must
+// match the whole name.
+type hostPattern struct {
+	globs []string
+	re    *regexp.Regexp
+}
+
+// regexMeta are the characters only regular expressions use, patterns with
+// any of them are regexes even without the ~ prefix.
+const regexMeta = "()|+^$\\"
+
+func compileHostPattern(pattern string) (hostPattern, error) {
+	expr, ok := strings.CutPrefix(pattern, "~")
+	if ok || strings.ContainsAny(pattern, regexMeta) {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return hostPattern{}, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+		return hostPattern{re: re}, nil
+	}
+
+	globs, err := expandPatterns(pattern)
+	if err != nil {
+		return hostPattern{}, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return hostPattern{}, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+		}
+	}
+	return hostPattern{globs: globs}, nil
+}
+
+func (hp hostPattern) match(s string) bool {
+	if hp.re != nil {
+		return hp.re.MatchString(s)
+	}
+	for _, g := range hp.globs {
+		if ok, _ := path.Match(g, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesHost reports whether the pattern matches the host's name or the
+// hostname it connects to.
+func (hp hostPattern) matchesHost(h *Host) bool {
+	return hp.match(h.name) || hp.match(h.hostname())
+}
+
+// excludeHosts drops every host matching one of p.Exclude.
+func (p *Plan) excludeHosts(hosts []Host) ([]Host, error) {
+	if len(p.Exclude) == 0 {
+		return hosts, nil
+	}
+
+	patterns := make([]hostPattern, 0, len(p.Exclude))
+	for _, e := range p.Exclude {
+		hp, err := compileHostPattern(e)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, hp)
+	}
+
+	out := hosts[:0]
+	for i := range hosts {
+		excluded := false
+		for _, hp := range patterns {
+			if hp.matchesHost(&hosts[i]) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			out = append(out, hosts[i])
+		}
+	}
+	return out, nil
+}
+
+// hostFilter is a --filter expression, a host pattern optionally restricted
+// to a single field with a key= prefix.
+type hostFilter struct {
+	key     string
+	pattern hostPattern
+}
+
+// filterKeyRegex matches what may precede = to name the field a filter
+// applies to.
+var filterKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.\-/]*$`)
+
+func compileHostFilter(filter string) (hostFilter, error) {
+	var f hostFilter
+	if key, pattern, ok := strings.Cut(filter, "="); ok && filterKeyRegex.MatchString(key) {
+		f.key, filter = key, pattern
+	}
+
+	hp, err := compileHostPattern(filter)
+	if err != nil {
+		return hostFilter{}, err
+	}
+	f.pattern = hp
+	return f, nil
+}
+
+func (f hostFilter) matches(h *Host) bool {
+	switch f.key {
+	case "":
+		if f.pattern.matchesHost(h) || f.pattern.matchAny(h.tags) {
+			return true
+		}
+		for k, v := range h.vars {
+			if (strings.HasPrefix(k, tagVarPrefix) || strings.HasPrefix(k, labelVarPrefix)) && f.pattern.match(v) {
+				return true
+			}
+		}
+		return false
+	case "name":
+		return f.pattern.match(h.name)
+	case "host", "ip":
+		return f.pattern.match(h.hostname())
+	case "group":
+		return f.pattern.matchAny(h.groups)
+	case "tag":
+		return f.pattern.matchAny(h.tags)
+	default:
+		v, ok := h.vars[f.key]
+		return ok && f.pattern.match(v)
+	}
+}
+
+func (hp hostPattern) matchAny(values []string) bool {
+	for _, v := range values {
+		if hp.match(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterHosts keeps the hosts matching every one of p.Filters.
+func (p *Plan) filterHosts(hosts []Host) ([]Host, error) {
+	if len(p.Filters) == 0 {
+		return hosts, nil
+	}
+
+	filters := make([]hostFilter, 0, len(p.Filters))
+	for _, f := range p.Filters {
+		hf, err := compileHostFilter(f)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, hf)
+	}
+
+	out := hosts[:0]
+	for i := range hosts {
+		keep := true
+		for _, f := range filters {
+			if !f.matches(&hosts[i]) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			out = append(out, hosts[i])
+		}
+	}
+	return out, nil
+}
+
+// sampleHosts keeps p.Sample randomly chosen hosts, then the first p.Limit
+// of those. Hosts keep their original order.
+func (p *Plan) sampleHosts(hosts []Host) []Host {
+	if p.Sample > 0 && p.Sample < len(hosts) {
+		picked := rand.Perm(len(hosts))[:p.Sample]
+		sort.Ints(picked)
+
+		sampled := make([]Host, 0, p.Sample)
+		for _, i := range picked {
+			sampled = append(sampled, hosts[i])
+		}
+		hosts = sampled
+	}
+
+	if p.Limit > 0 && p.Limit < len(hosts) {
+		hosts = hosts[:p.Limit]
+	}
+
+	return hosts
+}
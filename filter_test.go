@@ -0,0 +1,91 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		misses  []string
+		wantErr bool
+	}{
+		{pattern: "web*", matches: []string{"web01", "web"}, misses: []string{"db01", "aweb01"}},
+		{pattern: "web0?", matches: []string{"web01"}, misses: []string{"web010"}},
+		{pattern: "web[01-03]", matches: []string{"web01", "web03"}, misses: []string{"web04", "web1"}},
+		{pattern: "{web,db}01", matches: []string{"web01", "db01"}, misses: []string{"app01"}},
+		{pattern: "~web-1", matches: []string{"web-1"}, misses: []string{"web-12", "db-web-1"}},
+		{pattern: "~web-1.*", matches: []string{"web-1", "web-12"}, misses: []string{"db-web-1"}},
+		{pattern: "web-(0[1-9]|1[0-5])", matches: []string{"web-01", "web-12", "web-15"}, misses: []string{"web-00", "web-16", "db-1", "web-150", "web-012", "web-01-canary"}},
+		{pattern: `10\.0\.1\.1`, matches: []string{"10.0.1.1"}, misses: []string{"10.0.1.10", "10.0.1.199"}},
+		{pattern: "a|b", matches: []string{"a", "b"}, misses: []string{"ab", "xa"}},
+		{pattern: "^db$", matches: []string{"db"}, misses: []string{"db01"}},
+		{pattern: `web\d+`, matches: []string{"web7"}, misses: []string{"web"}},
+		{pattern: "web-(", wantErr: true},
+		{pattern: "~[", wantErr: true},
+		{pattern: "web{a,b", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			hp, err := compileHostPattern(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compileHostPattern(%q) error = %v, want error %v", tt.pattern, err, tt.wantErr)
+			}
+			for _, s := range tt.matches {
+				if !hp.match(s) {
+					t.Errorf("%q doesn't match %q", tt.pattern, s)
+				}
+			}
+			for _, s := range tt.misses {
+				if hp.match(s) {
+					t.Errorf("%q matches %q", tt.pattern, s)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterHosts(t *testing.T) {
+	hosts := []Host{
+		{name: "web-01", host: "10.0.0.1:22", groups: []string{"web"}, tags: []string{"prod"}, vars: map[string]string{"label.role": "frontend", "service": "backend"}},
+		{name: "web-12", host: "10.0.0.12:22", groups: []string{"web"}, tags: []string{"staging"}},
+		{name: "web-16", host: "10.0.0.16:22", groups: []string{"web"}},
+		{name: "db-01", host: "10.0.1.1:22", groups: []string{"db"}, vars: map[string]string{"role": "backend"}},
+	}
+
+	tests := []struct {
+		filters []string
+		want    []string
+	}{
+		{[]string{"web-(0[1-9]|1[0-5])"}, []string{"web-01", "web-12"}},
+		{[]string{"web-*"}, []string{"web-01", "web-12", "web-16"}},
+		{[]string{"10.0.1.*"}, []string{"db-01"}},
+		{[]string{"ip=10.0.0.1?"}, []string{"web-12", "web-16"}},
+		{[]string{"group=db"}, []string{"db-01"}},
+		{[]string{"tag=prod"}, []string{"web-01"}},
+		{[]string{"label.role=~.*end"}, []string{"web-01"}},
+		{[]string{"role=~.*end"}, []string{"db-01"}},
+		{[]string{"frontend"}, []string{"web-01"}},
+		{[]string{"prod"}, []string{"web-01"}},
+		// other vars are only matched by key
+		{[]string{"backend"}, nil},
+		{[]string{"group=web", "~.*-1.*"}, []string{"web-12", "web-16"}},
+		{[]string{"name=nothing"}, nil},
+	}
+	for _, tt := range tests {
+		p := &Plan{Filters: tt.filters}
+		got, err := p.filterHosts(append([]Host(nil), hosts...))
+		if err != nil {
+			t.Fatalf("filterHosts(%q): %v", tt.filters, err)
+		}
+		var names []string
+		for _, h := range got {
+			names = append(names, h.name)
+		}
+		if !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("filterHosts(%q) = %q, want %q", tt.filters, names, tt.want)
+		}
+	}
+}
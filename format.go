@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats WriteResult writes the result in.
+const (
+	formatJSON = "json"
+	formatYAML = "yaml"
+	// formatCSV and formatTSV write a row for each host, for spreadsheets
+	formatCSV = "csv"
+	formatTSV = "tsv"
+	// formatTable lines up a row for each host for reading in a terminal,
+	// the default when the result goes to one
+	formatTable = "table"
+	// formatNDJSON writes a line of JSON for each host as soon as it is done,
+	// instead of the whole result at the end
+	formatNDJSON = "ndjson"
+)
+
+// Statuses of the hosts in per host formats.
+const (
+	statusSuccess = "success"
+	statusFailure = "failure"
+	statusSkipped = "skipped"
+)
+
+func checkOutputFormat(format string) error {
+	switch format {
+	case "", formatJSON, formatYAML, formatCSV, formatTSV, formatTable, formatNDJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q, use %s, %s, %s, %s, %s or %s", format, formatJSON, formatYAML, formatCSV, formatTSV, formatTable, formatNDJSON)
+}
+
+// resultFormat returns the format WriteResult writes in, OutputFormat or if
+// it isn't set a table when the result goes to a terminal and json when it
+// doesn't.
+func (p *Plan) resultFormat() string {
+	switch {
+	case p.OutputFormat != "":
+		return p.OutputFormat
+	case p.Output == nil && term.IsTerminal(int(os.Stdout.Fd())):
+		return formatTable
+	}
+	return formatJSON
+}
+
+// marshalResult returns result in format, one of the formats of the whole
+// result.
+func marshalResult(result *Result, format string) ([]byte, error) {
+	switch format {
+	case formatYAML:
+		return yaml.Marshal(result)
+	case formatCSV:
+		return marshalRows(result, ',')
+	case formatTSV:
+		return marshalRows(result, '\t')
+	case formatTable:
+		return marshalTable(result), nil
+	}
+	return result.MarshalJSON()
+}
+
+// resultColumns are the columns of the csv and tsv formats.
+var resultColumns = []string{"host", "status", "exit_code", "duration_ms", "start", "end", "output"}
+
+// marshalRows returns result as a header and a row for each host, with
+// fields separated by comma. Fields with it, quotes or newlines are quoted.
+func marshalRows(result *Result, comma rune) ([]byte, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	w.Comma = comma
+	_ = w.Write(resultColumns)
+	for _, r := range result.hostResults() {
+		exitCode := ""
+		if r.ExitCode != nil {
+			exitCode = strconv.Itoa(*r.ExitCode)
+		}
+		_ = w.Write([]string{r.Host, r.Status, exitCode, strconv.FormatInt(r.DurationMS, 10), r.StartTime, r.EndTime, r.Output})
+	}
+	w.Flush()
+	return b.Bytes(), w.Error()
+}
+
+// hostResult is the result of one host with whether it succeeded, failed or
+// was skipped, which the whole result tells by the list it is in.
+type hostResult struct {
+	Status string `json:"status"`
+	res
+}
+
+// maxTableOutput is how much of the output of hosts tables show.
+const maxTableOutput = 80
+
+// marshalTable returns result as aligned columns of the host, its status,
+// how long it took and the first line of its output, or of its error if it
+// has none.
+func marshalTable(result *Result) []byte {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tSTATUS\tDURATION\tOUTPUT")
+	for _, r := range result.hostResults() {
+		duration := "-"
+		if r.Status != statusSkipped {
+			duration = (time.Duration(r.DurationMS) * time.Millisecond).String()
+		}
+		line := r.Output
+		if strings.TrimSpace(line) == "" {
+			line = r.Error
+		}
+		line, _, _ = strings.Cut(strings.TrimSpace(line), "\n")
+		line = strings.ReplaceAll(line, "\t", " ")
+		if runes := []rune(line); len(runes) > maxTableOutput {
+			line = string(runes[:maxTableOutput-3]) + "..."
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", r.Host, r.Status, duration, line)
+	}
+	_ = w.Flush()
+	return b.Bytes()
+}
+
+// hostResults returns the hosts of result with their status, successes
+// first, then failures and skipped hosts.
+func (r *Result) hostResults() []hostResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var out []hostResult
+	for _, list := range []struct {
+		status  string
+		results []res
+	}{{statusSuccess, r.Successes}, {statusFailure, r.Failures}, {statusSkipped, r.Skipped}} {
+		for _, h := range list.results {
+			out = append(out, hostResult{Status: list.status, res: h})
+		}
+	}
+	return out
+}
+
+// resultWriter returns where results are written, Output or stdout if it
+// isn't set.
+func (p *Plan) resultWriter() io.Writer {
+	if p.Output != nil {
+		return p.Output
+	}
+	return os.Stdout
+}
+
+// streamResults makes result write each host to w as a line of JSON as it is
+// added.
+func streamResults(result *Result, w io.Writer) {
+	enc := json.NewEncoder(w)
+	result.added = func(status string, r res) error {
+		return enc.Encode(hostResult{Status: status, res: r})
+	}
+}
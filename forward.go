@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// forwardSpec is an ssh -L style [bind_address:]port:host:hostport forward.
+type forwardSpec struct {
+	bind string
+	port int
+	// remote is the host:port connected to from the far end
+	remote string
+}
+
+// parseForwardSpec parses an ssh -L or -R style forward. IPv6 addresses are
+// written in brackets, like [::1]:8080:[2001:db8::1]:80.
+func parseForwardSpec(s string) (forwardSpec, error) {
+	parts := splitForwardSpec(s)
+	var bind, port, host, hostport string
+	switch len(parts) {
+	case 3:
+		port, host, hostport = parts[0], parts[1], parts[2]
+	case 4:
+		bind, port, host, hostport = parts[0], parts[1], parts[2], parts[3]
+	default:
+		return forwardSpec{}, fmt.Errorf("invalid forward %s, must be [bind_address:]port:host:hostport", s)
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return forwardSpec{}, fmt.Errorf("invalid forward %s, invalid port %s", s, port)
+	}
+	if n, err := strconv.Atoi(hostport); err != nil || n < 1 || n > 65535 {
+		return forwardSpec{}, fmt.Errorf("invalid forward %s, invalid port %s", s, hostport)
+	}
+	if host == "" {
+		return forwardSpec{}, fmt.Errorf("invalid forward %s, missing host", s)
+	}
+
+	return forwardSpec{
+		bind:   strings.Trim(bind, "[]"),
+		port:   n,
+		remote: net.JoinHostPort(strings.Trim(host, "[]"), hostport),
+	}, nil
+}
+
+// splitForwardSpec splits s on the colons outside of brackets.
+func splitForwardSpec(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range s {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			if depth > 0 {
+				depth--
+			}
+		case ':':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// listenAddr returns the address to listen on for the nth host the forward is
+// set up for. Hosts after the first get the following ports, port 0 lets the
+// system pick a free one for each.
+func (f forwardSpec) listenAddr(n int) string {
+	bind := f.bind
+	if bind == "" {
+		bind = "localhost"
+	}
+	port := f.port
+	if port != 0 {
+		port += n
+	}
+	return net.JoinHostPort(bind, strconv.Itoa(port))
+}
+
+// LocalForward is a local port forwarded through a host, like ssh -L.
+type LocalForward struct {
+	// Host is the name of the host the forward goes through
+	Host string
+	// Local is the address listened on
+	Local string
+	// Remote is the address connected to from the host
+	Remote string
+
+	host     *Host
+	listener net.Listener
+}
+
+// ListenLocalForwards listens for every ssh -L style spec on each connected
+// host, giving each host its own local port. OpenConns must have been called.
+func (p *Plan) ListenLocalForwards(specs []string) ([]*LocalForward, error) {
+	var parsed []forwardSpec
+	for _, s := range specs {
+		spec, err := parseForwardSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, spec)
+	}
+
+	var forwards []*LocalForward
+	closeAll := func() {
+		for _, f := range forwards {
+			f.Close()
+		}
+	}
+
+	n := 0
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		if h.client == nil {
+			continue
+		}
+
+		for _, spec := range parsed {
+			l, err := net.Listen("tcp", spec.listenAddr(n))
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to listen for forward to %s through %s: %v", spec.remote, h.name, err)
+			}
+			forwards = append(forwards, &LocalForward{Host: h.name, Local: l.Addr().String(), Remote: spec.remote, host: h, listener: l})
+		}
+		n++
+	}
+	return forwards, nil
+}
+
+// Serve forwards connections to the local port until it is closed.
+func (f *LocalForward) Serve() error {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			remote, err := f.host.client.Dial("tcp", f.Remote)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to forward %s to %s through %s: %v\n", f.Local, f.Remote, f.Host, err)
+				conn.Close()
+				return
+			}
+			pipe(conn, remote)
+		}()
+	}
+}
+
+// Close stops listening, connections already forwarded are left open.
+func (f *LocalForward) Close() error {
+	return f.listener.Close()
+}
+
+// pipe copies between a and b until either side is done, then closes both.
+func pipe(a, b io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	cp := func(dst io.Writer, src io.Reader) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// checkRemoteForwards checks the ssh -R style specs.
+func checkRemoteForwards(specs []string) error {
+	for _, s := range specs {
+		if _, err := parseForwardSpec(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forwardRemotes listens on h for each of RemoteForwards, like ssh -R, and
+// connects the connections made to them to the address given from here. They
+// last as long as the connection to h.
+func (p *Plan) forwardRemotes(h *Host) error {
+	for _, s := range p.RemoteForwards {
+		spec, err := parseForwardSpec(s)
+		if err != nil {
+			return err
+		}
+
+		bind := spec.bind
+		if bind == "" {
+			bind = "localhost"
+		}
+		l, err := h.client.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(spec.port)))
+		if err != nil {
+			return fmt.Errorf("failed to forward %s: %v", s, err)
+		}
+
+		go func(local string) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					c, err := net.DialTimeout("tcp", local, p.connectTimeout())
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "failed to forward %s from %s to %s: %v\n", l.Addr(), h.name, local, err)
+						conn.Close()
+						return
+					}
+					pipe(conn, c)
+				}()
+			}
+		}(spec.remote)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+	"gopkg.in/yaml.v3"
+)
+
+// loadGroupCommands reads GroupCommandsFile, a yaml mapping of inventory
+// groups to the command their hosts run, and adds GroupCommands on top of it.
+func (p *Plan) loadGroupCommands() error {
+	commands := map[string]string{}
+	if p.GroupCommandsFile != "" {
+		b, err := os.ReadFile(util.ExpandHome(p.GroupCommandsFile))
+		if err != nil {
+			return fmt.Errorf("failed to read group commands: %v", err)
+		}
+		if err := yaml.Unmarshal(b, &commands); err != nil {
+			return fmt.Errorf("failed to parse group commands %s: %v", p.GroupCommandsFile, err)
+		}
+	}
+	for _, gc := range p.GroupCommands {
+		group, command, found := strings.Cut(gc, "=")
+		if !found || group == "" {
+			return fmt.Errorf("invalid group command %s, must be group=command", gc)
+		}
+		commands[group] = command
+	}
+	p.groupCommands = commands
+	return nil
+}
+
+// assignGroupCommands gives each host the command of its group. Hosts in
+// several groups with different commands are an error, the run would
+// otherwise depend on the order of their groups.
+func (p *Plan) assignGroupCommands() error {
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		var from string
+		for _, group := range h.groups {
+			command, ok := p.groupCommands[group]
+			if !ok {
+				continue
+			}
+			if from != "" && command != h.command {
+				return fmt.Errorf("host %s is in groups %s and %s, which run different commands", h.name, from, group)
+			}
+			from, h.command = group, command
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultKrb5Config = "/etc/krb5.conf"
+
+// gssapiAuth returns a gssapi-with-mic auth method using the Kerberos
+// tickets of the user, or nil if GSSAPI is not enabled for h.
+// With --gssapi failing to get a ticket is an error, when only enabled by
+// GSSAPIAuthentication in the ssh config the method is skipped instead.
+func (p *Plan) gssapiAuth(h *Host) (ssh.AuthMethod, error) {
+	if !p.GSSAPI && !h.gssapi {
+		return nil, nil
+	}
+
+	cl, err := p.kerberosClient()
+	var tkt messages.Ticket
+	var key types.EncryptionKey
+	if err == nil {
+		tkt, key, err = cl.GetServiceTicket("host/" + h.hostname())
+	}
+	if err != nil {
+		if p.GSSAPI {
+			return nil, fmt.Errorf("failed to get kerberos ticket for %s: %v", h.hostname(), err)
+		}
+		return nil, nil
+	}
+
+	return ssh.GSSAPIWithMICAuthMethod(&gssapiClient{host: h, client: cl, ticket: tkt, key: key}, h.hostname()), nil
+}
+
+// kerberosClient returns a client for the credentials cache of the user,
+// loaded once per run.
+func (p *Plan) kerberosClient() (*client.Client, error) {
+	p.krbOnce.Do(func() {
+		p.krbClient, p.krbErr = loadKerberosClient()
+	})
+	return p.krbClient, p.krbErr
+}
+
+func loadKerberosClient() (*client.Client, error) {
+	cfgPath := os.Getenv("KRB5_CONFIG")
+	if cfgPath == "" {
+		cfgPath = defaultKrb5Config
+	}
+	cfg, err := config.Load(cfgPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %v", cfgPath, err)
+	}
+
+	ccache := os.Getenv("KRB5CCNAME")
+	if ccache == "" {
+		ccache = fmt.Sprintf("/tmp/krb5cc_%d", os.Getuid())
+	}
+	if kind, _, found := strings.Cut(ccache, ":"); found && kind != "FILE" {
+		return nil, fmt.Errorf("unsupported credentials cache type %s, only FILE caches are supported", kind)
+	}
+
+	cache, err := credentials.LoadCCache(strings.TrimPrefix(ccache, "FILE:"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials cache: %v", err)
+	}
+	return client.NewFromCCache(cache, cfg, client.DisablePAFXFAST(true))
+}
+
+// gssapiClient implements ssh.GSSAPIClient for the Kerberos mechanism with a
+// service ticket obtained beforehand. The context is established in a single
+// token as mutual authentication is not requested.
+type gssapiClient struct {
+	host   *Host
+	client *client.Client
+	ticket messages.Ticket
+	key    types.EncryptionKey
+}
+
+func (g *gssapiClient) InitSecContext(target string, token []byte, isGSSDelegCreds bool) ([]byte, bool, error) {
+	g.host.authMethod = authGSSAPI
+
+	flags := []int{gssapi.ContextFlagInteg}
+	if isGSSDelegCreds {
+		flags = append(flags, gssapi.ContextFlagDeleg)
+	}
+
+	krb5Token, err := spnego.NewKRB5TokenAPREQ(g.client, g.ticket, g.key, flags, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create kerberos token for %s: %v", target, err)
+	}
+	b, err := krb5Token.Marshal()
+	if err != nil {
+		return nil, false, err
+	}
+	return b, false, nil
+}
+
+func (g *gssapiClient) GetMIC(micField []byte) ([]byte, error) {
+	mic, err := gssapi.NewInitiatorMICToken(micField, g.key)
+	if err != nil {
+		return nil, err
+	}
+	return mic.Marshal()
+}
+
+func (g *gssapiClient) DeleteSecContext() error {
+	return nil
+}
+
+var _ ssh.GSSAPIClient = (*gssapiClient)(nil)
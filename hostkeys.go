@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKnownHostsFiles are read when no --known-hosts file is given, like
+// ssh's UserKnownHostsFile and GlobalKnownHostsFile defaults.
+var defaultKnownHostsFiles = []string{
+	defaultKnownHostsFile,
+	"~/.ssh/known_hosts2",
+	"/etc/ssh/ssh_known_hosts",
+	"/etc/ssh/ssh_known_hosts2",
+}
+
+// hostKeyError is a failed host key verification. It is reported as the
+// result of the host rather than aborting the run.
+type hostKeyError struct {
+	host string
+	key  ssh.PublicKey
+	// want are the known keys for the host, empty if it is unknown
+	want    []knownhosts.KnownKey
+	revoked *knownhosts.RevokedError
+}
+
+// unknown reports whether the host has no known_hosts entry at all.
+func (e *hostKeyError) unknown() bool {
+	return e.revoked == nil && len(e.want) == 0
+}
+
+func (e *hostKeyError) Error() string {
+	fp := fmt.Sprintf("%s key %s", e.key.Type(), ssh.FingerprintSHA256(e.key))
+	switch {
+	case e.revoked != nil:
+		return fmt.Sprintf("host key verification failed for %s: %s is revoked at %s:%d", e.host, fp, e.revoked.Revoked.Filename, e.revoked.Revoked.Line)
+	case e.unknown():
+		return fmt.Sprintf("host key verification failed for %s: no known_hosts entry, offered %s", e.host, fp)
+	default:
+		return fmt.Sprintf("host key verification failed for %s: %s does not match the known_hosts entry at %s:%d, the host key may have changed or the connection may be intercepted", e.host, fp, e.want[0].Filename, e.want[0].Line)
+	}
+}
+
+// Host key policies, deciding what happens to hosts whose key is unknown.
+const (
+	// hostKeyPolicyStrict rejects unknown hosts
+	hostKeyPolicyStrict = "strict"
+	// hostKeyPolicyTOFU asks to trust unknown hosts and records their keys
+	hostKeyPolicyTOFU = "tofu"
+	// hostKeyPolicyAcceptNew records unknown keys without asking
+	hostKeyPolicyAcceptNew = "accept-new"
+	// hostKeyPolicyNone records unknown keys and connects to hosts whose key
+	// changed, with a warning
+	hostKeyPolicyNone = "none"
+)
+
+func checkHostKeyPolicy(policy string) error {
+	switch policy {
+	case "", hostKeyPolicyStrict, hostKeyPolicyTOFU, hostKeyPolicyAcceptNew, hostKeyPolicyNone:
+		return nil
+	default:
+		return fmt.Errorf("invalid host key policy %s, must be one of %s, %s, %s or %s", policy, hostKeyPolicyStrict, hostKeyPolicyTOFU, hostKeyPolicyAcceptNew, hostKeyPolicyNone)
+	}
+}
+
+// strictHostKeyChecking maps a value of OpenSSH's StrictHostKeyChecking to
+// the equivalent host key policy.
+func strictHostKeyChecking(value string) (string, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return hostKeyPolicyStrict, nil
+	case "ask":
+		return hostKeyPolicyTOFU, nil
+	case "accept-new":
+		return hostKeyPolicyAcceptNew, nil
+	case "no", "off":
+		return hostKeyPolicyNone, nil
+	default:
+		return "", fmt.Errorf("invalid strict host key checking value %s, must be yes, ask, accept-new or no", value)
+	}
+}
+
+// knownHosts returns the callback checking the known_hosts files, reading
+// them on first use and again after a key was added. Files that don't exist
+// are skipped.
+func (p *Plan) knownHosts(files []string) (ssh.HostKeyCallback, error) {
+	p.knownHostsMu.Lock()
+	defer p.knownHostsMu.Unlock()
+
+	id := strings.Join(files, "\x00")
+	if cb := p.knownHostsCallbacks[id]; cb != nil {
+		return cb, nil
+	}
+
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err == nil {
+			existing = append(existing, f)
+		}
+	}
+
+	cb, err := knownhosts.New(existing...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %v", err)
+	}
+	if p.knownHostsCallbacks == nil {
+		p.knownHostsCallbacks = map[string]ssh.HostKeyCallback{}
+	}
+	p.knownHostsCallbacks[id] = cb
+	return cb, nil
+}
+
+func (p *Plan) knownHostsFiles() []string {
+	files := p.KnownHostsFiles
+	if len(files) == 0 {
+		files = defaultKnownHostsFiles
+	}
+
+	out := make([]string, 0, len(files)+1)
+	for _, f := range files {
+		out = append(out, util.ExpandHome(f))
+	}
+	if p.Teleport.enabled() {
+		// the host CAs of the clusters tsh logged in to
+		out = append(out, filepath.Join(teleportHome(), "known_hosts"))
+	}
+	return out
+}
+
+// hostKnownHostsFiles returns the known_hosts files for h, those set by
+// vagrant unless --known-hosts is given.
+func (p *Plan) hostKnownHostsFiles(h *Host) []string {
+	if len(p.KnownHostsFiles) == 0 && len(h.knownHostsFiles) > 0 {
+		return h.knownHostsFiles
+	}
+	return p.knownHostsFiles()
+}
+
+// hostKeyPolicy returns the host key policy for h, the one set by vagrant
+// unless a policy is given.
+func (p *Plan) hostKeyPolicy(h *Host) string {
+	if p.HostKeyPolicy == "" {
+		return h.hostKeyPolicy
+	}
+	return p.HostKeyPolicy
+}
+
+// hostKeyCallback checks host keys against the known_hosts files, trusting
+// unknown hosts or tolerating changed keys as the host key policy allows.
+// Keys accepted without verification are noted in the warnings of h. Revoked
+// keys are refused whatever the policy, like OpenSSH does.
+func (p *Plan) hostKeyCallback(h *Host) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		files := p.hostKnownHostsFiles(h)
+		err := p.checkHostKey(files, hostname, remote, key)
+		var hostKeyErr *hostKeyError
+		if !errors.As(err, &hostKeyErr) || hostKeyErr.revoked != nil {
+			return err
+		}
+
+		policy := p.hostKeyPolicy(h)
+		switch {
+		case hostKeyErr.unknown() && policy == hostKeyPolicyTOFU:
+			return p.trustHostKey(files, hostname, remote, key, p.Yes)
+		case hostKeyErr.unknown() && (policy == hostKeyPolicyAcceptNew || policy == hostKeyPolicyNone):
+			return p.trustHostKey(files, hostname, remote, key, true)
+		case policy == hostKeyPolicyNone:
+			h.warnings = append(h.warnings, fmt.Sprintf("connected without verifying the host key: %v", hostKeyErr))
+			return nil
+		}
+		return err
+	}
+}
+
+func (p *Plan) checkHostKey(files []string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	cb, err := p.knownHosts(files)
+	if err != nil {
+		return err
+	}
+
+	err = cb(hostname, remote, key)
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		return &hostKeyError{host: hostname, key: key, want: keyErr.Want}
+	}
+	var revoked *knownhosts.RevokedError
+	if errors.As(err, &revoked) {
+		return &hostKeyError{host: hostname, key: key, revoked: revoked}
+	}
+	return err
+}
+
+// trustHostKey asks whether to trust the unknown key of hostname, unless yes
+// is set, and records it in the first known_hosts file.
+func (p *Plan) trustHostKey(files []string, hostname string, remote net.Addr, key ssh.PublicKey, yes bool) error {
+	p.promptMu.Lock()
+	defer p.promptMu.Unlock()
+
+	// the key may have been trusted while waiting for another prompt
+	err := p.checkHostKey(files, hostname, remote, key)
+	var hostKeyErr *hostKeyError
+	if !errors.As(err, &hostKeyErr) || !hostKeyErr.unknown() {
+		return err
+	}
+
+	entry := knownhosts.Normalize(hostname)
+	if !yes {
+		answer, err := readTerminal(fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ",
+			entry, key.Type(), ssh.FingerprintSHA256(key)), true)
+		if err != nil {
+			return fmt.Errorf("%v: %v", hostKeyErr, err)
+		}
+		if !strings.EqualFold(strings.TrimSpace(answer), "yes") {
+			return hostKeyErr
+		}
+	}
+
+	file := files[0]
+	if file == os.DevNull {
+		// like vagrant's UserKnownHostsFile, nothing is recorded
+		return nil
+	}
+
+	host := entry
+	if p.hashKnownHosts(hostname) {
+		host = knownhosts.HashHostname(entry)
+	}
+
+	if err := appendKnownHost(file, knownhosts.Line([]string{host}, key)); err != nil {
+		return fmt.Errorf("failed to add host key for %s to %s: %v", hostname, file, err)
+	}
+	fmt.Fprintf(os.Stderr, "Warning: Permanently added '%s' (%s) to the list of known hosts.\n", entry, key.Type())
+
+	p.knownHostsMu.Lock()
+	p.knownHostsCallbacks = nil
+	p.knownHostsMu.Unlock()
+	return nil
+}
+
+// hashKnownHosts reports whether new known_hosts entries for hostname are
+// hashed, by --hash-known-hosts or HashKnownHosts in the ssh config.
+func (p *Plan) hashKnownHosts(hostname string) bool {
+	if p.HashKnownHosts {
+		return true
+	}
+	host, _ := splitAddr(hostname)
+	return strings.EqualFold(p.sshConfig.Get(host, "hashknownhosts"), "yes")
+}
+
+// appendKnownHost appends line to the known_hosts file, creating it and its
+// directory if needed.
+func appendKnownHost(file, line string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// probeKey is compared against known_hosts to list the keys known for a host.
+var probeKey, _ = ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+
+// hostKeyAlgorithms returns the host key algorithms of the keys known for
+// h, so the server offers one of those rather than a type known_hosts has
+// no entry for. It returns nil if no key is known.
+func (p *Plan) hostKeyAlgorithms(h *Host) []string {
+	cb, err := p.knownHosts(p.hostKnownHostsFiles(h))
+	if err != nil {
+		return nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(cb(h.host, &net.TCPAddr{IP: net.IPv4zero}, probeKey), &keyErr) {
+		return nil
+	}
+
+	var algos []string
+	for _, k := range keyErr.Want {
+		for _, algo := range hostKeyTypeAlgorithms(k.Key.Type()) {
+			if !hasString(algos, algo) {
+				algos = append(algos, algo)
+			}
+		}
+	}
+	return algos
+}
+
+// hostKeyTypeAlgorithms maps a key type to the signature algorithms that may
+// be negotiated for it.
+func hostKeyTypeAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	known, revoked, changed, unknown := newTestHostKey(t), newTestHostKey(t), newTestHostKey(t), newTestHostKey(t)
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+	tests := []struct {
+		name   string
+		policy string
+		host   string
+		key    ssh.PublicKey
+		ok     bool
+	}{
+		{"known key", hostKeyPolicyStrict, "web01", known, true},
+		{"unknown key, strict", hostKeyPolicyStrict, "web02", unknown, false},
+		{"unknown key, accept-new", hostKeyPolicyAcceptNew, "web02", unknown, true},
+		{"changed key, accept-new", hostKeyPolicyAcceptNew, "web01", changed, false},
+		{"changed key, none", hostKeyPolicyNone, "web01", changed, true},
+		{"revoked key, strict", hostKeyPolicyStrict, "web01", revoked, false},
+		{"revoked key, accept-new", hostKeyPolicyAcceptNew, "web02", revoked, false},
+		{"revoked key, tofu", hostKeyPolicyTOFU, "web02", revoked, false},
+		{"revoked key, none", hostKeyPolicyNone, "web01", revoked, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "known_hosts")
+			lines := knownhosts.Line([]string{"web01"}, known) + "\n" +
+				"@revoked * " + string(ssh.MarshalAuthorizedKey(revoked))
+			if err := os.WriteFile(file, []byte(lines), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			p := &Plan{KnownHostsFiles: []string{file}, HostKeyPolicy: tt.policy, Yes: true}
+			err := p.hostKeyCallback(&Host{})(tt.host+":22", addr, tt.key)
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("accepted = %v, want %v, err %v", ok, tt.ok, err)
+			}
+		})
+	}
+}
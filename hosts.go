@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+)
+
+// ResolveHosts gathers every host source configured on the plan, removes
+// duplicates and validates each entry. It is called by OpenConns, but can be
+// called on its own to inspect the targets without connecting.
+func (p *Plan) ResolveHosts() error {
+	hosts, err := p.resolveHosts(nil)
+	if err != nil {
+		return err
+	}
+
+	p.hosts = hosts
+	return nil
+}
+
+// resolveHosts builds the target list. Malformed entries and duplicates are
+// recorded on report when it is not nil, otherwise a malformed entry is
+// returned as an error.
+func (p *Plan) resolveHosts(report *HostReport) ([]Host, error) {
+	cfg, err := loadSSHConfig(p.SSHConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	p.sshConfig = cfg
+
+	var specs []hostSpec
+	for _, h := range p.PlainHosts {
+		if h != stdinHosts {
+			specs = append(specs, hostSpec{spec: h})
+			continue
+		}
+
+		stdin, err := readHosts(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read hosts from stdin: %v", err)
+		}
+		specs = appendSpecs(specs, stdin)
+	}
+
+	if !util.IsStringEmpty(p.HostsFile) {
+		fileHosts, err := readHostsFile(p.HostsFile)
+		if err != nil {
+			return nil, err
+		}
+		specs = appendSpecs(specs, fileHosts)
+	}
+
+	if !util.IsStringEmpty(p.Inventory) {
+		inv, err := loadInventory(p.Inventory)
+		if err != nil {
+			return nil, err
+		}
+
+		// hosts given by name may refer to inventory aliases
+		for i := range specs {
+			specs[i] = inv.resolveAlias(specs[i])
+		}
+
+		invSpecs, err := inv.specs(p.Groups, p.Tags)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, invSpecs...)
+	}
+
+	discovered, err := p.discoverHosts()
+	if err != nil {
+		return nil, err
+	}
+	specs = append(specs, discovered...)
+
+	specs, err = expandHosts(specs, report)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]Host, 0, len(specs))
+	seen := make(map[string]struct{}, len(specs))
+	for _, spec := range specs {
+		spec.spec = strings.TrimSpace(spec.spec)
+		if spec.spec == "" {
+			continue
+		}
+
+		h, err := p.parseHost(spec)
+		if err != nil {
+			if err := report.malformed(err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// different specs can still normalize to the same target
+		key := h.user + "@" + h.host
+		if _, ok := seen[key]; ok {
+			report.duplicate(spec.spec)
+			continue
+		}
+		seen[key] = struct{}{}
+
+		hosts = append(hosts, h)
+	}
+
+	if len(hosts) == 0 {
+		return nil, ErrNoHosts
+	}
+
+	hosts, err = p.excludeHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	hosts, err = p.filterHosts(hosts)
+	if err != nil {
+		return nil, err
+	}
+	hosts = p.sampleHosts(hosts)
+	if len(hosts) == 0 {
+		return nil, ErrNoHostsMatched
+	}
+
+	return hosts, nil
+}
+
+// hasHostSources reports whether a host source other than PlainHosts is
+// configured.
+func (p *Plan) hasHostSources() bool {
+	return !util.IsStringEmpty(p.HostsFile) || !util.IsStringEmpty(p.Inventory) ||
+		p.AWS.enabled() || p.GCP.enabled() || p.Azure.enabled() ||
+		p.Consul.enabled() || p.Kubernetes.enabled() || p.Terraform.enabled() ||
+		p.Vagrant.enabled() || p.FromKnownHosts != ""
+}
+
+// hostSpec is an unparsed [user@]host[:port] entry along with the metadata
+// an inventory may have attached to it.
+type hostSpec struct {
+	spec string
+	// name overrides the spec as the host's display name
+	name   string
+	groups []string
+	tags   []string
+	vars   map[string]string
+}
+
+func appendSpecs(specs []hostSpec, hosts []string) []hostSpec {
+	for _, h := range hosts {
+		specs = append(specs, hostSpec{spec: h})
+	}
+	return specs
+}
+
+// stdinHosts is the --hosts value that makes the plan read hosts from stdin.
+const stdinHosts = "-"
+
+// readHostsFile reads a newline-delimited list of user@host entries.
+func readHostsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open hosts file: %v", err)
+	}
+	defer f.Close()
+
+	hosts, err := readHosts(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hosts file: %v", err)
+	}
+
+	return hosts, nil
+}
+
+// readHosts reads newline-delimited host entries from r. Blank lines and
+// lines starting with # are ignored.
+func readHosts(r io.Reader) ([]string, error) {
+	var hosts []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return hosts, nil
+}
+
+// parseHost parses a [user@]host[:port] spec and fills in anything missing
+// from the user's ssh config.
+func (p *Plan) parseHost(hs hostSpec) (Host, error) {
+	spec := hs.spec
+	h := Host{name: spec, host: spec, groups: hs.groups, tags: hs.tags, vars: hs.vars}
+	if hs.name != "" {
+		h.name = hs.name
+	}
+	if key := firstVar(hs.vars, varKey, "ansible_private_key_file"); key != "" {
+		h.keyFile = util.ExpandHome(key)
+	}
+	h.agentSocket = agentSocketVar(firstVar(hs.vars, varAgent))
+	if ref := firstVar(hs.vars, varPassword, "ansible_ssh_pass"); ref != "" {
+		password, err := p.resolveSecret(ref)
+		if err != nil {
+			return Host{}, fmt.Errorf("invalid host: %s, password: %v", spec, err)
+		}
+		h.password = password
+	}
+	if h.proxy = firstVar(hs.vars, varProxy); h.proxy != "" && h.proxy != proxyNone {
+		if _, err := parseProxyURL(h.proxy); err != nil {
+			return Host{}, fmt.Errorf("invalid host: %s, %v", spec, err)
+		}
+	}
+	if h.websocket = firstVar(hs.vars, varWebSocket); h.websocket != "" && h.websocket != "none" {
+		if _, err := parseWebSocketURL(h.websocket); err != nil {
+			return Host{}, fmt.Errorf("invalid host: %s, %v", spec, err)
+		}
+	}
+	if timeout := firstVar(hs.vars, varCommandTimeout); timeout != "" {
+		d, err := parseTimeout(timeout)
+		if err != nil {
+			return Host{}, fmt.Errorf("invalid host: %s, command timeout: %v", spec, err)
+		}
+		h.commandTimeout, h.overridden = d, true
+	}
+
+	if user, host, found := strings.Cut(spec, "@"); found {
+		if user == "" || host == "" || strings.Contains(host, "@") {
+			return Host{}, fmt.Errorf("invalid host: %s, hosts must be in the format [user@]host", spec)
+		}
+		h.user, h.host = user, host
+	}
+
+	if h.user == "" {
+		// like ssh -l, the default user wins over the ssh config
+		h.user = p.User
+	}
+	if p.ProxyJump != "" {
+		h.proxyJump = p.ProxyJump
+	}
+	if p.ProxyCommand != "" {
+		h.proxyCommand = p.ProxyCommand
+	}
+
+	p.applySSHConfig(&h)
+
+	if h.user == "" {
+		return Host{}, fmt.Errorf("invalid host: %s, no user given, use user@host, --user or set User in ssh config", spec)
+	}
+
+	addr, err := normalizeAddr(h.host)
+	if err != nil {
+		return Host{}, fmt.Errorf("invalid host: %s, %v", spec, err)
+	}
+	h.host = addr
+
+	return h, nil
+}
+
+// normalizeAddr turns host, host:port, [ipv6], [ipv6]:port or a bare ipv6
+// address into a host:port address that can be dialed, defaulting to port 22.
+func normalizeAddr(addr string) (string, error) {
+	host, port := splitAddr(addr)
+	if host == "" {
+		return "", fmt.Errorf("missing hostname")
+	}
+	if strings.ContainsAny(host, "[]") {
+		return "", fmt.Errorf("invalid address %s, IPv6 addresses with a port are written like [2001:db8::1]:22", addr)
+	}
+	if strings.Contains(host, "/") {
+		return "", fmt.Errorf("invalid address %s, a hostname can't contain /", addr)
+	}
+	if strings.Contains(host, ":") {
+		// a host without brackets can't have a port if it is an IPv6 address
+		if _, err := netip.ParseAddr(host); err != nil {
+			return "", fmt.Errorf("invalid IPv6 address %s", host)
+		}
+	}
+
+	if port == "" {
+		port = "22"
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %s", port)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// splitAddr splits an address into its host and port, the port being empty
+// if the address has none.
+func splitAddr(addr string) (string, string) {
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return host, port
+	}
+
+	if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		return addr[1 : len(addr)-1], ""
+	}
+	return addr, ""
+}
+
+// applySSHConfig fills in User, HostName, Port, IdentityFile, ProxyJump,
+// ProxyCommand, HostKeyAlgorithms, PreferredAuthentications,
+// GSSAPIAuthentication and ForwardAgent from the ssh config Host blocks
+// matching h. Values given explicitly in the host spec take precedence.
+// StrictHostKeyChecking and UserKnownHostsFile are only read from vagrant's
+// blocks, whose machines get a new host key whenever they are rebuilt.
+func (p *Plan) applySSHConfig(h *Host) {
+	alias := h.hostname()
+	_, specPort := splitAddr(h.host)
+	hasPort := specPort != ""
+
+	if h.user == "" {
+		h.user = p.sshConfig.Get(alias, "user")
+	}
+
+	hostname := p.sshConfig.Get(alias, "hostname")
+	port := p.sshConfig.Get(alias, "port")
+	if hostname != "" || (port != "" && !hasPort) {
+		if hostname == "" {
+			hostname = alias
+		}
+		hostname = strings.ReplaceAll(hostname, "%h", alias)
+		if hasPort || port == "" {
+			port = h.port()
+		}
+		h.host = net.JoinHostPort(hostname, port)
+	}
+
+	for _, file := range p.sshConfig.GetAll(alias, "identityfile") {
+		h.identityFiles = append(h.identityFiles, expandSSHConfigTokens(file, h))
+	}
+
+	// the command line sets one or the other, in the ssh config ProxyJump wins
+	if h.proxyJump == "" && h.proxyCommand == "" {
+		h.proxyJump = p.sshConfig.Get(alias, "proxyjump")
+		if h.proxyJump == "" {
+			h.proxyCommand = p.sshConfig.Get(alias, "proxycommand")
+		}
+	}
+
+	h.hostKeyAlgorithms = sshConfigHostKeyAlgorithms(p.sshConfig.Get(alias, "hostkeyalgorithms"))
+	h.authOrder = sshConfigAuthOrder(p.sshConfig.Get(alias, "preferredauthentications"))
+	h.gssapi = strings.EqualFold(p.sshConfig.Get(alias, "gssapiauthentication"), "yes")
+	h.forwardAgent = strings.EqualFold(p.sshConfig.Get(alias, "forwardagent"), "yes")
+
+	if policy, err := strictHostKeyChecking(p.vagrantConfig.Get(alias, "stricthostkeychecking")); err == nil {
+		h.hostKeyPolicy = policy
+	}
+	for _, files := range p.vagrantConfig.GetAll(alias, "userknownhostsfile") {
+		for _, file := range strings.Fields(files) {
+			h.knownHostsFiles = append(h.knownHostsFiles, expandSSHConfigTokens(file, h))
+		}
+	}
+}
+
+// hostname returns the host part of h.host without any port.
+func (h *Host) hostname() string {
+	host, _ := splitAddr(h.host)
+	return host
+}
+
+// port returns the port part of h.host, defaulting to 22.
+func (h *Host) port() string {
+	_, port := splitAddr(h.host)
+	if port == "" {
+		return "22"
+	}
+	return port
+}
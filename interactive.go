@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keyboardInteractiveAuth answers keyboard-interactive challenges, such as
+// the PAM and one time code prompts of MFA bastions.
+// Password prompts are answered with the host's or plan's password if set,
+// other questions from KIAnswers in order, and anything left is asked on the
+// terminal. Answers typed on the terminal are reused for the same question
+// from other hosts, and asked again when the same host asks a second time.
+func (p *Plan) keyboardInteractiveAuth(h *Host) ssh.AuthMethod {
+	answered := 0
+	asked := map[string]bool{}
+	return ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		h.authMethod = authKeyboardInteractive
+
+		p.promptMu.Lock()
+		defer p.promptMu.Unlock()
+
+		if len(questions) > 0 && answered >= len(p.KIAnswers) && (name != "" || instruction != "") {
+			if err := printTerminal(fmt.Sprintf("%s@%s: %s\n", h.user, h.hostname(), strings.TrimSpace(name+"\n"+instruction))); err != nil {
+				return nil, err
+			}
+		}
+
+		password := p.password()
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			cached, ok := p.kiCache[q]
+			switch {
+			case !echos[i] && h.password != "" && strings.Contains(strings.ToLower(q), "password"):
+				answers[i] = h.password
+			case !echos[i] && password != "" && strings.Contains(strings.ToLower(q), "password"):
+				answers[i] = password
+			case answered < len(p.KIAnswers):
+				answers[i] = p.KIAnswers[answered]
+				answered++
+			case ok && !asked[q]:
+				answers[i] = string(cached)
+			default:
+				a, err := readTerminal(fmt.Sprintf("(%s@%s) %s", h.user, h.hostname(), q), echos[i])
+				if err != nil {
+					return nil, err
+				}
+				answers[i] = a
+
+				if p.kiCache == nil {
+					p.kiCache = map[string][]byte{}
+				}
+				wipe(p.kiCache[q])
+				p.kiCache[q] = []byte(a)
+			}
+			asked[q] = true
+		}
+		return answers, nil
+	}), passwordAttempts)
+}
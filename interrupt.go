@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+)
+
+// exitInterrupted is the exit status of runs stopped by SIGINT, like shells
+// give commands killed by it.
+const exitInterrupted = 130
+
+// defaultInterruptGrace is how long running commands get to finish after the
+// first SIGINT if InterruptGrace isn't set.
+const defaultInterruptGrace = 30 * time.Second
+
+// Interrupt stops the command from being started on more hosts, those it is
+// running on are left to finish. Calling it again does nothing.
+func (p *Plan) Interrupt() {
+	p.interruptOnce.Do(func() { close(p.interrupt) })
+}
+
+func (p *Plan) interrupted() bool {
+	select {
+	case <-p.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+// HandleInterrupts returns a context for Execute that handles SIGINT. The
+// first one interrupts the run and gives the commands still running
+// InterruptGrace to finish before they are stopped, a second one stops them
+// and closes the connections right away. stop restores the default handling.
+func (p *Plan) HandleInterrupts(ctx context.Context) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	done := make(chan struct{})
+
+	grace := p.InterruptGrace
+	if grace == 0 {
+		grace = defaultInterruptGrace
+	}
+
+	go func() {
+		select {
+		case <-sigs:
+		case <-done:
+			return
+		}
+		p.Interrupt()
+		fmt.Fprintf(os.Stderr, "interrupted, waiting up to %s for running commands, interrupt again to stop them now\n", grace)
+
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-sigs:
+			fmt.Fprintln(os.Stderr, "interrupted again, stopping")
+			cancel()
+			p.closeConns()
+		case <-timer.C:
+			fmt.Fprintln(os.Stderr, "grace period over, stopping running commands")
+			cancel()
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// inventory is a set of named hosts organised into groups, read from an
+// inventory file.
+type inventory struct {
+	hosts []inventoryHost
+	// groupVars holds the variables defined on each group
+	groupVars map[string]map[string]string
+	// children maps a group to its direct child groups
+	children map[string][]string
+	// aliases are named hosts that are only targeted when referenced by name
+	aliases map[string]inventoryHost
+}
+
+type inventoryHost struct {
+	name string
+	// spec overrides name as the host spec to connect to
+	spec string
+	// groups the host is directly a member of
+	groups []string
+	tags   []string
+	vars   map[string]string
+}
+
+const (
+	allGroup       = "all"
+	ungroupedGroup = "ungrouped"
+)
+
+func newInventory() *inventory {
+	return &inventory{
+		groupVars: map[string]map[string]string{},
+		children:  map[string][]string{},
+		aliases:   map[string]inventoryHost{},
+	}
+}
+
+// loadInventory reads an inventory file, picking the parser from the file
+// extension.
+func loadInventory(path string) (*inventory, error) {
+	var inv *inventory
+	var err error
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yml", ".yaml":
+		var b []byte
+		b, err = os.ReadFile(path)
+		if err != nil {
+			break
+		}
+
+		if isXSHInventory(b) {
+			inv, err = loadXSHInventory(b)
+		} else {
+			inv, err = loadAnsibleYAML(b)
+		}
+	default:
+		inv, err = loadAnsibleINI(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load inventory %s: %v", path, err)
+	}
+
+	return inv, nil
+}
+
+// host returns the host called name, adding it if it doesn't exist yet.
+func (inv *inventory) host(name string) *inventoryHost {
+	for i := range inv.hosts {
+		if inv.hosts[i].name == name {
+			return &inv.hosts[i]
+		}
+	}
+
+	inv.hosts = append(inv.hosts, inventoryHost{name: name, vars: map[string]string{}})
+	return &inv.hosts[len(inv.hosts)-1]
+}
+
+func (h *inventoryHost) addGroup(group string) {
+	if !hasString(h.groups, group) {
+		h.groups = append(h.groups, group)
+	}
+}
+
+func (h *inventoryHost) addTags(tags ...string) {
+	for _, t := range tags {
+		if !hasString(h.tags, t) {
+			h.tags = append(h.tags, t)
+		}
+	}
+}
+
+func (inv *inventory) addChild(parent, child string) {
+	for _, c := range inv.children[parent] {
+		if c == child {
+			return
+		}
+	}
+	inv.children[parent] = append(inv.children[parent], child)
+}
+
+// ancestors returns every group that has group as a descendant, ordered from
+// the outermost group inwards. Parents of the same group come in name order,
+// so later ones win when vars are merged.
+func (inv *inventory) ancestors(group string) []string {
+	var out []string
+	seen := map[string]bool{group: true}
+	parents := sortedKeys(inv.children)
+
+	var visit func(g string)
+	visit = func(g string) {
+		for _, parent := range parents {
+			if seen[parent] || !hasString(inv.children[parent], g) {
+				continue
+			}
+			seen[parent] = true
+			visit(parent)
+			out = append(out, parent)
+		}
+	}
+	visit(group)
+
+	return out
+}
+
+// descendants returns group and every group nested under it.
+func (inv *inventory) descendants(group string) map[string]bool {
+	out := map[string]bool{}
+
+	var visit func(g string)
+	visit = func(g string) {
+		if out[g] {
+			return
+		}
+		out[g] = true
+		for _, c := range inv.children[g] {
+			visit(c)
+		}
+	}
+	visit(group)
+
+	return out
+}
+
+func (inv *inventory) hasGroup(group string) bool {
+	if group == allGroup || group == ungroupedGroup {
+		return true
+	}
+	if _, ok := inv.groupVars[group]; ok {
+		return true
+	}
+	if _, ok := inv.children[group]; ok {
+		return true
+	}
+	for _, h := range inv.hosts {
+		for _, g := range h.groups {
+			if g == group {
+				return true
+			}
+		}
+	}
+	for _, children := range inv.children {
+		for _, c := range children {
+			if c == group {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// memberOf returns the groups h belongs to, directly or through nesting,
+// in a stable order.
+func (inv *inventory) memberOf(h *inventoryHost) []string {
+	seen := map[string]bool{}
+	var out []string
+	for _, g := range h.groups {
+		for _, a := range append(inv.ancestors(g), g) {
+			if a != allGroup && !seen[a] {
+				seen[a] = true
+				out = append(out, a)
+			}
+		}
+	}
+	if len(out) == 0 {
+		out = append(out, ungroupedGroup)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// effectiveVars merges the variables visible to h. Variables on the host win
+// over those of its groups, and nested groups win over their parents.
+func (inv *inventory) effectiveVars(h *inventoryHost) map[string]string {
+	vars := map[string]string{}
+	for k, v := range inv.groupVars[allGroup] {
+		vars[k] = v
+	}
+
+	for _, g := range h.groups {
+		for _, a := range append(inv.ancestors(g), g) {
+			for k, v := range inv.groupVars[a] {
+				vars[k] = v
+			}
+		}
+	}
+
+	for k, v := range h.vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// specs returns the host specs for every host in one of the given groups
+// that also has one of the given tags. An empty groups or tags list doesn't
+// filter.
+func (inv *inventory) specs(groups, tags []string) ([]hostSpec, error) {
+	selected := map[string]bool{}
+	for _, g := range groups {
+		if !inv.hasGroup(g) {
+			return nil, fmt.Errorf("unknown inventory group: %s", g)
+		}
+		for d := range inv.descendants(g) {
+			selected[d] = true
+		}
+	}
+
+	var specs []hostSpec
+	for i := range inv.hosts {
+		h := &inv.hosts[i]
+		memberOf := inv.memberOf(h)
+
+		if len(selected) > 0 && !selected[allGroup] && !inGroups(memberOf, selected) {
+			continue
+		}
+		if len(tags) > 0 && !hasAny(h.tags, tags) {
+			continue
+		}
+
+		vars := inv.effectiveVars(h)
+		spec := h.spec
+		if spec == "" {
+			spec = inventorySpec(h.name, vars)
+		}
+		specs = append(specs, hostSpec{
+			spec:   spec,
+			name:   h.name,
+			groups: memberOf,
+			tags:   h.tags,
+			vars:   vars,
+		})
+	}
+
+	return specs, nil
+}
+
+// resolveAlias replaces hs with the inventory alias it names, if any.
+func (inv *inventory) resolveAlias(hs hostSpec) hostSpec {
+	alias, ok := inv.aliases[hs.spec]
+	if !ok {
+		return hs
+	}
+
+	vars := inv.effectiveVars(&alias)
+	return hostSpec{
+		spec: inventorySpec(alias.spec, vars),
+		name: alias.name,
+		tags: alias.tags,
+		vars: vars,
+	}
+}
+
+func inGroups(groups []string, selected map[string]bool) bool {
+	for _, g := range groups {
+		if selected[g] {
+			return true
+		}
+	}
+	return false
+}
+
+// Connection variables understood in inventories. xsh inventories set them
+// from the user, port, key, agent, password, proxy, websocket and
+// command_timeout fields of hosts and groups.
+const (
+	varUser      = "ansible_user"
+	varPort      = "ansible_port"
+	varKey       = "ansible_ssh_private_key_file"
+	varPassword  = "ansible_password"
+	varAgent     = "xsh_agent"
+	varProxy     = "xsh_proxy"
+	varWebSocket = "xsh_websocket"
+	// varCommandTimeout overrides the command timeout for slow hosts
+	varCommandTimeout = "xsh_command_timeout"
+)
+
+// agentSocketVar maps the agent variable, a boolean or a socket path, to the
+// agent socket of a host.
+func agentSocketVar(v string) string {
+	switch strings.ToLower(v) {
+	case "", "yes", "true":
+		return ""
+	case "no", "false", agentNone:
+		return agentNone
+	default:
+		return v
+	}
+}
+
+// inventorySpec builds a [user@]host[:port] spec for an inventory host from
+// the connection variables. A user or port written in the name itself wins.
+func inventorySpec(name string, vars map[string]string) string {
+	user, addr, found := strings.Cut(name, "@")
+	if !found {
+		user, addr = "", name
+	}
+
+	if a := firstVar(vars, "ansible_host", "ansible_ssh_host"); a != "" {
+		_, port := splitAddr(addr)
+		addr = a
+		if port != "" {
+			addr = net.JoinHostPort(a, port)
+		}
+	}
+
+	if host, port := splitAddr(addr); port == "" {
+		if p := firstVar(vars, varPort, "ansible_ssh_port"); p != "" {
+			addr = net.JoinHostPort(host, p)
+		}
+	}
+
+	if user == "" {
+		user = firstVar(vars, varUser, "ansible_ssh_user")
+	}
+	if user != "" {
+		addr = user + "@" + addr
+	}
+
+	return addr
+}
+
+func hasString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAny(list, values []string) bool {
+	for _, v := range values {
+		if hasString(list, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func firstVar(vars map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := vars[k]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadAnsibleINI reads an Ansible INI inventory, supporting [group],
+// [group:vars] and [group:children] sections.
+func loadAnsibleINI(path string) (*inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	inv := newInventory()
+	group, kind := ungroupedGroup, ""
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			group, kind, _ = strings.Cut(line[1:len(line)-1], ":")
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: unknown section type %s", n, kind)
+			}
+			if _, ok := inv.groupVars[group]; !ok {
+				inv.groupVars[group] = map[string]string{}
+			}
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			k, v, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value", n)
+			}
+			inv.groupVars[group][strings.TrimSpace(k)] = unquote(strings.TrimSpace(v))
+		case "children":
+			inv.addChild(group, line)
+		default:
+			fields := splitQuoted(line)
+			names, err := expandAnsibleRange(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+
+			vars := map[string]string{}
+			for _, field := range fields[1:] {
+				k, v, ok := strings.Cut(field, "=")
+				if !ok {
+					return nil, fmt.Errorf("line %d: expected key=value, got %s", n, field)
+				}
+				vars[k] = unquote(v)
+			}
+
+			for _, name := range names {
+				h := inv.host(name)
+				if group != ungroupedGroup {
+					h.addGroup(group)
+				}
+				for k, v := range vars {
+					h.vars[k] = v
+				}
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return inv, nil
+}
+
+// ansibleYAMLGroup is a group in an Ansible YAML inventory.
+type ansibleYAMLGroup struct {
+	Hosts    map[string]map[string]any    `yaml:"hosts"`
+	Vars     map[string]any               `yaml:"vars"`
+	Children map[string]*ansibleYAMLGroup `yaml:"children"`
+}
+
+// loadAnsibleYAML reads an Ansible YAML inventory.
+func loadAnsibleYAML(b []byte) (*inventory, error) {
+	var groups map[string]*ansibleYAMLGroup
+	if err := yaml.Unmarshal(b, &groups); err != nil {
+		return nil, err
+	}
+
+	inv := newInventory()
+	for _, name := range sortedKeys(groups) {
+		if err := inv.addAnsibleYAMLGroup(name, groups[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	return inv, nil
+}
+
+func (inv *inventory) addAnsibleYAMLGroup(name string, g *ansibleYAMLGroup) error {
+	if _, ok := inv.groupVars[name]; !ok {
+		inv.groupVars[name] = map[string]string{}
+	}
+	if g == nil {
+		return nil
+	}
+
+	for k, v := range g.Vars {
+		inv.groupVars[name][k] = fmt.Sprint(v)
+	}
+
+	for _, pattern := range sortedKeys(g.Hosts) {
+		vars := g.Hosts[pattern]
+		names, err := expandAnsibleRange(pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, hostName := range names {
+			h := inv.host(hostName)
+			if name != allGroup && name != ungroupedGroup {
+				h.addGroup(name)
+			}
+			for k, v := range vars {
+				h.vars[k] = fmt.Sprint(v)
+			}
+		}
+	}
+
+	for _, childName := range sortedKeys(g.Children) {
+		inv.addChild(name, childName)
+		if err := inv.addAnsibleYAMLGroup(childName, g.Children[childName]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sortedKeys returns the keys of m in sorted order, so YAML inventories
+// resolve to the same host order on every run.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ansibleRangeRegex matches Ansible host ranges like [01:50] or [a:f].
+var ansibleRangeRegex = regexp.MustCompile(`\[([0-9]+|[a-z]):([0-9]+|[a-z])\]`)
+
+// expandAnsibleRange expands Ansible's [01:50] and [a:f] host ranges.
+func expandAnsibleRange(pattern string) ([]string, error) {
+	m := ansibleRangeRegex.FindStringSubmatchIndex(pattern)
+	if m == nil {
+		return []string{pattern}, nil
+	}
+
+	lo, hi := pattern[m[2]:m[3]], pattern[m[4]:m[5]]
+	prefix, suffix := pattern[:m[0]], pattern[m[1]:]
+
+	var values []string
+	if len(lo) == 1 && len(hi) == 1 && lo[0] >= 'a' && hi[0] >= 'a' {
+		if hi < lo {
+			return nil, fmt.Errorf("invalid range in %s", pattern)
+		}
+		for c := lo[0]; c <= hi[0]; c++ {
+			values = append(values, string(c))
+		}
+	} else {
+		var err error
+		values, err = expandRange(lo + "-" + hi)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range in %s: %v", pattern, err)
+		}
+	}
+
+	var out []string
+	for _, v := range values {
+		expanded, err := expandAnsibleRange(prefix + v + suffix)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, expanded...)
+	}
+	return out, nil
+}
+
+// splitQuoted splits s on whitespace, keeping quoted sections together.
+func splitQuoted(s string) []string {
+	var fields []string
+	var current strings.Builder
+	var quote rune
+
+	for _, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			current.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote = c
+			current.WriteRune(c)
+		case c == ' ' || c == '\t':
+			if current.Len() > 0 {
+				fields = append(fields, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(c)
+		}
+	}
+	if current.Len() > 0 {
+		fields = append(fields, current.String())
+	}
+	return fields
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInventorySpec(t *testing.T) {
+	tests := []struct {
+		name string
+		host string
+		vars map[string]string
+		want string
+	}{
+		{name: "bare name", host: "web1", want: "web1"},
+		{name: "user and port vars", host: "web1", vars: map[string]string{varUser: "deploy", varPort: "2222"}, want: "deploy@web1:2222"},
+		{name: "old style vars", host: "web1", vars: map[string]string{"ansible_ssh_user": "deploy", "ansible_ssh_port": "2222"}, want: "deploy@web1:2222"},
+		{name: "ansible_host", host: "web1", vars: map[string]string{"ansible_host": "10.0.0.1"}, want: "10.0.0.1"},
+		{name: "ansible_host keeps the port in the name", host: "web1:2200", vars: map[string]string{"ansible_host": "10.0.0.1", varPort: "22"}, want: "10.0.0.1:2200"},
+		{name: "user in the name wins", host: "root@web1", vars: map[string]string{varUser: "deploy"}, want: "root@web1"},
+		{name: "ipv6 ansible_host", host: "db", vars: map[string]string{"ansible_host": "fd00::1", varPort: "22"}, want: "[fd00::1]:22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inventorySpec(tt.host, tt.vars); got != tt.want {
+				t.Errorf("inventorySpec(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandAnsibleRange(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+		wantErr bool
+	}{
+		{pattern: "web1", want: []string{"web1"}},
+		{pattern: "web[01:03]", want: []string{"web01", "web02", "web03"}},
+		{pattern: "db-[a:c]", want: []string{"db-a", "db-b", "db-c"}},
+		{pattern: "r[1:2]n[a:b]", want: []string{"r1na", "r1nb", "r2na", "r2nb"}},
+		{pattern: "db-[c:a]", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			got, err := expandAnsibleRange(tt.pattern)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expandAnsibleRange() error = %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandAnsibleRange() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+const testINIInventory = `
+# comment
+bastion ansible_user=admin
+
+[web]
+web[1:2] ansible_port=2222
+
+[db]
+db1 ansible_host=10.0.0.5 role="primary db"
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ansible_user=deploy
+
+[all:vars]
+ansible_port=22
+`
+
+const testYAMLInventory = `
+all:
+  vars:
+    ansible_port: 22
+  hosts:
+    bastion:
+      ansible_user: admin
+  children:
+    prod:
+      vars:
+        ansible_user: deploy
+      children:
+        web:
+          hosts:
+            web[1:2]:
+              ansible_port: 2222
+        db:
+          hosts:
+            db1:
+              ansible_host: 10.0.0.5
+              role: primary db
+`
+
+func TestLoadInventory(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		data   string
+		groups []string
+		want   []string
+	}{
+		{name: "ini, all hosts", file: "hosts", data: testINIInventory, want: []string{"admin@bastion:22", "deploy@web1:2222", "deploy@web2:2222", "deploy@10.0.0.5:22"}},
+		{name: "ini, nested group", file: "hosts", data: testINIInventory, groups: []string{"prod"}, want: []string{"deploy@web1:2222", "deploy@web2:2222", "deploy@10.0.0.5:22"}},
+		{name: "ini, ungrouped", file: "hosts", data: testINIInventory, groups: []string{ungroupedGroup}, want: []string{"admin@bastion:22"}},
+		{name: "yaml, all hosts", file: "hosts.yml", data: testYAMLInventory, want: []string{"admin@bastion:22", "deploy@10.0.0.5:22", "deploy@web1:2222", "deploy@web2:2222"}},
+		{name: "yaml, child group", file: "hosts.yml", data: testYAMLInventory, groups: []string{"db"}, want: []string{"deploy@10.0.0.5:22"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			inv, err := loadInventory(path)
+			if err != nil {
+				t.Fatalf("loadInventory() = %v", err)
+			}
+			specs, err := inv.specs(tt.groups, nil)
+			if err != nil {
+				t.Fatalf("specs() = %v", err)
+			}
+			var got []string
+			for _, s := range specs {
+				got = append(got, s.spec)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("specs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadInventoryErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "unknown section", data: "[web:hosts]\nweb1\n"},
+		{name: "var without value", data: "[web:vars]\nansible_user\n"},
+		{name: "host var without value", data: "[web]\nweb1 ansible_user\n"},
+		{name: "bad range", data: "[web]\nweb[3:1]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "hosts")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadInventory(path); err == nil {
+				t.Error("loadInventory() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestEffectiveVars(t *testing.T) {
+	inv := newInventory()
+	inv.groupVars[allGroup] = map[string]string{"a": "all", "b": "all", "c": "all", "d": "all"}
+	inv.groupVars["dc"] = map[string]string{"b": "dc", "c": "dc"}
+	inv.groupVars["east"] = map[string]string{"c": "east"}
+	inv.groupVars["prod"] = map[string]string{"c": "prod", "d": "prod"}
+	inv.groupVars["web"] = map[string]string{"d": "web"}
+	// web has two parents, east and prod, and east is nested in dc
+	inv.addChild("prod", "web")
+	inv.addChild("east", "web")
+	inv.addChild("dc", "east")
+	h := inv.host("web1")
+	h.addGroup("web")
+	h.vars["a"] = "host"
+
+	want := map[string]string{"a": "host", "b": "dc", "c": "prod", "d": "web"}
+	// parents sit in a map, so try enough times to hit another order
+	for range 50 {
+		if got := inv.effectiveVars(h); !reflect.DeepEqual(got, want) {
+			t.Fatalf("effectiveVars() = %v, want %v", got, want)
+		}
+	}
+	if got, want := inv.ancestors("web"), []string{"dc", "east", "prod"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ancestors() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// xshInventory is xsh's own YAML inventory format:
+//
+//	vars:
+//	  env: prod
+//	groups:
+//	  web:
+//	    tags: [frontend]
+//	    vars:
+//	      role: web
+//	    hosts:
+//	      - deploy@web[01-03].example.com
+//	      - host: web04.example.com
+//	        user: admin
+//	        port: 2222
+//	        key: ~/.ssh/web04
+//	        agent: no
+//	        password: env:WEB04_PASSWORD
+//	        tags: [canary]
+//	  prod:
+//	    user: deploy
+//	    proxy: socks5://proxy.example.com:1080
+//	    children: [web]
+//	hosts:
+//	  - admin@bastion.example.com
+//	aliases:
+//	  db-primary:
+//	    host: admin@10.1.2.3:2200
+//	    vars:
+//	      role: primary
+//	  cache: admin@10.1.2.4
+type xshInventory struct {
+	Vars    map[string]string   `yaml:"vars"`
+	Groups  map[string]xshGroup `yaml:"groups"`
+	Hosts   []xshHost           `yaml:"hosts"`
+	Aliases map[string]xshHost  `yaml:"aliases"`
+}
+
+type xshGroup struct {
+	xshConn  `yaml:",inline"`
+	Tags     []string          `yaml:"tags"`
+	Vars     map[string]string `yaml:"vars"`
+	Hosts    []xshHost         `yaml:"hosts"`
+	Children []string          `yaml:"children"`
+}
+
+// xshHost is either a plain host spec or a mapping with tags and vars.
+type xshHost struct {
+	xshConn `yaml:",inline"`
+	Host    string            `yaml:"host"`
+	Tags    []string          `yaml:"tags"`
+	Vars    map[string]string `yaml:"vars"`
+}
+
+// xshConn holds per-host or per-group connection overrides.
+type xshConn struct {
+	User string `yaml:"user"`
+	Port string `yaml:"port"`
+	Key  string `yaml:"key"`
+	// Agent is yes, no or the path of an agent socket
+	Agent string `yaml:"agent"`
+	// Password is a literal password or a secret reference like env:NAME or
+	// vault:secret/ssh#password
+	Password string `yaml:"password"`
+	// Proxy is a proxy URL, or none to connect directly
+	Proxy string `yaml:"proxy"`
+	// WebSocket is a ws:// or wss:// gateway URL, or none to connect directly
+	WebSocket string `yaml:"websocket"`
+	// CommandTimeout is how long commands may run for, like 10m, for hosts
+	// known to be slow
+	CommandTimeout string `yaml:"command_timeout"`
+}
+
+// applyTo sets the overrides as connection variables in vars.
+func (c xshConn) applyTo(vars map[string]string) map[string]string {
+	if vars == nil {
+		vars = map[string]string{}
+	}
+	for k, v := range map[string]string{varUser: c.User, varPort: c.Port, varKey: c.Key, varAgent: c.Agent, varPassword: c.Password, varProxy: c.Proxy, varWebSocket: c.WebSocket, varCommandTimeout: c.CommandTimeout} {
+		if v != "" {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+func (h *xshHost) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&h.Host)
+	}
+
+	type plain xshHost
+	return node.Decode((*plain)(h))
+}
+
+// isXSHInventory reports whether the YAML document is in xsh's inventory
+// format rather than Ansible's, which has groups as its top level keys.
+func isXSHInventory(b []byte) bool {
+	var top map[string]yaml.Node
+	if err := yaml.Unmarshal(b, &top); err != nil {
+		return false
+	}
+
+	if _, ok := top["groups"]; ok {
+		return true
+	}
+	if _, ok := top["aliases"]; ok {
+		return true
+	}
+	hosts, ok := top["hosts"]
+	return ok && hosts.Kind == yaml.SequenceNode
+}
+
+// loadXSHInventory reads an inventory in xsh's YAML format.
+func loadXSHInventory(b []byte) (*inventory, error) {
+	var doc xshInventory
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+
+	inv := newInventory()
+	inv.groupVars[allGroup] = doc.Vars
+
+	if err := inv.addXSHHosts("", nil, doc.Hosts); err != nil {
+		return nil, err
+	}
+
+	for name, a := range doc.Aliases {
+		if a.Host == "" {
+			return nil, fmt.Errorf("alias %s has no host", name)
+		}
+		inv.aliases[name] = inventoryHost{name: name, spec: a.Host, tags: a.Tags, vars: a.applyTo(a.Vars)}
+	}
+
+	for _, name := range sortedKeys(doc.Groups) {
+		g := doc.Groups[name]
+		inv.groupVars[name] = g.applyTo(g.Vars)
+		for _, child := range g.Children {
+			inv.addChild(name, child)
+		}
+		if err := inv.addXSHHosts(name, g.Tags, g.Hosts); err != nil {
+			return nil, err
+		}
+	}
+
+	return inv, nil
+}
+
+func (inv *inventory) addXSHHosts(group string, groupTags []string, hosts []xshHost) error {
+	for _, entry := range hosts {
+		if entry.Host == "" {
+			return fmt.Errorf("host entry without a host in group %q", group)
+		}
+
+		h := inv.host(entry.Host)
+		if group != "" {
+			h.addGroup(group)
+		}
+		h.addTags(groupTags...)
+		h.addTags(entry.Tags...)
+		for k, v := range entry.applyTo(entry.Vars) {
+			h.vars[k] = v
+		}
+	}
+	return nil
+}
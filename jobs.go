@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/danvixent/sshx/util"
+)
+
+// jobsDir is where detached jobs are recorded, here and on the hosts.
+const jobsDir = "~/.xsh/jobs"
+
+// remoteJobsDir is jobsDir on the hosts.
+const remoteJobsDir = `"$HOME"/.xsh/jobs`
+
+// Job states reported by CheckJob.
+const (
+	jobRunning = "running"
+	jobExited  = "exited"
+	jobKilled  = "killed"
+	// jobLost jobs stopped without recording how they exited, such as when
+	// the host rebooted
+	jobLost = "lost"
+	// jobMissing jobs aren't on the host, they were reaped already
+	jobMissing = "missing"
+)
+
+// ErrJobRunning is returned by CheckJob when reaping a job still running on
+// some of its hosts.
+var ErrJobRunning = errors.New("job still running")
+
+// Job is a command started with Detach, running in the background on its
+// hosts to be checked on and collected later.
+type Job struct {
+	ID      string    `json:"id"`
+	Command string    `json:"command"`
+	Started time.Time `json:"started"`
+	// Hosts are the user@host:port of the hosts the job was started on
+	Hosts []string `json:"hosts"`
+}
+
+func newJobID() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// checkDetach checks Detach can be used with the other options, the command
+// runs unattended so nothing can answer prompts or read its output.
+func (p *Plan) checkDetach() error {
+	if !p.Detach {
+		return nil
+	}
+	switch {
+	case p.Sudo:
+		return fmt.Errorf("sudo can't be used with detach, nothing would answer its prompt")
+	case len(p.Steps) > 0:
+		return fmt.Errorf("detach runs a single command, use a script for more")
+	case p.Shell == shellPowerShell || p.Shell == shellCmd:
+		return fmt.Errorf("detach can't be used with the %s shell", p.Shell)
+	}
+	return nil
+}
+
+// detachCommand wraps command to run as job id in the background under
+// nohup and setsid, so it outlives the session. Its output and exit status
+// are kept in the job's directory on the host. The job is only started once,
+// running it again fails.
+func detachCommand(id, command string) string {
+	dir := jobDir(id)
+	run := `sh -c "$1"; echo $? > "$XSH_JOB_DIR/exit.tmp" && mv "$XSH_JOB_DIR/exit.tmp" "$XSH_JOB_DIR/exit"`
+	return `d=` + dir + `; (umask 077 && mkdir -p ` + remoteJobsDir + ` && mkdir "$d") || exit; ` +
+		`s=; command -v setsid >/dev/null && s=setsid; ` +
+		`XSH_JOB_DIR="$d" nohup $s sh -c ` + shellQuote(run) + ` xsh ` + shellQuote(command) +
+		` > "$d/out" 2>&1 < /dev/null & echo $! > "$d/pid"; echo $!`
+}
+
+// jobDir is the directory of job id on the host. It is named after the host
+// too, so hosts sharing a home directory don't share it.
+func jobDir(id string) string {
+	return remoteJobsDir + "/" + id + `-"$(uname -n)"`
+}
+
+// jobCommand prints the state of job id on the host on the first line and
+// its output after it. With reap the job is removed from the host unless it
+// still runs, and with kill it is killed first.
+func jobCommand(id string, reap, kill bool) string {
+	cmd := `d=` + jobDir(id) + `; [ -d "$d" ] || { echo ` + jobMissing + `; exit 0; }; ` +
+		`pid=$(cat "$d/pid" 2>/dev/null); k=; `
+	if kill {
+		// the job is its own process group, kill all of it
+		cmd += `if [ ! -f "$d/exit" ] && kill -0 "$pid" 2>/dev/null; then ` +
+			`kill -TERM "-$pid" 2>/dev/null || kill -TERM "$pid"; sleep 1; kill -KILL "-$pid" 2>/dev/null; k=1; fi; `
+	}
+	cmd += `if [ -f "$d/exit" ]; then s="` + jobExited + ` $(cat "$d/exit")"; ` +
+		`elif [ -n "$k" ]; then s=` + jobKilled + `; ` +
+		`elif kill -0 "$pid" 2>/dev/null; then s=` + jobRunning + `; else s=` + jobLost + `; fi; ` +
+		`echo "$s"; cat "$d/out"`
+	if reap {
+		cmd += `; [ "$s" = ` + jobRunning + ` ] || rm -rf "$d"`
+	}
+	return cmd
+}
+
+// SaveJob records the job a detached run started on the hosts it succeeded
+// on, and returns it.
+func (p *Plan) SaveJob(result *Result) (*Job, error) {
+	started := map[string]bool{}
+	for _, r := range result.Successes {
+		started[r.Host] = true
+	}
+
+	job := &Job{ID: p.jobID, Command: p.Command, Started: time.Now()}
+	if p.Script != "" {
+		job.Command = p.Script
+	}
+	for i := range p.hosts {
+		if h := &p.hosts[i]; started[h.name] {
+			job.Hosts = append(job.Hosts, daemonKey(h))
+		}
+	}
+	if len(job.Hosts) == 0 {
+		return nil, fmt.Errorf("the job didn't start on any host")
+	}
+
+	dir := util.ExpandHome(jobsDir)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create jobs directory: %v", err)
+	}
+	b, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal job: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, job.ID+".json"), b, 0o600); err != nil {
+		return nil, fmt.Errorf("failed to record job: %v", err)
+	}
+	return job, nil
+}
+
+// LoadJobs returns the recorded jobs, oldest first.
+func LoadJobs() ([]*Job, error) {
+	paths, err := filepath.Glob(filepath.Join(util.ExpandHome(jobsDir), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []*Job
+	for _, path := range paths {
+		job, err := LoadJob(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Started.Before(jobs[j].Started) })
+	return jobs, nil
+}
+
+// LoadJob returns the recorded job id.
+func LoadJob(id string) (*Job, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return nil, fmt.Errorf("invalid job id %q", id)
+	}
+
+	b, err := os.ReadFile(filepath.Join(util.ExpandHome(jobsDir), id+".json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("no job %s", id)
+		}
+		return nil, fmt.Errorf("failed to read job %s: %v", id, err)
+	}
+
+	var job Job
+	if err := json.Unmarshal(b, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse job %s: %v", id, err)
+	}
+	return &job, nil
+}
+
+// JobStatus is how a job is doing on one of its hosts.
+type JobStatus struct {
+	Host  string
+	State string
+	// ExitStatus is what the job exited with, if its state is exited
+	ExitStatus int
+	Output     string
+	// Error is why the host couldn't be checked on
+	Error string
+}
+
+// CheckJob connects to the hosts of job and returns how it is doing on each,
+// with the output it has written so far. With reap the job is removed from
+// the hosts it is done on, and from here once it is done on all of them;
+// with kill it is killed where it still runs first.
+func (p *Plan) CheckJob(ctx context.Context, job *Job, reap, kill bool) ([]JobStatus, error) {
+	p.PlainHosts = job.Hosts
+	p.Command = jobCommand(job.ID, reap, kill)
+	p.Steps, p.Script, p.Template = nil, "", false
+	p.Detach, p.Sudo = false, false
+	p.OutputFormat = formatJSON
+
+	if err := p.OpenConns(); err != nil {
+		return nil, err
+	}
+	defer close(p.stop)
+
+	result, err := p.Execute(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []JobStatus
+	running := false
+	for _, r := range result.Failures {
+		statuses = append(statuses, JobStatus{Host: r.Host, Error: r.Error})
+		running = true
+	}
+	for _, r := range result.Successes {
+		state, output, _ := strings.Cut(r.Output, "\n")
+		status := JobStatus{Host: r.Host, State: state, Output: output}
+		if s, ok := strings.CutPrefix(state, jobExited+" "); ok {
+			status.State = jobExited
+			status.ExitStatus, _ = strconv.Atoi(s)
+		}
+		running = running || status.State == jobRunning
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+
+	if reap {
+		if running {
+			return statuses, ErrJobRunning
+		}
+		if err := os.Remove(filepath.Join(util.ExpandHome(jobsDir), job.ID+".json")); err != nil {
+			return statuses, fmt.Errorf("failed to remove job record: %v", err)
+		}
+	}
+	return statuses, nil
+}
+
+// PrintJobStatuses writes the state and output of the job on each host.
+func PrintJobStatuses(w io.Writer, statuses []JobStatus) {
+	for _, s := range statuses {
+		state := s.State
+		switch {
+		case s.Error != "":
+			state = "error: " + s.Error
+		case s.State == jobExited:
+			state = fmt.Sprintf("%s %d", s.State, s.ExitStatus)
+		}
+		fmt.Fprintf(w, "==> %s %s <==\n", s.Host, state)
+		_, _ = io.WriteString(w, s.Output)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// dial connects to h, tunnelling through the Teleport proxy, a WebSocket
+// gateway, its ProxyCommand or its ProxyJump hosts if it has any.
+func (p *Plan) dial(h *Host, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	start := time.Now()
+	conn, err := p.dialConn(h)
+	if err != nil {
+		return nil, err
+	}
+	h.dialTime = time.Since(start)
+	return newClient(conn, h.host, cfg)
+}
+
+// dialConn opens the stream to the ssh server of h that dial starts its
+// connection over.
+func (p *Plan) dialConn(h *Host) (net.Conn, error) {
+	if p.Teleport.enabled() {
+		return p.dialTeleport(h)
+	}
+	if ws := p.websocketFor(h); ws != "" {
+		conn, err := p.dialWebSocket(h, ws)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect through websocket: %w", err)
+		}
+		return conn, nil
+	}
+	if h.proxyCommand != "" && !strings.EqualFold(h.proxyCommand, "none") {
+		conn, err := dialProxyCommand(h.host, expandSSHConfigTokens(h.proxyCommand, h))
+		if err != nil {
+			return nil, fmt.Errorf("failed to run proxy command: %v", err)
+		}
+		return conn, nil
+	}
+	if h.proxyJump == "" || strings.EqualFold(h.proxyJump, "none") {
+		return p.dialTCP(h, h.host)
+	}
+
+	var via *ssh.Client
+	var chain []string
+	for _, spec := range strings.Split(h.proxyJump, ",") {
+		spec = strings.TrimSpace(spec)
+		chain = append(chain, spec)
+
+		jump, err := p.jumpConn(h, via, strings.Join(chain, ","), spec)
+		if err != nil {
+			return nil, err
+		}
+		h.warnings = append(h.warnings, jump.warnings...)
+		via = jump.client
+	}
+
+	return via.Dial("tcp", h.host)
+}
+
+// jumpConn is a connection to a jump host, shared by the hosts behind it.
+// It is dialed once, by the first host needing it, and a failure is kept for
+// the rest of the run.
+type jumpConn struct {
+	once   sync.Once
+	client *ssh.Client
+	err    error
+	// warnings are reported with the result of every host behind it
+	warnings []string
+}
+
+// jumpConn returns the connection to the jump host spec, the last hop of
+// chain, dialing it through via. Hosts behind the same chain and proxy share
+// its connections instead of each connecting to the bastions again. The
+// first hop is reached through the proxy of h.
+func (p *Plan) jumpConn(h *Host, via *ssh.Client, chain, spec string) (*jumpConn, error) {
+	key := p.proxyFor(h) + " " + chain
+
+	p.jumpMu.Lock()
+	j, ok := p.jumps[key]
+	if !ok {
+		if p.jumps == nil {
+			p.jumps = map[string]*jumpConn{}
+		}
+		j = &jumpConn{}
+		p.jumps[key] = j
+	}
+	p.jumpMu.Unlock()
+
+	j.once.Do(func() {
+		j.client, j.warnings, j.err = p.dialJump(h, via, spec)
+	})
+	if j.err != nil {
+		return nil, j.err
+	}
+	return j, nil
+}
+
+// dialJump connects to the jump host spec through via, or the proxy of h.
+func (p *Plan) dialJump(h *Host, via *ssh.Client, spec string) (*ssh.Client, []string, error) {
+	jump, err := p.jumpHost(spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jumpCfg, err := p.clientConfig(&jump)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := p.dialVia(h, via, jump.host, jumpCfg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to jump host %s: %w", jump.name, err)
+	}
+	return c, jump.warnings, nil
+}
+
+// closeJumps closes the connections to jump hosts, after those to the hosts
+// behind them.
+func (p *Plan) closeJumps() {
+	p.jumpMu.Lock()
+	defer p.jumpMu.Unlock()
+
+	for _, j := range p.jumps {
+		// waits for a dial still in progress
+		j.once.Do(func() {})
+		if j.client != nil {
+			_ = j.client.Close()
+		}
+	}
+	p.jumps = nil
+}
+
+// jumpHost resolves a [user@]host[:port] jump spec. Its ssh config is applied,
+// except for ProxyJump and ProxyCommand as the chain is given explicitly.
+func (p *Plan) jumpHost(spec string) (Host, error) {
+	h := Host{name: spec, host: spec, proxyJump: "none", proxyCommand: "none"}
+	if user, host, found := strings.Cut(spec, "@"); found {
+		h.user, h.host = user, host
+	}
+
+	p.applySSHConfig(&h)
+	if h.user == "" {
+		return Host{}, fmt.Errorf("invalid jump host: %s, no user given and none found in ssh config", spec)
+	}
+
+	addr, err := normalizeAddr(h.host)
+	if err != nil {
+		return Host{}, fmt.Errorf("invalid jump host: %s, %v", spec, err)
+	}
+	h.host = addr
+
+	return h, nil
+}
+
+// dialVia opens an ssh connection to addr, through via if it is not nil or
+// else through the proxy of h.
+func (p *Plan) dialVia(h *Host, via *ssh.Client, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if via == nil {
+		conn, err = p.dialTCP(h, addr)
+	} else {
+		conn, err = via.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, addr, cfg)
+}
+
+// newClient starts an ssh connection to addr over conn, closing conn if it
+// fails.
+func newClient(conn net.Conn, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
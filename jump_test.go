@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stallingBastion accepts connections and closes each after delay without
+// speaking ssh, counting how many it got.
+func stallingBastion(t *testing.T, delay time.Duration) (string, *atomic.Int32) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			time.AfterFunc(delay, func() { conn.Close() })
+		}
+	}()
+	return ln.Addr().String(), &accepted
+}
+
+func newJumpTestPlan(t *testing.T) *Plan {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("SSH_AUTH_SOCK", "")
+	return &Plan{HostKeyPolicy: "none", Password: "x", KnownHostsFiles: []string{filepath.Join(t.TempDir(), "known_hosts")}}
+}
+
+// dialBehind dials a host behind each of the jump specs at once and returns
+// the errors.
+func dialBehind(p *Plan, jumps []string) []error {
+	errs := make([]error, len(jumps))
+	var wg sync.WaitGroup
+	for i, jump := range jumps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h := &Host{name: "target", host: "10.0.0.1:22", proxyJump: jump}
+			_, errs[i] = p.dialConn(h)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestJumpConnFailureShared(t *testing.T) {
+	p := newJumpTestPlan(t)
+	addr, accepted := stallingBastion(t, 0)
+
+	jumps := make([]string, 8)
+	for i := range jumps {
+		jumps[i] = "u@" + addr
+	}
+	for i, err := range dialBehind(p, jumps) {
+		if err == nil {
+			t.Errorf("host %d connected through a broken jump host", i)
+		}
+	}
+	if n := accepted.Load(); n != 1 {
+		t.Errorf("jump host dialed %d times, want 1", n)
+	}
+	p.closeJumps()
+}
+
+func TestJumpConnParallel(t *testing.T) {
+	p := newJumpTestPlan(t)
+	const delay = 200 * time.Millisecond
+
+	jumps := make([]string, 8)
+	for i := range jumps {
+		addr, _ := stallingBastion(t, delay)
+		jumps[i] = "u@" + addr
+	}
+	start := time.Now()
+	dialBehind(p, jumps)
+	// serialised dials would take len(jumps) * delay
+	if elapsed := time.Since(start); elapsed > 4*delay {
+		t.Errorf("dialing %d jump hosts took %s, want them dialed in parallel", len(jumps), elapsed)
+	}
+	p.closeJumps()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepaliveRequest is the global request OpenSSH sends for
+// ServerAliveInterval, servers answer it even if they don't support it.
+const keepaliveRequest = "keepalive@openssh.com"
+
+// KeepaliveOptions control how connections to hosts are checked for liveness.
+type KeepaliveOptions struct {
+	// Interval is how often a keepalive is sent, 0 disables them
+	Interval time.Duration
+	// CountMax is how many keepalives in a row may go unanswered before the
+	// connection is considered lost
+	CountMax int
+}
+
+// keepalive tracks the keepalives of one connection.
+type keepalive struct {
+	lost atomic.Bool
+}
+
+// startKeepalive sends keepalives on the connection of h until it is closed,
+// closing it if the server stops answering so that a command waiting on it
+// fails instead of hanging.
+func (p *Plan) startKeepalive(h *Host) {
+	interval := p.Keepalive.Interval
+	if interval <= 0 {
+		return
+	}
+	countMax := max(p.Keepalive.CountMax, 1)
+
+	k := &keepalive{}
+	h.keepalive = k
+	go func(c *ssh.Client) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		missed := 0
+		for range ticker.C {
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := c.SendRequest(keepaliveRequest, true, nil)
+				reply <- err
+			}()
+
+			select {
+			case err := <-reply:
+				if err != nil {
+					// the connection was closed
+					return
+				}
+				missed = 0
+			case <-time.After(interval):
+				missed++
+				if missed >= countMax {
+					k.lost.Store(true)
+					_ = c.Close()
+					return
+				}
+			}
+		}
+	}(h.client)
+}
+
+// connectionLost returns the error for a command that failed because the
+// connection to h was lost, or nil if it wasn't.
+func (h *Host) connectionLost() error {
+	if h.keepalive == nil || !h.keepalive.lost.Load() {
+		return nil
+	}
+	return fmt.Errorf("%w: no reply to keepalives", ErrConnectionLost)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/danvixent/sshx/util"
+	"golang.org/x/crypto/ssh"
+)
+
+// parsePrivateKey parses the private key read from path. Encrypted keys are
+// decrypted when the server first accepts them, so their passphrase is only
+// asked for when the key is actually needed. Keys are parsed once per run and
+// shared by every host, so each key is unlocked at most once.
+func (p *Plan) parsePrivateKey(path string, b []byte) (ssh.Signer, error) {
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+
+	if signer, ok := p.keys[path]; ok {
+		return signer, nil
+	}
+
+	signer, err := p.parseKey(path, b)
+	if err != nil {
+		return nil, err
+	}
+	if p.keys == nil {
+		p.keys = map[string]ssh.Signer{}
+	}
+	p.keys[path] = signer
+	return signer, nil
+}
+
+func (p *Plan) parseKey(path string, b []byte) (ssh.Signer, error) {
+	if isSecurityKey(b) {
+		return nil, fmt.Errorf("%s is a FIDO security key, add it to ssh-agent with ssh-add to use it", path)
+	}
+
+	if isPPK(b) {
+		return p.parsePPKKey(path, b)
+	}
+
+	signer, err := ssh.ParsePrivateKey(b)
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return signer, err
+	}
+
+	decrypt := func() (ssh.Signer, error) {
+		return p.decryptPrivateKey(path, func(passphrase []byte) (ssh.Signer, error) {
+			return ssh.ParsePrivateKeyWithPassphrase(b, passphrase)
+		})
+	}
+	if missing.PublicKey == nil {
+		// older PEM keys don't carry their public key in the clear
+		return decrypt()
+	}
+	return &encryptedSigner{pub: missing.PublicKey, decrypt: decrypt}, nil
+}
+
+// parsePPKKey parses a PuTTY key file, which is decrypted on first use like
+// encrypted OpenSSH keys.
+func (p *Plan) parsePPKKey(path string, b []byte) (ssh.Signer, error) {
+	k, err := parsePPK(b)
+	if err != nil {
+		return nil, err
+	}
+	if !k.encrypted() {
+		return k.signer(nil)
+	}
+
+	pub, err := k.publicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid PuTTY key: %v", err)
+	}
+	return &encryptedSigner{pub: pub, decrypt: func() (ssh.Signer, error) {
+		return p.decryptPrivateKey(path, k.signer)
+	}}, nil
+}
+
+// decryptPrivateKey decrypts the encrypted private key at path with parse,
+// using the passphrase from --passphrase-file, or else by prompting for it.
+// Passphrases that worked before are tried first, as keys often share one.
+func (p *Plan) decryptPrivateKey(path string, parse func(passphrase []byte) (ssh.Signer, error)) (ssh.Signer, error) {
+	p.passphraseMu.Lock()
+	defer p.passphraseMu.Unlock()
+
+	for _, passphrase := range p.passphrases {
+		if signer, err := parse(passphrase); err == nil {
+			return signer, nil
+		}
+	}
+
+	if !util.IsStringEmpty(p.PassphraseFile) {
+		passphrase, err := os.ReadFile(util.ExpandHome(p.PassphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %v", err)
+		}
+		passphrase = []byte(strings.TrimRight(string(passphrase), "\r\n"))
+
+		signer, err := parse(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt key %s: %v", path, err)
+		}
+		p.passphrases = append(p.passphrases, passphrase)
+		return signer, nil
+	}
+
+	var err error
+	for attempt := 0; attempt < passwordAttempts; attempt++ {
+		var passphrase string
+		passphrase, err = readPassword(fmt.Sprintf("Enter passphrase for key '%s': ", path))
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		b := []byte(passphrase)
+		signer, err = parse(b)
+		if err == nil {
+			p.passphrases = append(p.passphrases, b)
+			return signer, nil
+		}
+		wipe(b)
+	}
+	return nil, fmt.Errorf("failed to decrypt key %s: %v", path, err)
+}
+
+// isSecurityKey reports whether b is an OpenSSH private key backed by a FIDO
+// authenticator, such as an ed25519-sk key. Signing with those needs the
+// hardware, which only ssh-agent can talk to.
+func isSecurityKey(b []byte) bool {
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "OPENSSH PRIVATE KEY" {
+		return false
+	}
+	return bytes.Contains(block.Bytes, []byte(ssh.KeyAlgoSKED25519)) ||
+		bytes.Contains(block.Bytes, []byte(ssh.KeyAlgoSKECDSA256))
+}
+
+// securityKeySigner prompts for a touch before signing with a FIDO key held
+// by the agent, as the agent blocks until the key confirms user presence.
+type securityKeySigner struct {
+	ssh.Signer
+	host string
+}
+
+func (s *securityKeySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	fmt.Fprintf(os.Stderr, "Confirm user presence for key %s to connect to %s\n", ssh.FingerprintSHA256(s.PublicKey()), s.host)
+	return s.Signer.Sign(rand, data)
+}
+
+// encryptedSigner is the signer of an encrypted key, decrypted on first use.
+type encryptedSigner struct {
+	pub     ssh.PublicKey
+	decrypt func() (ssh.Signer, error)
+
+	once   sync.Once
+	signer ssh.Signer
+	err    error
+}
+
+func (s *encryptedSigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	s.once.Do(func() {
+		s.signer, s.err = s.decrypt()
+	})
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if as, ok := s.signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	return s.signer.Sign(rand, data)
+}
+
+// ephemeralSigner generates a throwaway ed25519 key for credentials that are
+// only valid for a single run, like Vault certificates.
+func ephemeralSigner() (ssh.Signer, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewSignerFromKey(priv)
+}
+
+// wipe zeroes a secret once it is no longer needed.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipeSecrets zeroes the passphrases, password and keyboard-interactive
+// answers cached for the run and drops the Vault secrets read. Strings
+// handed to the ssh package can't be zeroed, so this only limits how long
+// secrets stay in memory.
+func (p *Plan) wipeSecrets() {
+	p.passphraseMu.Lock()
+	for _, b := range p.passphrases {
+		wipe(b)
+	}
+	p.passphrases = nil
+	p.passphraseMu.Unlock()
+
+	p.passwordMu.Lock()
+	wipe(p.askedPassword)
+	p.askedPassword = nil
+	p.passwordMu.Unlock()
+
+	p.promptMu.Lock()
+	for _, b := range p.kiCache {
+		wipe(b)
+	}
+	p.kiCache = nil
+	p.promptMu.Unlock()
+
+	p.secretsMu.Lock()
+	p.secrets = nil
+	p.secretsMu.Unlock()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Orders hosts can be run on in.
+const (
+	orderGiven   = ""
+	orderFastest = "fastest"
+	orderSlowest = "slowest"
+)
+
+func checkOrder(order string) error {
+	switch order {
+	case orderGiven, orderFastest, orderSlowest:
+		return nil
+	default:
+		return fmt.Errorf("invalid order %s, must be %s or %s", order, orderFastest, orderSlowest)
+	}
+}
+
+// executionOrder returns the hosts in the order their commands are started
+// in, by connection latency for the fastest and slowest orders. Hosts whose
+// latency wasn't measured, such as those run through a daemon, go last.
+func (p *Plan) executionOrder() []*Host {
+	hosts := make([]*Host, len(p.hosts))
+	for i := range p.hosts {
+		hosts[i] = &p.hosts[i]
+	}
+	if p.Order == orderGiven {
+		return hosts
+	}
+
+	sort.SliceStable(hosts, func(i, j int) bool {
+		a, b := hosts[i].latency, hosts[j].latency
+		if a == 0 || b == 0 {
+			return b == 0 && a != 0
+		}
+		if p.Order == orderSlowest {
+			return a > b
+		}
+		return a < b
+	})
+	return hosts
+}
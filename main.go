@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"time"
 	_ "time/tzdata"
 
@@ -10,54 +13,453 @@ import (
 )
 
 func main() {
-	var hosts []string
-	var command string
+	var hostLists []string
+	var hostsFile string
+	var sshConfigFile string
+	var inventoryFile string
+	var groups []string
+	var tags []string
+	var exclude []string
+	var filters []string
+	var limit int
+	var sample int
+	var aws AWSOptions
+	var gcp GCPOptions
+	var azure AzureOptions
+	var consul ConsulOptions
+	var k8s KubernetesOptions
+	var terraform TerraformOptions
+	var vagrant VagrantOptions
+	var fromKnownHosts string
+	var commands []string
+	var script string
+	var scriptArgs []string
+	var templateCommand bool
+	var user string
 	var keyFile string
+	var vault VaultOptions
+	var teleport TeleportOptions
+	var password string
+	var askPass bool
+	var passphraseFile string
+	var kiAnswers []string
+	var gssapiAuth bool
+	var forwardAgent bool
+	var showBanners bool
+	var requireAll bool
+	var rekeyThreshold uint64
+	var maxConnectionLifetime time.Duration
+	var debug bool
+	var agentSocket string
+	var authOrder []string
+	var proxyJump string
+	var proxyCommand string
+	var proxyURL string
+	var websocketURL string
+	var websocketHeaders []string
+	var knownHostsFiles []string
+	var hostKeyPolicy string
+	var strictChecking string
+	var hashKnownHosts bool
+	var algorithms AlgorithmOptions
+	var connectRetry RetryOptions
+	var commandRetry RetryOptions
+	var keepalive KeepaliveOptions
+	var compression bool
+	var pty bool
+	var env []string
+	var chdir string
+	var shell string
+	var sendEnv []string
+	var groupCommands []string
+	var groupCommandsFile string
+	var when string
+	var until string
+	var pollInterval, maxWait time.Duration
+	var sudo bool
+	var becomeUser string
+	var sudoPassword string
+	var askSudoPass bool
+	var daemonSocket string
+	var preferFamily string
+	var maxConnectsPerSecond float64
+	var reconnect bool
+	var order string
+	var batchSize string
+	var canary string
+	var failFast bool
+	var maxFailures string
+	var exitCodePolicy string
+	var exitCodePercentage int
+	var canaryExpect string
+	var batchPause time.Duration
+	var stagger time.Duration
+	var serial bool
+	var stream bool
+	var detach bool
+	var interruptGrace time.Duration
+	var staggerJitter bool
+	var remoteForwards []string
+	var yes bool
+	var confirmAbove int
 	var outputFile string
+	var outputFormat string
 	var parallelLimit int
-	var timeout time.Duration
+	var connectTimeout time.Duration
+	var commandTimeout time.Duration
+	var timeoutOverrides string
 
-	cmd := &cobra.Command{
+	// cmd is the root command, declared early so newPlan can tell which
+	// flags were set
+	var cmd *cobra.Command
+
+	// newPlan builds a plan from the command line flags
+	newPlan := func() (*Plan, error) {
+		var hosts []string
+		for _, list := range hostLists {
+			hosts = append(hosts, splitHostList(list)...)
+		}
+
+		var pl *int
+		if parallelLimit > 0 {
+			pl = &parallelLimit
+		}
+		var command string
+		if len(commands) > 0 {
+			command = commands[0]
+		}
+		p, err := NewPlan(
+			hosts,
+			command,
+			keyFile,
+			outputFile,
+			pl,
+		)
+		if err != nil {
+			return nil, err
+		}
+		p.User = user
+		p.OutputFormat = outputFormat
+		p.Template = templateCommand
+		if len(commands) > 1 {
+			p.Steps = commands[1:]
+		}
+		p.Script = script
+		p.ScriptArgs = scriptArgs
+		p.HostsFile = hostsFile
+		p.SSHConfigPath = sshConfigFile
+		p.Inventory = inventoryFile
+		p.Groups = groups
+		p.Tags = tags
+		p.Exclude = exclude
+		p.Filters = filters
+		p.Limit = limit
+		p.Sample = sample
+		p.AWS = aws
+		p.GCP = gcp
+		p.Azure = azure
+		p.Consul = consul
+		p.Kubernetes = k8s
+		p.Terraform = terraform
+		p.Vagrant = vagrant
+		p.FromKnownHosts = fromKnownHosts
+		p.Vault = vault
+		p.Teleport = teleport
+		p.AgentSocket = agentSocket
+		p.AuthOrder = authOrder
+		p.ProxyJump = proxyJump
+		p.ProxyCommand = proxyCommand
+		p.Proxy = proxyURL
+		p.WebSocket = websocketURL
+		p.WebSocketHeaders = websocketHeaders
+		p.Password = password
+		if p.Password == "" {
+			p.Password = os.Getenv("XSH_PASSWORD")
+		}
+		p.AskPass = askPass
+		p.PassphraseFile = passphraseFile
+		p.KIAnswers = kiAnswers
+		p.GSSAPI = gssapiAuth
+		p.ForwardAgent = forwardAgent
+		p.ShowBanners = showBanners
+		p.RequireAll = requireAll
+		p.RekeyThreshold = rekeyThreshold
+		p.MaxConnectionLifetime = maxConnectionLifetime
+		p.Debug = debug
+		p.KnownHostsFiles = knownHostsFiles
+		if cmd.PersistentFlags().Changed("host-key-policy") {
+			p.HostKeyPolicy = hostKeyPolicy
+		}
+		if strictChecking != "" {
+			p.HostKeyPolicy, err = strictHostKeyChecking(strictChecking)
+			if err != nil {
+				return nil, err
+			}
+		}
+		p.HashKnownHosts = hashKnownHosts
+		p.Algorithms = algorithms
+		p.ConnectRetry = connectRetry
+		p.CommandRetry = commandRetry
+		p.Keepalive = keepalive
+		p.Compression = compression
+		p.PTY = pty
+		p.Env = env
+		p.Chdir = chdir
+		p.Shell = shell
+		p.SendEnv = sendEnv
+		p.GroupCommands = groupCommands
+		p.GroupCommandsFile = groupCommandsFile
+		p.When = when
+		p.Until = until
+		p.PollInterval = pollInterval
+		p.MaxWait = maxWait
+		p.Sudo = sudo
+		p.BecomeUser = becomeUser
+		p.SudoPassword = sudoPassword
+		if p.SudoPassword == "" {
+			p.SudoPassword = os.Getenv("XSH_SUDO_PASSWORD")
+		}
+		p.AskSudoPass = askSudoPass
+		p.DaemonSocket = daemonSocket
+		p.PreferFamily = preferFamily
+		p.MaxConnectsPerSecond = maxConnectsPerSecond
+		p.Reconnect = reconnect
+		p.Order = order
+		p.BatchSize = batchSize
+		p.Canary = canary
+		p.FailFast = failFast
+		p.MaxFailures = maxFailures
+		p.ExitCodePolicy = exitCodePolicy
+		if cmd.PersistentFlags().Changed("exit-code-percentage") {
+			p.ExitCodePercentage = &exitCodePercentage
+		}
+		p.CanaryExpect = canaryExpect
+		p.BatchPause = batchPause
+		p.Stagger = stagger
+		p.Serial = serial
+		p.Stream = stream
+		p.Detach = detach
+		p.InterruptGrace = interruptGrace
+		p.StaggerJitter = staggerJitter
+		p.RemoteForwards = remoteForwards
+		p.ConnectTimeout = connectTimeout
+		p.CommandTimeout = commandTimeout
+		p.TimeoutOverrides = timeoutOverrides
+		p.Yes = yes
+		p.ConfirmAbove = confirmAbove
+
+		if len(p.PlainHosts) == 0 && !p.hasHostSources() && isPiped(os.Stdin) {
+			p.PlainHosts = []string{stdinHosts}
+		}
+
+		return p, nil
+	}
+
+	cmd = &cobra.Command{
 		Use:     "xsh",
 		Version: "0.1",
 		Short:   "Multi-host ssh command runner",
+		// failed hosts are an error too, the usage wouldn't help with them
+		SilenceUsage: true,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			var pl *int
-			if parallelLimit > 0 {
-				pl = &parallelLimit
-			}
-			p, err := NewPlan(
-				hosts,
-				command,
-				keyFile,
-				outputFile,
-				pl,
-			)
+			p, err := newPlan()
 			if err != nil {
 				log.Fatalf("Error creating plan: %s", err)
 			}
+			defer p.wipeSecrets()
 
 			err = p.OpenConns()
 			if err != nil {
 				return err
 			}
+			if err := p.Confirm(); err != nil {
+				return err
+			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), timeout)
-			defer cancel()
+			ctx, stop := p.HandleInterrupts(context.Background())
+			defer stop()
 
 			result, err := p.Execute(ctx)
-			if err != nil {
-				return err
+			if werr := p.WriteResult(result); werr != nil {
+				return werr
 			}
-
-			return p.WriteResult(result)
+			if p.Detach && len(result.Successes) > 0 {
+				job, jerr := p.SaveJob(result)
+				if jerr != nil {
+					return jerr
+				}
+				fmt.Fprintf(os.Stderr, "started job %s on %d hosts, see xsh attach %s\n", job.ID, len(job.Hosts), job.ID)
+			}
+			if err == nil {
+				err = p.ExitCodeError(result)
+			}
+			return err
 		},
 	}
 
-	cmd.PersistentFlags().StringSliceVar(&hosts, "hosts", []string{}, "hosts to connect to")
-	cmd.PersistentFlags().StringVar(&command, "command", "", "command to execute")
-	cmd.PersistentFlags().StringVar(&keyFile, "key", "", "ssh key file path")
+	cmd.PersistentFlags().StringArrayVar(&hostLists, "hosts", []string{}, "hosts to connect to as [user@]host[:port], with IPv6 addresses in brackets like root@[2001:db8::1]:22, use - to read them from stdin or srv:name to resolve a DNS SRV record")
+	cmd.PersistentFlags().StringVar(&hostsFile, "hosts-file", "", "file containing newline-delimited user@host entries")
+	cmd.PersistentFlags().StringArrayVar(&exclude, "exclude", []string{}, "skip hosts whose whole name or address matches this glob, or regex when prefixed with ~ or using ( ) | + ^ $ or \\")
+	cmd.PersistentFlags().StringArrayVar(&filters, "filter", []string{}, "only target hosts whose whole name, address, tag or label matches this glob or regex, like web-(0[1-9]|1[0-5]), use key=pattern to match one var, discovered tags and labels are tag.<key> and label.<key>")
+	cmd.PersistentFlags().IntVar(&limit, "limit", 0, "only target the first N hosts")
+	cmd.PersistentFlags().IntVar(&sample, "sample", 0, "only target N randomly chosen hosts")
+	cmd.PersistentFlags().StringVar(&inventoryFile, "inventory", "", "inventory file, in xsh yaml or ansible ini/yaml format")
+	cmd.PersistentFlags().StringSliceVar(&groups, "group", []string{}, "only target hosts in these inventory groups")
+	cmd.PersistentFlags().StringSliceVar(&tags, "tag", []string{}, "only target inventory hosts with one of these tags")
+	cmd.PersistentFlags().StringSliceVar(&aws.Tags, "aws-tag", []string{}, "target running EC2 instances with these Key=Value tags")
+	cmd.PersistentFlags().StringVar(&aws.Region, "aws-region", "", "AWS region to query")
+	cmd.PersistentFlags().StringVar(&aws.Profile, "aws-profile", "", "AWS cli profile to use")
+	cmd.PersistentFlags().StringVar(&aws.User, "aws-user", "", "login user for EC2 instances")
+	cmd.PersistentFlags().StringVar(&aws.Address, "aws-address", "private", "EC2 address to connect to, private or public")
+	cmd.PersistentFlags().BoolVar(&aws.InstanceConnect, "aws-instance-connect", false, "push a temporary key to EC2 instances with EC2 Instance Connect before connecting")
+	cmd.PersistentFlags().StringVar(&gcp.Project, "gcp-project", "", "target running instances in this GCP project")
+	cmd.PersistentFlags().StringVar(&gcp.Filter, "gcp-filter", "", "gcloud filter expression for instances, e.g. labels.role=web")
+	cmd.PersistentFlags().StringVar(&gcp.User, "gcp-user", "", "login user for GCP instances")
+	cmd.PersistentFlags().BoolVar(&gcp.OSLogin, "gcp-os-login", false, "use the OS Login username of the active gcloud account and add a temporary key to its profile")
+	cmd.PersistentFlags().StringVar(&gcp.Address, "gcp-address", "private", "GCP address to connect to, private or public")
+	cmd.PersistentFlags().StringVar(&azure.ResourceGroup, "azure-resource-group", "", "target running VMs in this Azure resource group")
+	cmd.PersistentFlags().StringSliceVar(&azure.Tags, "azure-tag", []string{}, "target running Azure VMs with these Key=Value tags")
+	cmd.PersistentFlags().StringVar(&azure.Subscription, "azure-subscription", "", "Azure subscription to query")
+	cmd.PersistentFlags().StringVar(&azure.User, "azure-user", "", "login user for Azure VMs")
+	cmd.PersistentFlags().StringVar(&azure.Address, "azure-address", "private", "Azure address to connect to, private or public")
+	cmd.PersistentFlags().StringVar(&consul.Service, "consul-service", "", "target healthy nodes of this Consul service")
+	cmd.PersistentFlags().StringVar(&consul.Addr, "consul-addr", "", "Consul HTTP address, defaults to CONSUL_HTTP_ADDR")
+	cmd.PersistentFlags().StringVar(&consul.Datacenter, "consul-datacenter", "", "Consul datacenter to query")
+	cmd.PersistentFlags().StringSliceVar(&consul.Tags, "consul-tag", []string{}, "only target service instances with these tags")
+	cmd.PersistentFlags().StringVar(&consul.User, "consul-user", "", "login user for Consul nodes")
+	cmd.PersistentFlags().BoolVar(&k8s.Nodes, "k8s-nodes", false, "target the nodes of the current kubernetes cluster")
+	cmd.PersistentFlags().StringVar(&k8s.Selector, "k8s-selector", "", "label selector for kubernetes nodes")
+	cmd.PersistentFlags().StringVar(&k8s.Kubeconfig, "kubeconfig", "", "kubeconfig file to use")
+	cmd.PersistentFlags().StringVar(&k8s.Context, "k8s-context", "", "kubeconfig context to use")
+	cmd.PersistentFlags().StringVar(&k8s.User, "k8s-user", "", "login user for kubernetes nodes")
+	cmd.PersistentFlags().StringVar(&k8s.Address, "k8s-address", "internal", "node address to connect to, internal or external")
+	cmd.PersistentFlags().StringVar(&terraform.StatePath, "terraform-state", "", "target compute instances in this terraform state file")
+	cmd.PersistentFlags().StringVar(&terraform.User, "terraform-user", "", "login user for terraform instances")
+	cmd.PersistentFlags().StringVar(&terraform.Address, "terraform-address", "private", "instance address to connect to, private or public")
+	cmd.PersistentFlags().BoolVar(&vagrant.Enabled, "vagrant", false, "target the machines of the vagrant environment in the current directory")
+	cmd.PersistentFlags().StringVar(&vagrant.ConfigFile, "vagrant-ssh-config", "", "read vagrant machines from saved vagrant ssh-config output")
+	cmd.PersistentFlags().StringVar(&fromKnownHosts, "from-known-hosts", "", "target hosts from ~/.ssh/known_hosts, optionally only those matching a glob or ~regex")
+	cmd.PersistentFlags().Lookup("from-known-hosts").NoOptDefVal = "*"
+	cmd.PersistentFlags().StringVar(&sshConfigFile, "ssh-config", defaultSSHConfigFile, "ssh client config file, pass an empty value to disable")
+	cmd.PersistentFlags().BoolVar(&templateCommand, "template", false, "render the command as a Go template with host details and inventory vars, e.g. {{.Vars.service}}, use {{quote .Vars.service}} to pass a value as one shell word")
+	cmd.PersistentFlags().StringVar(&user, "user", "", "login user for hosts given without one")
+	cmd.PersistentFlags().StringVar(&script, "script", "", "local script to upload to every host, run before the commands and remove again, instead of quoting it into --command")
+	cmd.PersistentFlags().StringArrayVar(&scriptArgs, "script-arg", []string{}, "argument to pass to the script, repeat for more")
+	cmd.PersistentFlags().StringArrayVar(&commands, "command", []string{}, "command to execute, repeat to run more commands in order over the same connection")
+	cmd.PersistentFlags().StringVar(&keyFile, "key", "", "ssh key file path, in OpenSSH, PEM or PuTTY ppk format")
+	cmd.PersistentFlags().StringVar(&vault.Role, "vault-ssh-role", "", "sign a throwaway key for this run with this Vault SSH secrets engine role")
+	cmd.PersistentFlags().StringVar(&vault.Mount, "vault-ssh-mount", defaultVaultSSHMount, "mount path of the Vault SSH secrets engine")
+	cmd.PersistentFlags().StringVar(&vault.Addr, "vault-addr", "", "Vault address, defaults to VAULT_ADDR")
+	cmd.PersistentFlags().BoolVar(&teleport.Enabled, "teleport", false, "connect through the Teleport proxy with the certificate of the current tsh login")
+	cmd.PersistentFlags().StringVar(&teleport.Proxy, "teleport-proxy", "", "Teleport proxy address, defaults to that of the active tsh profile")
+	cmd.PersistentFlags().StringVar(&teleport.Cluster, "teleport-cluster", "", "Teleport cluster to connect to, defaults to that of the active tsh profile")
+	cmd.PersistentFlags().StringVar(&password, "password", "", "password to try after public keys, or an env:NAME or vault:path#field reference to it, prefer a reference, XSH_PASSWORD or --ask-pass as flags are visible to other users")
+	cmd.PersistentFlags().BoolVar(&askPass, "ask-pass", false, "prompt for a password to try after public keys")
+	cmd.PersistentFlags().StringArrayVar(&knownHostsFiles, "known-hosts", []string{}, "known_hosts file to verify host keys against, defaults to those read by ssh")
+	cmd.PersistentFlags().StringSliceVar(&algorithms.Ciphers, "ciphers", []string{}, "only negotiate these ciphers, in order of preference")
+	cmd.PersistentFlags().StringSliceVar(&algorithms.KeyExchanges, "kex-algorithms", []string{}, "only negotiate these key exchange algorithms, in order of preference")
+	cmd.PersistentFlags().StringSliceVar(&algorithms.MACs, "macs", []string{}, "only negotiate these MAC algorithms, in order of preference")
+	cmd.PersistentFlags().StringSliceVar(&algorithms.HostKeys, "hostkey-algorithms", []string{}, "only accept host keys of these algorithms, in order of preference, overrides HostKeyAlgorithms in the ssh config")
+	cmd.PersistentFlags().BoolVar(&algorithms.FIPS, "fips", false, "only negotiate FIPS 140 approved algorithms")
+	cmd.PersistentFlags().StringVar(&daemonSocket, "daemon-socket", "", "socket of the xsh daemon to run through, or to listen on, defaults to "+defaultDaemonSocket+" if a daemon listens there, none connects directly")
+	cmd.PersistentFlags().StringVar(&shell, "shell", shellNone, "run commands with bash, sh, powershell or cmd, for Windows OpenSSH servers and minimal images, none hands them to the login shell")
+	cmd.PersistentFlags().StringVar(&chdir, "chdir", "", "directory to run the commands from on every host, ~/ for the remote home, commands don't run where it doesn't exist")
+	cmd.PersistentFlags().StringArrayVar(&groupCommands, "group-command", []string{}, "group=command to run on the hosts of an inventory group instead of --command, repeat for more groups")
+	cmd.PersistentFlags().StringVar(&when, "when", "", `only run on hosts whose facts match this condition, like 'facts.os == "ubuntu" && facts.memory_gb > 8', with facts.os, os_version, os_family, kernel, arch, hostname, cpus and memory_gb`)
+	cmd.PersistentFlags().StringVar(&until, "until", "", `run the commands on each host again until this condition on their exit and output holds, like 'exit == 0 && output matches "active \(running\)"'`)
+	cmd.PersistentFlags().DurationVar(&pollInterval, "interval", defaultPollInterval, "wait between runs of the commands with --until")
+	cmd.PersistentFlags().DurationVar(&maxWait, "max-wait", defaultMaxWait, "how long to keep running the commands with --until before failing the host, --command-timeout limits each run")
+	cmd.PersistentFlags().StringVar(&groupCommandsFile, "group-commands-file", "", "yaml file mapping inventory groups to the command their hosts run")
+	cmd.PersistentFlags().StringArrayVar(&env, "env", []string{}, "NAME=value variable to set for the commands, repeat for more")
+	cmd.PersistentFlags().StringArrayVar(&sendEnv, "send-env", []string{}, "pass on local variables whose names match this glob, like SendEnv in the ssh config")
+	cmd.PersistentFlags().BoolVar(&sudo, "sudo", false, "run commands through sudo as root, answering its password prompt with --sudo-password or --ask-sudo-pass")
+	cmd.PersistentFlags().StringVar(&becomeUser, "become-user", "", "run commands through sudo as this user, implies --sudo")
+	cmd.PersistentFlags().StringVar(&sudoPassword, "sudo-password", "", "sudo password, or an env:NAME or vault:path#field reference to it, XSH_SUDO_PASSWORD also sets it")
+	cmd.PersistentFlags().BoolVar(&askSudoPass, "ask-sudo-pass", false, "prompt for the sudo password once and use it on every host")
+	cmd.PersistentFlags().BoolVar(&pty, "pty", false, "run commands in a pseudo terminal, for those that need one such as sudo prompting for a password, output then has terminal line endings")
+	cmd.PersistentFlags().BoolVarP(&compression, "compression", "C", false, "zlib compression of the ssh transport like ssh -C, not supported by x/crypto/ssh so runs using it are refused")
+	cmd.PersistentFlags().DurationVar(&keepalive.Interval, "keepalive-interval", 15*time.Second, "send a keepalive to each host this often, like ServerAliveInterval, 0 disables them")
+	cmd.PersistentFlags().IntVar(&keepalive.CountMax, "keepalive-count-max", 3, "fail hosts with a connection lost error after this many keepalives go unanswered")
+	cmd.PersistentFlags().StringVar(&preferFamily, "prefer-family", familyAny, "address family to try first for hosts with both IPv4 and IPv6 addresses, ipv4, ipv6 or any for the resolver's order, the other is raced after 250ms")
+	cmd.PersistentFlags().Float64Var(&maxConnectsPerSecond, "max-connects-per-second", 0, "limit how many connections are attempted per second, so large runs don't trip fail2ban, bastion or auth backend rate limits, 0 is unlimited")
+	cmd.PersistentFlags().StringArrayVarP(&remoteForwards, "remote", "R", []string{}, "forward [bind_address:]port:host:hostport on every host to host:hostport from here while the command runs, like ssh -R")
+	cmd.PersistentFlags().BoolVar(&failFast, "fail-fast", false, "stop starting the command on more hosts after it failed on one, the hosts it didn't start on are reported as skipped")
+	cmd.PersistentFlags().StringVar(&exitCodePolicy, "exit-code-policy", exitPolicyAny, "when failed hosts make xsh exit non-zero: any, all, or percentage for at least --exit-code-percentage of them")
+	cmd.PersistentFlags().IntVar(&exitCodePercentage, "exit-code-percentage", defaultExitCodePercentage, "percentage of hosts that must fail for xsh to exit non-zero with --exit-code-policy percentage")
+	cmd.PersistentFlags().StringVar(&maxFailures, "max-failures", "", "stop starting the command on more hosts after it failed on this many, or a percentage of them")
+	cmd.PersistentFlags().StringVar(&canary, "canary", "", "run the command on this many hosts, or a percentage of them, first and only go on to the rest if it succeeded on all of them")
+	cmd.PersistentFlags().StringVar(&canaryExpect, "canary-expect", "", "regex the output of the canaries must match for the run to go on")
+	cmd.PersistentFlags().StringVar(&batchSize, "batch-size", "", "roll the command across the hosts in waves of this many hosts, or a percentage of them like 25%, each wave finishing before the next starts")
+	cmd.PersistentFlags().DurationVar(&batchPause, "batch-pause", 0, "wait between waves of --batch-size")
+	cmd.PersistentFlags().BoolVar(&detach, "detach", false, "start the command in the background on the hosts and return, check on it later with xsh jobs, attach and reap")
+	cmd.PersistentFlags().BoolVar(&stream, "stream", false, "print each line of output as it arrives, prefixed with the name of its host, like web01 | ...")
+	cmd.PersistentFlags().BoolVar(&serial, "serial", false, "run on one host at a time in the order they were given, printing the output as it arrives, for risky changes")
+	cmd.PersistentFlags().DurationVar(&interruptGrace, "interrupt-grace", defaultInterruptGrace, "how long running commands get to finish after an interrupt, before they are stopped")
+	cmd.PersistentFlags().DurationVar(&stagger, "stagger", 0, "wait between starting the command on each host, like 200ms, so backends the command hits aren't hit by every host at once")
+	cmd.PersistentFlags().BoolVar(&staggerJitter, "stagger-jitter", false, "wait a random time up to --stagger between hosts instead")
+	cmd.PersistentFlags().StringVar(&order, "order", "", "start the command on the hosts that connected fastest or slowest first, by connection latency, instead of in the order given")
+	cmd.PersistentFlags().BoolVar(&reconnect, "reconnect", false, "reconnect to hosts whose connection drops while the command runs and run it again, only for commands that are safe to repeat")
+	cmd.PersistentFlags().IntVar(&commandRetry.Retries, "retries", 0, "run the command again on hosts where it failed, up to this many times, only for commands that are safe to repeat")
+	cmd.PersistentFlags().DurationVar(&commandRetry.Backoff, "retry-delay", 5*time.Second, "wait before running a failed command again, doubled after each retry")
+	cmd.PersistentFlags().DurationVar(&commandRetry.MaxBackoff, "retry-max-delay", 5*time.Minute, "longest wait between command retries")
+	cmd.PersistentFlags().BoolVar(&commandRetry.Jitter, "retry-jitter", false, "wait a random time between half and all of each retry delay, so hosts that failed together don't retry together")
+	cmd.PersistentFlags().IntVar(&connectRetry.Retries, "connect-retries", 0, "retry connections that fail with a network error, such as a host that is rebooting, this many times")
+	cmd.PersistentFlags().DurationVar(&connectRetry.Backoff, "connect-backoff", time.Second, "wait before the first connect retry, doubled after each retry")
+	cmd.PersistentFlags().DurationVar(&connectRetry.MaxBackoff, "connect-max-backoff", 30*time.Second, "longest wait between connect retries")
+	cmd.PersistentFlags().BoolVar(&connectRetry.Jitter, "connect-jitter", false, "wait a random time between half and all of each connect backoff")
+	cmd.PersistentFlags().StringVar(&hostKeyPolicy, "host-key-policy", hostKeyPolicyStrict, "what to do with unknown host keys: strict rejects them, tofu asks to trust and record them, accept-new records them and none also accepts changed keys, vagrant machines are checked as their ssh-config asks unless given")
+	cmd.PersistentFlags().StringVar(&strictChecking, "strict-host-key-checking", "", "OpenSSH style yes, ask, accept-new or no, overrides --host-key-policy")
+	cmd.PersistentFlags().BoolVar(&hashKnownHosts, "hash-known-hosts", false, "hash host names of keys added to known_hosts, also enabled by HashKnownHosts in the ssh config")
+	cmd.PersistentFlags().BoolVarP(&yes, "yes", "y", false, "answer yes to prompts, such as trusting unknown host keys")
+	cmd.PersistentFlags().IntVar(&confirmAbove, "confirm-above", defaultConfirmAbove, "show the hosts and command and ask to confirm before running on more than this many hosts, 0 to never ask")
+	cmd.PersistentFlags().StringVarP(&proxyJump, "jump", "J", "", "connect through these comma separated [user@]host[:port] jump hosts, like ssh -J, none disables ProxyJump from the ssh config")
+	cmd.PersistentFlags().StringVar(&proxyCommand, "proxy-command", "", "command whose stdin and stdout connect to the host, like ProxyCommand in the ssh config, with %h, %p and %r expanded")
+	cmd.PersistentFlags().StringVar(&proxyURL, "proxy", "", "connect to hosts, or the first jump host, through this socks5://, socks5h://, http:// or https:// proxy, xsh_proxy or proxy in an inventory sets one per group or host")
+	cmd.PersistentFlags().StringVar(&websocketURL, "websocket", "", "reach hosts through this ws:// or wss:// gateway carrying ssh over a WebSocket, with %h, %p and %r expanded, xsh_websocket or websocket in an inventory sets one per group or host")
+	cmd.PersistentFlags().StringArrayVar(&websocketHeaders, "websocket-header", []string{}, "\"Name: value\" header to send to the websocket gateway, such as an access token")
+	cmd.PersistentFlags().StringSliceVar(&authOrder, "auth-order", []string{}, "auth methods to try, in order, from gssapi-with-mic, publickey, key, agent, password and keyboard-interactive, overrides PreferredAuthentications in the ssh config")
+	cmd.PersistentFlags().StringVar(&agentSocket, "agent-socket", "", "ssh-agent socket to use instead of SSH_AUTH_SOCK, such as that of 1Password or gpg-agent, none disables the agent")
+	cmd.PersistentFlags().Uint64Var(&rekeyThreshold, "rekey-threshold", 0, "renegotiate session keys after this many bytes, 0 for the cipher's default")
+	cmd.PersistentFlags().DurationVar(&maxConnectionLifetime, "max-connection-lifetime", 0, "reconnect to hosts, for new session keys, before the next command once their connection is this old, 0 for no limit")
+	cmd.PersistentFlags().BoolVar(&debug, "debug", false, "log connections, rekey settings and reconnects to stderr")
+	cmd.PersistentFlags().BoolVar(&requireAll, "require-all", false, "stop before running anything if a host can't be connected to, instead of reporting it as failed and running on the rest")
+	cmd.PersistentFlags().BoolVar(&showBanners, "show-banners", false, "also print the banners hosts show before login to stderr, they are always included in the results")
+	cmd.PersistentFlags().BoolVar(&forwardAgent, "forward-agent", false, "forward the local ssh-agent so remote commands can use it, only to trusted hosts")
+	cmd.PersistentFlags().BoolVar(&gssapiAuth, "gssapi", false, "authenticate with Kerberos tickets, also enabled per host by GSSAPIAuthentication in the ssh config")
+	cmd.PersistentFlags().StringArrayVar(&kiAnswers, "ki-answers", []string{}, "answers to keyboard-interactive questions, in the order they are asked")
+	cmd.PersistentFlags().StringVar(&passphraseFile, "passphrase-file", "", "file holding the passphrase of encrypted keys, instead of prompting for it")
 	cmd.PersistentFlags().StringVar(&outputFile, "output", "", "output file path")
+	cmd.PersistentFlags().StringVar(&outputFormat, "output-format", "", "format of the results, json, yaml, csv or tsv with a row per host, table, or ndjson for a line of json per host as soon as it is done, defaults to table on a terminal and json otherwise")
 	cmd.PersistentFlags().IntVar(&parallelLimit, "parallel-limit", 0, "limit concurrent command execution to specified limit")
-	cmd.PersistentFlags().DurationVar(&timeout, "timeout", 2*time.Minute, "timeout for ssh command")
+	cmd.PersistentFlags().DurationVar(&connectTimeout, "connect-timeout", defaultConnectTimeout, "how long to wait for the TCP connection to each host")
+	cmd.PersistentFlags().DurationVar(&commandTimeout, "command-timeout", 2*time.Minute, "how long the command may run for, 0 for no limit")
+	cmd.PersistentFlags().DurationVar(&commandTimeout, "timeout", 2*time.Minute, "timeout for ssh command")
+	cmd.PersistentFlags().StringVar(&timeoutOverrides, "timeout-overrides", "", "yaml file mapping host globs, or ~regexes, to the command timeout of the hosts they match, for hosts known to be slow")
+	_ = cmd.PersistentFlags().MarkDeprecated("timeout", "use --command-timeout instead")
+
+	cmd.AddCommand(newHostsCmd(newPlan))
+	cmd.AddCommand(newAgentCmd(newPlan))
+	cmd.AddCommand(newDaemonCmd(newPlan))
+	cmd.AddCommand(newForwardCmd(newPlan))
+	cmd.AddCommand(newSOCKSCmd(newPlan))
+	cmd.AddCommand(newPingCmd(newPlan))
+	cmd.AddCommand(newJobsCmd())
+	cmd.AddCommand(newAttachCmd(newPlan))
+	cmd.AddCommand(newReapCmd(newPlan))
+
+	if err := cmd.Execute(); err != nil {
+		if errors.Is(err, ErrInterrupted) {
+			os.Exit(exitInterrupted)
+		}
+		os.Exit(1)
+	}
+}
+
+// isPiped reports whether f is a pipe or file rather than a terminal.
+func isPiped(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice == 0
 }
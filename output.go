@@ -3,47 +3,169 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 )
 
 type Result struct {
-	Successes []res `json:"successes"`
-	Failures  []res `json:"failures"`
+	Successes []res `json:"successes" yaml:"successes"`
+	Failures  []res `json:"failures" yaml:"failures"`
+	// Skipped are the hosts the command wasn't started on
+	Skipped []res `json:"skipped,omitempty" yaml:"skipped,omitempty"`
 
 	mu sync.Mutex
+	// added is called with each host as it is added if set, addedErr is the
+	// first error it returned
+	added    func(status string, r res) error
+	addedErr error
 }
 
 type res struct {
-	Error     string `json:"error,omitempty"`
-	Host      string `json:"host,omitempty"`
-	StartTime string `json:"start_time,omitempty"`
-	EndTime   string `json:"end_time,omitempty"`
-	TimeTaken string `json:"time_taken,omitempty"`
-	Output    string `json:"output,omitempty"`
+	Error     string `json:"error,omitempty" yaml:"error,omitempty"`
+	Host      string `json:"host,omitempty" yaml:"host,omitempty"`
+	StartTime string `json:"start_time,omitempty" yaml:"start_time,omitempty"`
+	EndTime   string `json:"end_time,omitempty" yaml:"end_time,omitempty"`
+	TimeTaken string `json:"time_taken,omitempty" yaml:"time_taken,omitempty"`
+	// DurationMS is TimeTaken in milliseconds, from the start of the run on
+	// the host to its end. ExecMS is how much of it running the commands
+	// took, after gathering facts for When
+	DurationMS int64 `json:"duration_ms" yaml:"duration_ms"`
+	ExecMS     int64 `json:"exec_ms" yaml:"exec_ms"`
+	// DialMS and AuthMS split LatencyMS into opening the connection, and the
+	// ssh handshake and authentication over it
+	DialMS int64  `json:"dial_ms,omitempty" yaml:"dial_ms,omitempty"`
+	AuthMS int64  `json:"auth_ms,omitempty" yaml:"auth_ms,omitempty"`
+	Output string `json:"output,omitempty" yaml:"output,omitempty"`
+	// Stderr is what the commands wrote to stderr, Output has their stdout
+	Stderr string `json:"stderr,omitempty" yaml:"stderr,omitempty"`
+	// ExitCode is what the command exited with, unset if it didn't exit
+	ExitCode *int `json:"exit_code,omitempty" yaml:"exit_code,omitempty"`
+	// AuthMethod is the auth method the host accepted
+	AuthMethod string `json:"auth_method,omitempty" yaml:"auth_method,omitempty"`
+	// Retries is how many times connecting to the host was retried
+	Retries int `json:"retries,omitempty" yaml:"retries,omitempty"`
+	// Attempts is how many times the command was run, when failed commands
+	// are retried
+	Attempts int `json:"attempts,omitempty" yaml:"attempts,omitempty"`
+	// LatencyMS is how long connecting to and authenticating with the host
+	// took, in milliseconds
+	LatencyMS int64 `json:"latency_ms,omitempty" yaml:"latency_ms,omitempty"`
+	// Banner is what the host showed before authenticating
+	Banner string `json:"banner,omitempty" yaml:"banner,omitempty"`
+	// Facts are those gathered from the host to check the when condition
+	Facts map[string]string `json:"facts,omitempty" yaml:"facts,omitempty"`
+	// Warnings are problems that didn't stop the command, such as an
+	// unverified host key
+	Warnings []string `json:"warnings,omitempty" yaml:"warnings,omitempty"`
+
+	Groups []string          `json:"groups,omitempty" yaml:"groups,omitempty"`
+	Tags   []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	Vars   map[string]string `json:"vars,omitempty" yaml:"vars,omitempty"`
 }
 
-func (r *Result) AddResult(start, end time.Time, host string, output []byte, err error) {
+func (r *Result) AddResult(start, end time.Time, h *Host, output []byte, err error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	result := res{
-		Host:      host,
-		StartTime: start.Format(time.RFC3339),
-		EndTime:   end.Format(time.RFC3339),
-		TimeTaken: fmt.Sprintf("%fs", start.Sub(end).Seconds()),
-		Output:    string(output),
+		Host:       h.name,
+		StartTime:  start.Format(time.RFC3339),
+		EndTime:    end.Format(time.RFC3339),
+		TimeTaken:  fmt.Sprintf("%fs", end.Sub(start).Seconds()),
+		DurationMS: end.Sub(start).Milliseconds(),
+		ExecMS:     h.execTime.Milliseconds(),
+		Output:     string(output),
+		Stderr:     string(h.stderr),
+		ExitCode:   exitCode(err),
+		AuthMethod: h.authMethod,
+		Retries:    h.retries,
+		Attempts:   h.attempts,
+		LatencyMS:  h.latency.Milliseconds(),
+		Banner:     h.banner,
+		Facts:      h.facts,
+		Warnings:   h.warnings,
+		Groups:     h.groups,
+		Tags:       h.tags,
+		Vars:       resultVars(h.vars),
+	}
+	if h.latency > 0 {
+		result.DialMS = h.dialTime.Milliseconds()
+		result.AuthMS = (h.latency - h.dialTime).Milliseconds()
 	}
 
 	if err != nil {
 		result.Error = err.Error()
 		r.Failures = append(r.Failures, result)
+		r.notify(statusFailure, result)
 		return
 	}
 
 	r.Successes = append(r.Successes, result)
+	r.notify(statusSuccess, result)
+}
+
+// AddSkipped records that the command wasn't started on h, for reason.
+func (r *Result) AddSkipped(h *Host, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := res{
+		Host:   h.name,
+		Error:  reason,
+		Facts:  h.facts,
+		Groups: h.groups,
+		Tags:   h.tags,
+		Vars:   resultVars(h.vars),
+	}
+	r.Skipped = append(r.Skipped, result)
+	r.notify(statusSkipped, result)
+}
+
+// notify passes a host that was just added to added, with r.mu held.
+func (r *Result) notify(status string, result res) {
+	if r.added == nil {
+		return
+	}
+	if err := r.added(status, result); err != nil && r.addedErr == nil {
+		r.addedErr = err
+	}
 }
 
 func (r *Result) MarshalJSON() ([]byte, error) {
-	return json.Marshal(r)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// marshal through a type without this method to avoid recursing
+	type result struct {
+		Successes []res `json:"successes"`
+		Failures  []res `json:"failures"`
+		Skipped   []res `json:"skipped,omitempty"`
+	}
+	return json.Marshal(result{Successes: r.Successes, Failures: r.Failures, Skipped: r.Skipped})
+}
+
+func (r *Result) MarshalYAML() (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type result struct {
+		Successes []res `yaml:"successes"`
+		Failures  []res `yaml:"failures"`
+		Skipped   []res `yaml:"skipped,omitempty"`
+	}
+	return result{Successes: r.Successes, Failures: r.Failures, Skipped: r.Skipped}, nil
+}
+
+// resultVars returns the host vars worth reporting. Ansible and xsh
+// connection variables are left out, they describe how to connect rather than
+// the host and may hold passwords.
+func resultVars(vars map[string]string) map[string]string {
+	out := make(map[string]string, len(vars))
+	for k, v := range vars {
+		if !strings.HasPrefix(k, "ansible_") && !strings.HasPrefix(k, "xsh_") {
+			out[k] = v
+		}
+	}
+	return out
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// passwordAttempts is how many times a rejected password is asked for again
+// with --ask-pass.
+const passwordAttempts = 3
+
+// passwordAuth returns an auth method sending the password set for h in the
+// inventory or else the plan's password, or nil if password authentication is
+// not enabled.
+// With AskPass the password is prompted for on first use and reused for every
+// host, a host rejecting it prompts again and the new password is kept.
+func (p *Plan) passwordAuth(h *Host) ssh.AuthMethod {
+	if h.password != "" {
+		return passwordMethod(h, h.password)
+	}
+	if p.Password == "" && !p.AskPass {
+		return nil
+	}
+	if !p.AskPass {
+		return passwordMethod(h, p.Password)
+	}
+
+	attempt := 0
+	return ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+		h.authMethod = authPassword
+		attempt++
+
+		p.passwordMu.Lock()
+		defer p.passwordMu.Unlock()
+
+		if p.askedPassword == nil && p.Password != "" && attempt == 1 {
+			return p.Password, nil
+		}
+		if p.askedPassword == nil || attempt > 1 {
+			pw, err := readPassword(fmt.Sprintf("%s@%s's password: ", h.user, h.hostname()))
+			if err != nil {
+				return "", err
+			}
+			wipe(p.askedPassword)
+			p.askedPassword = []byte(pw)
+		}
+		return string(p.askedPassword), nil
+	}), passwordAttempts)
+}
+
+func passwordMethod(h *Host, password string) ssh.AuthMethod {
+	return ssh.PasswordCallback(func() (string, error) {
+		h.authMethod = authPassword
+		return password, nil
+	})
+}
+
+// password returns the plan's password, the last one prompted for or else
+// the given one.
+func (p *Plan) password() string {
+	p.passwordMu.Lock()
+	defer p.passwordMu.Unlock()
+
+	if p.askedPassword != nil {
+		return string(p.askedPassword)
+	}
+	return p.Password
+}
+
+// readPassword prompts on the terminal and reads a line without echoing it.
+func readPassword(prompt string) (string, error) {
+	return readTerminal(prompt, false)
+}
+
+// printTerminal writes s to the terminal.
+func printTerminal(s string) error {
+	in, out, err := openTerminal()
+	if err != nil {
+		return fmt.Errorf("failed to open terminal for prompt: %v", err)
+	}
+	defer closeTerminal(in, out)
+
+	_, err = fmt.Fprint(out, s)
+	return err
+}
+
+// readTerminal prompts on the terminal and reads a line, echoing it if echo
+// is set. The terminal is used directly as stdin may carry the host list.
+func readTerminal(prompt string, echo bool) (string, error) {
+	in, out, err := openTerminal()
+	if err != nil {
+		return "", fmt.Errorf("failed to open terminal for prompt: %v", err)
+	}
+	defer closeTerminal(in, out)
+
+	fmt.Fprint(out, prompt)
+	if echo {
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("failed to read answer: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	b, err := term.ReadPassword(int(in.Fd()))
+	fmt.Fprintln(out)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+	return string(b), nil
+}
+
+func closeTerminal(in, out *os.File) {
+	in.Close()
+	if out != in {
+		out.Close()
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+// Outcomes of pinging a host.
+const (
+	pingReachable    = "reachable"
+	pingAuthRequired = "auth-required"
+	pingUnreachable  = "unreachable"
+)
+
+// maxBannerLines bounds the lines a server may send before its version.
+const maxBannerLines = 64
+
+// PingResult is the outcome of pinging one host.
+type PingResult struct {
+	Host string
+	// Status is reachable if the host let us log in, auth-required if it
+	// answered but turned down our credentials, or unreachable
+	Status string
+	// Version is the ssh version the server announced
+	Version string
+	// Time is how long the server took to announce its version
+	Time  time.Duration
+	Error string
+}
+
+// PingReport is the outcome of pinging a plan's hosts.
+type PingReport struct {
+	Results []PingResult
+}
+
+// OK reports whether every host could be logged in to.
+func (r *PingReport) OK() bool {
+	for _, res := range r.Results {
+		if res.Status != pingReachable {
+			return false
+		}
+	}
+	return true
+}
+
+// Ping checks every host in parallel, without running anything on them: it
+// connects, reads the server's version and then tries to log in.
+func (p *Plan) Ping(ctx context.Context) (*PingReport, error) {
+	if err := p.checkOptions(); err != nil {
+		return nil, err
+	}
+
+	password, err := p.resolveSecret(p.Password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve password: %v", err)
+	}
+	p.Password = password
+
+	if err := p.ResolveHosts(); err != nil {
+		return nil, err
+	}
+	if err := p.setupCredentials(); err != nil {
+		return nil, err
+	}
+	defer p.closeJumps()
+
+	report := &PingReport{Results: make([]PingResult, len(p.hosts))}
+	errg, ctx := errgroup.WithContext(ctx)
+	errg.SetLimit(p.connectParallelism())
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		errg.Go(func() error {
+			report.Results[i] = p.ping(ctx, h)
+			return nil
+		})
+	}
+	_ = errg.Wait()
+
+	return report, nil
+}
+
+func (p *Plan) ping(ctx context.Context, h *Host) PingResult {
+	res := PingResult{Host: h.name, Status: pingUnreachable}
+	fail := func(err error) PingResult {
+		res.Error = err.Error()
+		return res
+	}
+
+	cfg, err := p.clientConfig(h)
+	if err != nil {
+		return fail(err)
+	}
+	// a ping only shows whether we get in, not what the server greets us with
+	cfg.BannerCallback = func(string) error { return nil }
+	if err := p.pushInstanceConnectKey(h); err != nil {
+		return fail(fmt.Errorf("failed to push EC2 Instance Connect key: %v", err))
+	}
+
+	start := time.Now()
+	conn, err := p.dialConn(h)
+	if err != nil {
+		return fail(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(p.connectTimeout()))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	version, read, err := readServerVersion(conn)
+	if err != nil {
+		return fail(fmt.Errorf("failed to read ssh version: %v", err))
+	}
+	res.Version = version
+	res.Time = time.Since(start)
+
+	// the handshake reads the version again
+	replay := &bufferedConn{Conn: conn, r: bufio.NewReader(io.MultiReader(bytes.NewReader(read), conn))}
+	c, chans, reqs, err := ssh.NewClientConn(replay, h.host, cfg)
+	if err != nil {
+		var hostKeyErr *hostKeyError
+		if !errors.As(err, &hostKeyErr) && strings.Contains(err.Error(), "unable to authenticate") {
+			res.Status = pingAuthRequired
+		}
+		return fail(err)
+	}
+	_ = ssh.NewClient(c, chans, reqs).Close()
+
+	res.Status = pingReachable
+	return res
+}
+
+// readServerVersion reads up to the line a server announces its ssh version
+// on, which may follow other lines. It returns the version and everything
+// read.
+func readServerVersion(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	r := bufio.NewReader(io.TeeReader(conn, &read))
+	for i := 0; i < maxBannerLines; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return "", nil, err
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			// the handshake must see what the reader buffered past the line too
+			return strings.TrimRight(line, "\r\n"), read.Bytes(), nil
+		}
+	}
+	return "", nil, fmt.Errorf("no ssh version in the first %d lines", maxBannerLines)
+}
+
+// Print writes the report in a human readable form.
+func (r *PingReport) Print(w io.Writer) {
+	for _, res := range r.Results {
+		detail := res.Version
+		if res.Error != "" {
+			detail = res.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", res.Host, res.Status, res.Time.Round(time.Millisecond), detail)
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+const ppkHeaderPrefix = "PuTTY-User-Key-File-"
+
+// ppkKey is a PuTTY private key file, in format version 2 or 3.
+type ppkKey struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+
+	// argon2 parameters of encrypted version 3 keys
+	kdf         string
+	memory      uint32
+	passes      uint32
+	parallelism uint32
+	salt        []byte
+}
+
+func isPPK(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte(ppkHeaderPrefix))
+}
+
+// parsePPK reads the fields of a PuTTY key file, leaving the private part
+// as it is stored.
+func parsePPK(b []byte) (*ppkKey, error) {
+	k := &ppkKey{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+
+	// readLines decodes the n base64 lines following a *-Lines header
+	readLines := func(n string) ([]byte, error) {
+		count, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid line count %s", n)
+		}
+
+		var data strings.Builder
+		for i := 0; i < count; i++ {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("unexpected end of file")
+			}
+			data.WriteString(strings.TrimSpace(scanner.Text()))
+		}
+		return base64.StdEncoding.DecodeString(data.String())
+	}
+
+	for scanner.Scan() {
+		// values such as the comment are covered by the MAC, so only the line
+		// ending is trimmed, an empty comment is written as "Comment: "
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid line: %s", line)
+		}
+		value = strings.TrimPrefix(value, " ")
+
+		var err error
+		switch key {
+		case "Encryption":
+			k.encryption = value
+		case "Comment":
+			k.comment = value
+		case "Public-Lines":
+			k.public, err = readLines(value)
+		case "Private-Lines":
+			k.private, err = readLines(value)
+		case "Private-MAC":
+			k.mac, err = hex.DecodeString(value)
+		case "Key-Derivation":
+			k.kdf = value
+		case "Argon2-Memory":
+			k.memory, err = parseUint32(value)
+		case "Argon2-Passes":
+			k.passes, err = parseUint32(value)
+		case "Argon2-Parallelism":
+			k.parallelism, err = parseUint32(value)
+		case "Argon2-Salt":
+			k.salt, err = hex.DecodeString(value)
+		default:
+			version, found := strings.CutPrefix(key, ppkHeaderPrefix)
+			if !found {
+				continue
+			}
+			k.version, err = strconv.Atoi(version)
+			k.algorithm = value
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if k.version != 2 && k.version != 3 {
+		return nil, fmt.Errorf("unsupported PuTTY key format version %d", k.version)
+	}
+	if k.encryption != "none" && k.encryption != "aes256-cbc" {
+		return nil, fmt.Errorf("unsupported PuTTY key encryption %s", k.encryption)
+	}
+	return k, nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err
+}
+
+func (k *ppkKey) encrypted() bool {
+	return k.encryption != "none"
+}
+
+// publicKey returns the public half, which PuTTY stores unencrypted.
+func (k *ppkKey) publicKey() (ssh.PublicKey, error) {
+	return ssh.ParsePublicKey(k.public)
+}
+
+// signer decrypts the private part with passphrase, checks its MAC and
+// returns a signer for the key.
+func (k *ppkKey) signer(passphrase []byte) (ssh.Signer, error) {
+	var cipherKey, iv, macKey []byte
+	var newHash func() hash.Hash
+
+	switch k.version {
+	case 2:
+		newHash = sha1.New
+		h := sha1.Sum(append([]byte("putty-private-key-file-mac-key"), passphrase...))
+		macKey = h[:]
+		if k.encrypted() {
+			a := sha1.Sum(append([]byte{0, 0, 0, 0}, passphrase...))
+			b := sha1.Sum(append([]byte{0, 0, 0, 1}, passphrase...))
+			cipherKey = append(a[:], b[:]...)[:32]
+			iv = make([]byte, aes.BlockSize)
+		}
+	case 3:
+		newHash = sha256.New
+		if k.encrypted() {
+			var out []byte
+			switch k.kdf {
+			case "Argon2id":
+				out = argon2.IDKey(passphrase, k.salt, k.passes, k.memory, uint8(k.parallelism), 80)
+			case "Argon2i":
+				out = argon2.Key(passphrase, k.salt, k.passes, k.memory, uint8(k.parallelism), 80)
+			default:
+				return nil, fmt.Errorf("unsupported PuTTY key derivation %s", k.kdf)
+			}
+			cipherKey, iv, macKey = out[:32], out[32:48], out[48:]
+		}
+	}
+
+	private := k.private
+	if k.encrypted() {
+		if len(private)%aes.BlockSize != 0 {
+			return nil, fmt.Errorf("invalid PuTTY key: private part is not a whole number of blocks")
+		}
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			return nil, err
+		}
+		private = make([]byte, len(k.private))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(private, k.private)
+	}
+
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(k.algorithm), []byte(k.encryption), []byte(k.comment), k.public, private} {
+		_ = binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+	if !hmac.Equal(mac.Sum(nil), k.mac) {
+		if k.encrypted() {
+			return nil, x509.IncorrectPasswordError
+		}
+		return nil, fmt.Errorf("invalid PuTTY key: MAC mismatch")
+	}
+
+	key, err := k.privateKey(private)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PuTTY key: %v", err)
+	}
+	return ssh.NewSignerFromKey(key)
+}
+
+// privateKey builds the crypto key from the decrypted private part and the
+// public part.
+func (k *ppkKey) privateKey(private []byte) (any, error) {
+	pub, err := k.publicKey()
+	if err != nil {
+		return nil, err
+	}
+	cryptoPub, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %s", k.algorithm)
+	}
+
+	r := &sshWireReader{b: private}
+	switch pub := cryptoPub.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		d, p, q := r.mpint(), r.mpint(), r.mpint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		key := &rsa.PrivateKey{PublicKey: *pub, D: d, Primes: []*big.Int{p, q}}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		return key, nil
+	case *ecdsa.PublicKey:
+		d := r.mpint()
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &ecdsa.PrivateKey{PublicKey: *pub, D: d}, nil
+	case ed25519.PublicKey:
+		// PuTTY writes the seed as a little endian number without its high
+		// zero bytes, so it can be shorter than SeedSize
+		seed := r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if len(seed) > ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid ed25519 key length %d", len(seed))
+		}
+		padded := make([]byte, ed25519.SeedSize)
+		copy(padded, seed)
+		key := ed25519.NewKeyFromSeed(padded)
+		if !pub.Equal(key.Public()) {
+			return nil, fmt.Errorf("ed25519 private key doesn't match the public key")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", k.algorithm)
+	}
+}
+
+// sshWireReader reads the string and mpint encodings of RFC 4251, keeping
+// the first error.
+type sshWireReader struct {
+	b   []byte
+	err error
+}
+
+func (r *sshWireReader) string() []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < 4 {
+		r.err = errors.New("truncated data")
+		return nil
+	}
+
+	n := binary.BigEndian.Uint32(r.b)
+	if uint64(len(r.b)-4) < uint64(n) {
+		r.err = errors.New("truncated data")
+		return nil
+	}
+	s := r.b[4 : 4+n]
+	r.b = r.b[4+n:]
+	return s
+}
+
+func (r *sshWireReader) mpint() *big.Int {
+	return new(big.Int).SetBytes(r.string())
+}
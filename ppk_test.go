@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// encodePPK writes key as a PuTTY key file of the given version, following
+// the format PuTTY documents, encrypted if passphrase isn't empty.
+func encodePPK(t *testing.T, version int, key any, comment, passphrase string) []byte {
+	t.Helper()
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := signer.PublicKey().Marshal()
+
+	var private []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		private = ssh.Marshal(struct{ D, P, Q, Iqmp *big.Int }{k.D, k.Primes[0], k.Primes[1], k.Precomputed.Qinv})
+	case *ecdsa.PrivateKey:
+		private = ssh.Marshal(struct{ D *big.Int }{k.D})
+	case ed25519.PrivateKey:
+		// like PuTTY's put_mp_le_unsigned, without the high zero bytes
+		private = ssh.Marshal(struct{ Seed []byte }{bytes.TrimRight(k.Seed(), "\x00")})
+	}
+
+	algorithm, encryption := signer.PublicKey().Type(), "none"
+	var kdf string
+	var cipherKey, iv, macKey []byte
+	var newHash func() hash.Hash
+	salt := bytes.Repeat([]byte{7}, 16)
+	switch version {
+	case 2:
+		newHash = sha1.New
+		h := sha1.Sum([]byte("putty-private-key-file-mac-key" + passphrase))
+		macKey = h[:]
+		if passphrase != "" {
+			a := sha1.Sum([]byte("\x00\x00\x00\x00" + passphrase))
+			b := sha1.Sum([]byte("\x00\x00\x00\x01" + passphrase))
+			cipherKey, iv = append(a[:], b[:12]...), make([]byte, aes.BlockSize)
+		}
+	case 3:
+		newHash = sha256.New
+		if passphrase != "" {
+			out := argon2.IDKey([]byte(passphrase), salt, 1, 64, 1, 80)
+			cipherKey, iv, macKey = out[:32], out[32:48], out[48:]
+			kdf = "Key-Derivation: Argon2id\nArgon2-Memory: 64\nArgon2-Passes: 1\nArgon2-Parallelism: 1\nArgon2-Salt: " + hex.EncodeToString(salt) + "\n"
+		}
+	}
+	if passphrase != "" {
+		encryption = "aes256-cbc"
+		private = append(private, make([]byte, aes.BlockSize-len(private)%aes.BlockSize)...)
+	}
+
+	mac := hmac.New(newHash, macKey)
+	for _, field := range [][]byte{[]byte(algorithm), []byte(encryption), []byte(comment), public, private} {
+		_ = binary.Write(mac, binary.BigEndian, uint32(len(field)))
+		mac.Write(field)
+	}
+
+	if passphrase != "" {
+		block, err := aes.NewCipher(cipherKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(private, private)
+	}
+
+	lines := func(b []byte) string {
+		s := base64.StdEncoding.EncodeToString(b)
+		var out []string
+		for len(s) > 64 {
+			out = append(out, s[:64])
+			s = s[64:]
+		}
+		out = append(out, s)
+		return fmt.Sprintf("%d\n%s\n", len(out), strings.Join(out, "\n"))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%d: %s\n", ppkHeaderPrefix, version, algorithm)
+	fmt.Fprintf(&b, "Encryption: %s\nComment: %s\n", encryption, comment)
+	b.WriteString("Public-Lines: " + lines(public))
+	b.WriteString(kdf)
+	b.WriteString("Private-Lines: " + lines(private))
+	fmt.Fprintf(&b, "Private-MAC: %x\n", mac.Sum(nil))
+	return []byte(b.String())
+}
+
+func TestPPKSigner(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		version    int
+		key        any
+		passphrase string
+		// try is the passphrase the key is decrypted with
+		try     string
+		wantErr error
+	}{
+		{name: "v2 rsa", version: 2, key: rsaKey},
+		{name: "v2 ecdsa", version: 2, key: ecdsaKey},
+		{name: "v2 ed25519", version: 2, key: ed25519Key},
+		{name: "v2 encrypted", version: 2, key: ed25519Key, passphrase: "hunter2", try: "hunter2"},
+		{name: "v2 wrong passphrase", version: 2, key: rsaKey, passphrase: "hunter2", try: "hunter3", wantErr: x509.IncorrectPasswordError},
+		{name: "v3 rsa", version: 3, key: rsaKey},
+		{name: "v3 ecdsa", version: 3, key: ecdsaKey},
+		{name: "v3 ed25519", version: 3, key: ed25519Key},
+		{name: "v3 encrypted", version: 3, key: ecdsaKey, passphrase: "hunter2", try: "hunter2"},
+		{name: "v3 wrong passphrase", version: 3, key: ed25519Key, passphrase: "hunter2", try: "", wantErr: x509.IncorrectPasswordError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := encodePPK(t, tt.version, tt.key, "test key", tt.passphrase)
+			if !isPPK(b) {
+				t.Fatal("isPPK() = false")
+			}
+			k, err := parsePPK(b)
+			if err != nil {
+				t.Fatalf("parsePPK() = %v", err)
+			}
+			if k.encrypted() != (tt.passphrase != "") || k.comment != "test key" {
+				t.Errorf("parsePPK() encrypted %t comment %q", k.encrypted(), k.comment)
+			}
+
+			signer, err := k.signer([]byte(tt.try))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("signer() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			want, err := ssh.NewSignerFromKey(tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), want.PublicKey().Marshal()) {
+				t.Fatal("signer() returned a different key")
+			}
+			sig, err := signer.Sign(rand.Reader, []byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := want.PublicKey().Verify([]byte("data"), sig); err != nil {
+				t.Errorf("signature doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestPPKFiles(t *testing.T) {
+	tests := []struct {
+		file       string
+		version    int
+		passphrase string
+	}{
+		{file: "v2-rsa-encrypted.ppk", version: 2, passphrase: "testkey"},
+		{file: "v2-ecdsa-encrypted.ppk", version: 2, passphrase: "testkey"},
+		{file: "v2-ed25519-encrypted.ppk", version: 2, passphrase: "testkey"},
+		{file: "v3-rsa.ppk", version: 3},
+		{file: "v3-rsa-encrypted.ppk", version: 3, passphrase: "testkey"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join("testdata", "ppk", tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			k, err := parsePPK(b)
+			if err != nil {
+				t.Fatalf("parsePPK() = %v", err)
+			}
+			if k.version != tt.version || k.encrypted() != (tt.passphrase != "") || k.comment != "a@b" {
+				t.Errorf("parsePPK() version %d encrypted %t comment %q", k.version, k.encrypted(), k.comment)
+			}
+
+			if tt.passphrase != "" {
+				if _, err := k.signer([]byte("wrong")); !errors.Is(err, x509.IncorrectPasswordError) {
+					t.Errorf("signer() with a wrong passphrase = %v, want IncorrectPasswordError", err)
+				}
+			}
+			signer, err := k.signer([]byte(tt.passphrase))
+			if err != nil {
+				t.Fatalf("signer() = %v", err)
+			}
+			public, err := k.publicKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sig, err := signer.Sign(rand.Reader, []byte("data"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := public.Verify([]byte("data"), sig); err != nil {
+				t.Errorf("signature doesn't verify with the public key in the file: %v", err)
+			}
+		})
+	}
+}
+
+func TestPPKEd25519(t *testing.T) {
+	// seeds ending in zero bytes are written shorter by PuTTY
+	seed := bytes.Repeat([]byte{0x5a}, ed25519.SeedSize)
+	seed[31], seed[30] = 0, 0
+	key := ed25519.NewKeyFromSeed(seed)
+
+	for _, comment := range []string{"", "test key"} {
+		b := encodePPK(t, 3, key, comment, "")
+		k, err := parsePPK(b)
+		if err != nil {
+			t.Errorf("parsePPK() with comment %q = %v", comment, err)
+			continue
+		}
+		if k.comment != comment {
+			t.Errorf("parsePPK() comment = %q, want %q", k.comment, comment)
+		}
+		signer, err := k.signer(nil)
+		if err != nil {
+			t.Errorf("signer() with comment %q = %v", comment, err)
+			continue
+		}
+		if !bytes.Equal(signer.PublicKey().Marshal(), mustSSHPublicKey(t, key.Public()).Marshal()) {
+			t.Error("signer() returned a different key")
+		}
+	}
+}
+
+func mustSSHPublicKey(t *testing.T, key any) ssh.PublicKey {
+	t.Helper()
+	pub, err := ssh.NewPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub
+}
+
+func TestPPKTampered(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := bytes.Replace(encodePPK(t, 3, key, "test key", ""), []byte("Comment: test key"), []byte("Comment: other key"), 1)
+	k, err := parsePPK(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.signer(nil); err == nil || errors.Is(err, x509.IncorrectPasswordError) {
+		t.Errorf("signer() of a tampered key = %v, want a MAC mismatch", err)
+	}
+}
+
+func TestParsePPKErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{name: "version 1", data: "PuTTY-User-Key-File-1: ssh-rsa\nEncryption: none\n"},
+		{name: "unknown encryption", data: "PuTTY-User-Key-File-3: ssh-rsa\nEncryption: des\n"},
+		{name: "line without a colon", data: "PuTTY-User-Key-File-3: ssh-rsa\nEncryption none\n"},
+		{name: "bad line count", data: "PuTTY-User-Key-File-3: ssh-rsa\nPublic-Lines: x\n"},
+		{name: "missing lines", data: "PuTTY-User-Key-File-3: ssh-rsa\nPublic-Lines: 2\nAAAA\n"},
+		{name: "bad base64", data: "PuTTY-User-Key-File-3: ssh-rsa\nPublic-Lines: 1\n!!!!\n"},
+		{name: "bad mac", data: "PuTTY-User-Key-File-3: ssh-rsa\nPrivate-MAC: xyz\n"},
+		{name: "bad argon2 memory", data: "PuTTY-User-Key-File-3: ssh-rsa\nArgon2-Memory: -1\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parsePPK([]byte(tt.data)); err == nil {
+				t.Error("parsePPK() succeeded, want error")
+			}
+		})
+	}
+}
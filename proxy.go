@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyNone as the proxy of a host connects to it directly.
+const proxyNone = "none"
+
+// parseProxyURL checks a socks5, socks5h, http or https proxy URL.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %v", raw, err)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h", "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid proxy %s, must be a socks5://, socks5h://, http:// or https:// URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy %s, missing host", raw)
+	}
+	return u, nil
+}
+
+// proxyFor returns the proxy to reach h through, the one set for it in the
+// inventory or else Proxy, or "" to connect directly.
+func (p *Plan) proxyFor(h *Host) string {
+	switch h.proxy {
+	case "":
+		return p.Proxy
+	case proxyNone:
+		return ""
+	default:
+		return h.proxy
+	}
+}
+
+// dialTCP opens a TCP connection to addr, through the proxy of h if it has
+// one.
+func (p *Plan) dialTCP(h *Host, addr string) (net.Conn, error) {
+	raw := p.proxyFor(h)
+	if raw == "" {
+		return p.dialDirect(addr)
+	}
+
+	u, err := parseProxyURL(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.connectTimeout())
+	defer cancel()
+	conn, err := dialProxy(ctx, p.dialer(), u, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect through proxy %s: %w", u.Redacted(), err)
+	}
+	return conn, nil
+}
+
+func dialProxy(ctx context.Context, forward Dialer, u *url.URL, addr string) (net.Conn, error) {
+	if u.Scheme == "socks5" || u.Scheme == "socks5h" {
+		d, err := proxy.FromURL(u, proxyDialer{forward})
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	}
+
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	tunnel, err := httpConnect(conn, u, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// proxyDialer adapts a Dialer to the proxy package, which also wants Dial.
+type proxyDialer struct {
+	Dialer
+}
+
+func (d proxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// httpConnect asks an HTTP proxy to tunnel conn to addr.
+func httpConnect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proxy response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("proxy returned %s", resp.Status)
+	}
+
+	// the server's banner may already be buffered behind the response
+	return &bufferedConn{Conn: conn, r: r}, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
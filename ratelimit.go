@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// connectLimiter spaces out connection attempts so they don't exceed a rate.
+type connectLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait blocks until another connection may be attempted under rate per
+// second, rate 0 being unlimited.
+func (l *connectLimiter) wait(rate float64) {
+	if rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	at := l.next
+	if at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(time.Duration(float64(time.Second) / rate))
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(at))
+}
+
+func checkConnectRate(rate float64) error {
+	if rate < 0 {
+		return fmt.Errorf("invalid max connects per second %v, must not be negative", rate)
+	}
+	return nil
+}
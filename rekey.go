@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// debugf writes a debug message to stderr if Debug is set.
+func (p *Plan) debugf(format string, args ...any) {
+	if p.Debug {
+		fmt.Fprintf(os.Stderr, "debug: "+format+"\n", args...)
+	}
+}
+
+func checkLifetime(lifetime time.Duration) error {
+	if lifetime < 0 {
+		return fmt.Errorf("invalid max connection lifetime %v, must not be negative", lifetime)
+	}
+	return nil
+}
+
+// rekeyPolicy describes when connections renegotiate their session keys.
+func (p *Plan) rekeyPolicy() string {
+	policy := "rekeying at the cipher's default threshold"
+	if p.RekeyThreshold > 0 {
+		policy = fmt.Sprintf("rekeying every %d bytes", p.RekeyThreshold)
+	}
+	if p.MaxConnectionLifetime > 0 {
+		policy += fmt.Sprintf(" and reconnecting after %v", p.MaxConnectionLifetime)
+	}
+	return policy
+}
+
+// connectionExpired reports whether the connection to h is older than
+// MaxConnectionLifetime and is to be replaced before its next session.
+func (p *Plan) connectionExpired(h *Host) bool {
+	return p.MaxConnectionLifetime > 0 && h.daemon == "" && time.Since(h.connectedAt) >= p.MaxConnectionLifetime
+}
+
+// renewConnection replaces the connection to h with a new one, and so new
+// session keys, once it has been open for MaxConnectionLifetime.
+func (p *Plan) renewConnection(h *Host) error {
+	p.debugf("connection to %s is %v old, reconnecting for new session keys", h.name, time.Since(h.connectedAt).Round(time.Second))
+	if h.session != nil {
+		_ = h.session.Close()
+		h.session = nil
+	}
+	if err := p.redial(h); err != nil {
+		return fmt.Errorf("failed to renew connection: %v", err)
+	}
+	p.debugf("reconnected to %s, %s", h.name, p.rekeyPolicy())
+	return nil
+}
+
+// daemonSession opens a session on h for a daemon request, first renewing
+// the connection if it expired and no other request is running on it.
+func (p *Plan) daemonSession(h *Host) (*ssh.Session, error) {
+	p.daemonMu.Lock()
+	defer p.daemonMu.Unlock()
+
+	if p.connectionExpired(h) && p.daemonActive[h] == 0 {
+		if err := p.renewConnection(h); err != nil {
+			return nil, err
+		}
+	}
+	session, err := p.newSession(h)
+	if err != nil {
+		return nil, err
+	}
+	if p.daemonActive == nil {
+		p.daemonActive = map[*Host]int{}
+	}
+	p.daemonActive[h]++
+	return session, nil
+}
+
+// daemonSessionDone records that a session daemonSession opened on h ended.
+func (p *Plan) daemonSessionDone(h *Host) {
+	p.daemonMu.Lock()
+	defer p.daemonMu.Unlock()
+	p.daemonActive[h]--
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryOptions control how failed connections to hosts, or failed commands,
+// are retried.
+type RetryOptions struct {
+	// Retries is how many times a failed connection or command is retried
+	Retries int
+	// Backoff is the wait before the first retry, doubled after each one
+	Backoff time.Duration
+	// MaxBackoff caps the wait between retries
+	MaxBackoff time.Duration
+	// Jitter waits a random time between half and all of each backoff, so
+	// hosts that failed together don't retry together
+	Jitter bool
+}
+
+func (o RetryOptions) validate() error {
+	if o.Retries < 0 {
+		return fmt.Errorf("invalid retries %d, must not be negative", o.Retries)
+	}
+	if o.Backoff < 0 || o.MaxBackoff < 0 {
+		return fmt.Errorf("invalid retry backoff, must not be negative")
+	}
+	return nil
+}
+
+// delay returns the wait before retry n, counting from 0.
+func (o RetryOptions) delay(n int) time.Duration {
+	d := o.Backoff
+	for i := 0; i < n && (o.MaxBackoff == 0 || d < o.MaxBackoff); i++ {
+		d *= 2
+	}
+	if o.MaxBackoff > 0 {
+		d = min(d, o.MaxBackoff)
+	}
+	if o.Jitter && d > 1 {
+		d = d/2 + rand.N(d/2)
+	}
+	return d
+}
+
+// dialRetry dials h, retrying transient failures such as refused or reset
+// connections while the host reboots. Auth and host key failures are not
+// retried, they won't go away by themselves.
+func (p *Plan) dialRetry(h *Host, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	for {
+		p.connectLimiter.wait(p.MaxConnectsPerSecond)
+		start := time.Now()
+		h.banner = ""
+		c, err := p.dial(h, cfg)
+		if err == nil {
+			h.latency = time.Since(start)
+			return c, nil
+		}
+		if h.retries >= p.ConnectRetry.Retries || !isTransient(err) {
+			return nil, err
+		}
+
+		time.Sleep(p.ConnectRetry.delay(h.retries))
+		h.retries++
+	}
+}
+
+// runRetry runs the plan's commands on h, running them again after
+// CommandRetry's backoff while they fail, up to its retries. Hosts that
+// couldn't be connected to aren't retried.
+func (p *Plan) runRetry(ctx context.Context, h *Host) ([]byte, error) {
+	return p.retry(ctx, h, func() ([]byte, error) { return p.run(ctx, h) })
+}
+
+// retry calls run until it succeeds, as runRetry does with the commands.
+func (p *Plan) retry(ctx context.Context, h *Host, run func() ([]byte, error)) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		out, err := run()
+		if p.CommandRetry.Retries > 0 {
+			h.attempts = attempt
+		}
+		if err == nil || h.err != nil || attempt > p.CommandRetry.Retries {
+			return out, err
+		}
+
+		select {
+		case <-time.After(p.CommandRetry.delay(attempt - 1)):
+		case <-ctx.Done():
+			return out, err
+		}
+	}
+}
+
+// isTransient reports whether a dial error is a network failure worth
+// retrying.
+func isTransient(err error) bool {
+	var hostKeyErr *hostKeyError
+	if errors.As(err, &hostKeyErr) {
+		return false
+	}
+
+	var netErr net.Error
+	var chanErr *ssh.OpenChannelError
+	return errors.As(err, &netErr) || errors.As(err, &chanErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// redial replaces the connection to h with a new one, setting up agent and
+// remote forwarding on it again.
+func (p *Plan) redial(h *Host) error {
+	_ = h.client.Close()
+
+	cfg, err := p.clientConfig(h)
+	if err != nil {
+		return err
+	}
+	// the key pushed when h was first connected to has expired by now
+	if err := p.pushInstanceConnectKey(h); err != nil {
+		return fmt.Errorf("failed to push EC2 Instance Connect key for host %s: %v", h.host, err)
+	}
+	c, err := p.dialRetry(h, cfg)
+	if err != nil {
+		return err
+	}
+	h.client = c
+	h.connectedAt = time.Now()
+	p.startKeepalive(h)
+	if err := p.forwardAgent(h, c); err != nil {
+		return fmt.Errorf("failed to forward agent: %v", err)
+	}
+	if err := p.forwardRemotes(h); err != nil {
+		return fmt.Errorf("failed to forward remote ports: %v", err)
+	}
+	return nil
+}
+
+// connectionDropped reports whether a command failed because the connection
+// to h dropped, rather than by exiting or being stopped.
+func (p *Plan) connectionDropped(ctx context.Context, h *Host, err error) bool {
+	var exitErr *ssh.ExitError
+	if h.daemon != "" || ctx.Err() != nil || errors.As(err, &exitErr) {
+		return false
+	}
+	if h.connectionLost() != nil {
+		return true
+	}
+
+	// the command may have failed for another reason, check the connection
+	// still answers
+	alive := make(chan bool, 1)
+	go func() {
+		_, _, err := h.client.SendRequest(keepaliveRequest, true, nil)
+		alive <- err == nil
+	}()
+	select {
+	case ok := <-alive:
+		return !ok
+	case <-time.After(p.connectTimeout()):
+		return true
+	}
+}
+
+// reconnectAndRun connects to h again after its connection dropped with
+// cause, and runs command on the new connection.
+func (p *Plan) reconnectAndRun(ctx context.Context, h *Host, command string, cause error) ([]byte, error) {
+	if err := p.redial(h); err != nil {
+		return nil, fmt.Errorf("%v, failed to reconnect: %v", cause, err)
+	}
+	h.warnings = append(h.warnings, fmt.Sprintf("reconnected and ran the command again after the connection dropped: %v", cause))
+
+	session, err := p.newSession(h)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start ssh session after reconnecting: %v", err)
+	}
+	return p.runCommand(ctx, h, session, command)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	failing := errors.New("command failed")
+	tests := []struct {
+		name string
+		// retries is RetryOptions.Retries, failures how many runs fail
+		// before one succeeds
+		retries, failures int
+		unreachable       bool
+		wantRuns          int
+		wantAttempts      int
+		wantErr           bool
+	}{
+		{name: "no retries, success", retries: 0, failures: 0, wantRuns: 1},
+		{name: "no retries, failure", retries: 0, failures: 100, wantRuns: 1, wantErr: true},
+		{name: "retried until success", retries: 3, failures: 2, wantRuns: 3, wantAttempts: 3},
+		{name: "retries run out", retries: 2, failures: 100, wantRuns: 3, wantAttempts: 3, wantErr: true},
+		{name: "unreachable host", retries: 3, failures: 100, unreachable: true, wantRuns: 1, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{CommandRetry: RetryOptions{Retries: tt.retries, Backoff: time.Millisecond}}
+			h := &Host{}
+			if tt.unreachable {
+				h.err = errors.New("connection refused")
+			}
+
+			runs := 0
+			done := make(chan error, 1)
+			go func() {
+				_, err := p.retry(context.Background(), h, func() ([]byte, error) {
+					runs++
+					if runs <= tt.failures {
+						return nil, failing
+					}
+					return []byte("ok"), nil
+				})
+				done <- err
+			}()
+
+			select {
+			case err := <-done:
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("retry didn't return")
+			}
+			if runs != tt.wantRuns || h.attempts != tt.wantAttempts {
+				t.Errorf("ran %d times with %d attempts, want %d and %d", runs, h.attempts, tt.wantRuns, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryStopsWithContext(t *testing.T) {
+	p := &Plan{CommandRetry: RetryOptions{Retries: 5, Backoff: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	runs := 0
+	_, err := p.retry(ctx, &Host{}, func() ([]byte, error) {
+		runs++
+		return nil, errors.New("command failed")
+	})
+	if err == nil || runs != 1 {
+		t.Errorf("ran %d times with error %v, want one failed run", runs, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		opts RetryOptions
+		n    int
+		want time.Duration
+	}{
+		{RetryOptions{Backoff: time.Second}, 0, time.Second},
+		{RetryOptions{Backoff: time.Second}, 3, 8 * time.Second},
+		{RetryOptions{Backoff: time.Second, MaxBackoff: 5 * time.Second}, 3, 5 * time.Second},
+		{RetryOptions{Backoff: time.Second, MaxBackoff: 5 * time.Second}, 100, 5 * time.Second},
+		{RetryOptions{}, 2, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.delay(tt.n); got != tt.want {
+			t.Errorf("%+v delay(%d) = %s, want %s", tt.opts, tt.n, got, tt.want)
+		}
+	}
+
+	jittered := RetryOptions{Backoff: 4 * time.Second, Jitter: true}
+	for i := 0; i < 100; i++ {
+		if d := jittered.delay(1); d < 4*time.Second || d >= 8*time.Second {
+			t.Fatalf("jittered delay %s outside [4s, 8s)", d)
+		}
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{fmt.Errorf("handshake: %w", io.EOF), true},
+		{io.ErrUnexpectedEOF, true},
+		{&hostKeyError{host: "web01"}, false},
+		{errors.New("ssh: unable to authenticate"), false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
@@ -1,38 +1,316 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
-	"log"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/danvixent/sshx/util"
+	"github.com/jcmturner/gokrb5/v8/client"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/sync/errgroup"
 )
 
 type Plan struct {
 	PlainHosts    []string
 	Command       string
+	Template      bool
+	User          string
 	SSHKeyPath    string
 	Output        io.WriteCloser
 	ParallelLimit *int
+	HostsFile     string
+	SSHConfigPath string
+	Inventory     string
+	Groups        []string
+	Tags          []string
+	Exclude       []string
+	Filters       []string
+	Limit         int
+	Sample        int
+	AWS           AWSOptions
+	GCP           GCPOptions
+	Azure         AzureOptions
+	Consul        ConsulOptions
+	Kubernetes    KubernetesOptions
+	Terraform     TerraformOptions
+	Vagrant       VagrantOptions
+	// OutputFormat is how WriteResult writes the result, json, yaml, csv,
+	// tsv, table or ndjson. It defaults to a table on a terminal and json
+	// otherwise
+	OutputFormat string
+	// FromKnownHosts targets known_hosts entries matching this pattern
+	FromKnownHosts string
+	Vault          VaultOptions
+	Teleport       TeleportOptions
+	// ProxyJump is a comma separated chain of jump hosts for every host,
+	// overriding ProxyJump in the ssh config
+	ProxyJump string
+	// ProxyCommand is an OpenSSH style ProxyCommand for every host whose
+	// stdio is the connection, overriding the ssh config
+	ProxyCommand string
+	// WebSocket is a ws:// or wss:// gateway URL to reach hosts through, with
+	// %h, %p and %r replaced by the host, port and user
+	WebSocket string
+	// WebSocketHeaders are "Name: value" headers sent to the gateway, such as
+	// an access token
+	WebSocketHeaders []string
+	// Proxy is a socks5:// or http:// proxy URL to connect to hosts, or the
+	// first jump host, through
+	Proxy string
+	// AuthOrder is the order auth methods are tried in, overriding
+	// PreferredAuthentications in the ssh config
+	AuthOrder []string
+	// AgentSocket is the ssh-agent to use instead of SSH_AUTH_SOCK, none
+	// disables the agent
+	AgentSocket string
+	// Password is tried after public keys, AskPass prompts for it instead
+	Password string
+	AskPass  bool
+	// Algorithms restricts the ciphers, key exchanges, MACs and host key
+	// algorithms negotiated
+	Algorithms AlgorithmOptions
+	// RekeyThreshold is how many bytes are sent before session keys are
+	// renegotiated, the ssh package picks a default for the cipher if not set
+	RekeyThreshold uint64
+	// MaxConnectionLifetime replaces connections older than this with new
+	// ones before their next command, so very long runs and daemons don't
+	// keep the same session keys for good. Connections last for the whole
+	// run if not set
+	MaxConnectionLifetime time.Duration
+	// Debug writes what happens to connections to stderr
+	Debug bool
+	// ConnectTimeout is how long to wait for the TCP connection to a host,
+	// 10 seconds if not set
+	ConnectTimeout time.Duration
+	// CommandTimeout is how long the command may run for on the hosts, it
+	// isn't limited if not set. TimeoutOverrides is a yaml file of host
+	// patterns and the timeouts of the hosts they match, for those known to
+	// be slow, which xsh_command_timeout in an inventory also sets
+	CommandTimeout   time.Duration
+	TimeoutOverrides string
+	// BatchSize rolls the command across the hosts in waves of this many
+	// hosts, or this percentage of them like 25%, with BatchPause between
+	// waves
+	BatchSize  string
+	BatchPause time.Duration
+	// Stagger waits this long between starting the command on each host, so
+	// a shared backend the command hits isn't hit by all of them at once.
+	// StaggerJitter waits a random time up to it instead
+	Stagger       time.Duration
+	StaggerJitter bool
+	// Serial runs the commands on one host at a time, in the order the hosts
+	// were given, and streams their output as it arrives, to stderr if the
+	// result goes to stdout
+	Serial bool
+	// Stream prints each line of output as it arrives, prefixed with the
+	// name of its host. Output goes to stderr if the result goes to stdout
+	Stream bool
+	// InterruptGrace is how long the commands still running get to finish
+	// after the run is interrupted before they are stopped, 30 seconds if
+	// not set
+	InterruptGrace time.Duration
+	// Detach starts the command in the background on the hosts as a job,
+	// which outlives the run and is checked on later with CheckJob
+	Detach bool
+	// Canary runs the command on this many hosts, or percentage of them,
+	// first and only goes on to the rest if it succeeded on all of them, and
+	// its output matched CanaryExpect if set
+	Canary       string
+	CanaryExpect string
+	// FailFast stops starting the command on more hosts after it failed on
+	// one, MaxFailures after it failed on this many, or this percentage of
+	// them. The hosts it didn't start on are reported as skipped
+	FailFast    bool
+	MaxFailures string
+	// ExitCodePolicy is when failed hosts fail the run, any (the default),
+	// all or percentage, which fails it when at least ExitCodePercentage of
+	// them failed. A percentage of 0 fails it if any host failed
+	ExitCodePolicy     string
+	ExitCodePercentage *int
+	// RemoteForwards are ssh -R style [bind_address:]port:host:hostport
+	// forwards set up on every host for the run, so commands can reach
+	// host:hostport from here
+	RemoteForwards []string
+	// Steps are more commands run after Command, in order, each in a new
+	// session over the same connection
+	Steps []string
+	// GroupCommands are group=command mappings, run instead of Command on
+	// the hosts in group. GroupCommandsFile is a yaml file of them, those in
+	// GroupCommands win. Hosts in no such group run Command, or are skipped
+	// if there is none
+	GroupCommands     []string
+	GroupCommandsFile string
+	// When is a condition on facts gathered from each host first, like
+	// facts.os == "ubuntu" && facts.memory_gb > 8, the command only runs on
+	// the hosts matching it and the others are reported as skipped
+	When string
+	// Until runs the commands on each host again, every PollInterval or 5
+	// seconds, until a condition on their exit status and output holds,
+	// like exit == 0 && output matches "active", for up to MaxWait or 5
+	// minutes. CommandTimeout then limits each run of the commands
+	Until        string
+	PollInterval time.Duration
+	MaxWait      time.Duration
+	// Env are NAME=value variables set for every command, SendEnv globs
+	// matching local variables to pass on like SendEnv in the ssh config
+	Env     []string
+	SendEnv []string
+	// Shell runs commands with bash, sh, powershell or cmd, for Windows
+	// hosts and minimal images, instead of handing them to the login shell
+	Shell string
+	// Chdir is the directory commands are run from on every host
+	Chdir string
+	// Script is the path of a local script uploaded to every host and run
+	// with ScriptArgs before Command, then removed again
+	Script     string
+	ScriptArgs []string
+	// DaemonSocket is the socket of the xsh daemon to run through, by default
+	// ~/.xsh/daemon.sock if it exists, none connects directly
+	DaemonSocket string
+	// Sudo runs commands through sudo, as BecomeUser if it is set or else
+	// root. SudoPassword, a secret reference, answers its password prompt,
+	// AskSudoPass prompts for it instead
+	Sudo         bool
+	BecomeUser   string
+	SudoPassword string
+	AskSudoPass  bool
+	// PTY runs commands in a pseudo terminal, for those that need one such as
+	// sudo prompting for a password. Output then has terminal line endings
+	PTY bool
+	// Compression asks for zlib compression of the ssh transport like ssh -C.
+	// x/crypto/ssh only implements the none compression, so runs asking for
+	// it are refused rather than left uncompressed
+	Compression bool
+	// Keepalive sets how often connections are checked for liveness
+	Keepalive KeepaliveOptions
+	// Dialer opens the TCP connections to hosts and proxies, by default a
+	// net.Dialer. Embedders can set it to connect over a VPN library or a
+	// test harness instead
+	Dialer Dialer
+	// PreferFamily is ipv4 or ipv6 to try addresses of that family first when
+	// a host has both, a custom Dialer picks addresses itself
+	PreferFamily string
+	// MaxConnectsPerSecond limits how fast hosts are connected to, so large
+	// runs don't trip fail2ban or rate limits, 0 is unlimited
+	MaxConnectsPerSecond float64
+	// Reconnect reconnects to hosts whose connection drops while a command
+	// runs and runs the command again
+	Reconnect bool
+	// Order is fastest or slowest to start commands on the hosts that
+	// connected fastest or slowest first, instead of in the order given
+	Order string
+	// ConnectRetry sets how often and how fast failed connections are retried
+	ConnectRetry RetryOptions
+	// CommandRetry sets how often and how fast commands that fail on a host
+	// are run on it again
+	CommandRetry RetryOptions
+	// KnownHostsFiles are checked for host keys instead of the defaults,
+	// keys trusted on first use are added to the first one
+	KnownHostsFiles []string
+	// HashKnownHosts hashes the host names of keys added to known_hosts
+	HashKnownHosts bool
+	// HostKeyPolicy is strict, tofu, accept-new or none. tofu trusts unknown
+	// hosts after asking, or without asking when Yes is set, accept-new
+	// without asking and none also ignores changed keys. If empty, hosts are
+	// checked strictly unless vagrant's ssh-config says otherwise for them
+	HostKeyPolicy string
+	// Yes answers yes to every prompt
+	Yes bool
+	// ConfirmAbove asks to confirm runs on more than this many hosts before
+	// running anything, unless Yes is set. It isn't asked if not set
+	ConfirmAbove int
+	// RequireAll stops the run before any command if a host can't be
+	// connected to, instead of reporting it as failed and running on the rest
+	RequireAll bool
+	// ShowBanners also writes the banners hosts show before authenticating to
+	// stderr, they are always reported with the results
+	ShowBanners bool
+	// ForwardAgent forwards the local ssh-agent to every host
+	ForwardAgent bool
+	// GSSAPI authenticates with Kerberos tickets for every host, instead of
+	// only those with GSSAPIAuthentication set in the ssh config
+	GSSAPI bool
+	// KIAnswers answer keyboard-interactive questions in order
+	KIAnswers []string
+	// PassphraseFile holds the passphrase of encrypted keys
+	PassphraseFile string
 
-	hosts    []Host
-	errgroup errgroup.Group
-	stop     chan struct{}
+	hosts     []Host
+	sshConfig *sshConfig
+	errgroup  errgroup.Group
+	stop      chan struct{}
+	// serving is set once the plan listens as a daemon
+	serving        bool
+	connectLimiter connectLimiter
+	// daemonActive counts the requests a daemon is running per host, guarded
+	// by daemonMu
+	daemonMu     sync.Mutex
+	daemonActive map[*Host]int
+	// scriptCommand uploads and runs Script
+	scriptCommand string
+	sudo          *sudoExchange
+	// when and until are When and Until parsed
+	when  expr
+	until expr
+	// groupCommands maps groups to the command their hosts run, from
+	// GroupCommandsFile and GroupCommands
+	groupCommands map[string]string
+	// envExports sets Env and SendEnv at the start of every command
+	envExports   string
+	canaryExpect *regexp.Regexp
+	// failures counts the hosts the commands failed on
+	failures atomic.Int32
+	// streamMu serializes writes of streamed output, prefixWidth pads host
+	// names to line them up
+	streamMu    sync.Mutex
+	prefixOnce  sync.Once
+	prefixWidth int
+	// jobID is the job started by a detached run
+	jobID string
+	// interrupt is closed by Interrupt
+	interrupt     chan struct{}
+	interruptOnce sync.Once
+
+	vaultSigner           ssh.Signer
+	instanceConnectSigner ssh.Signer
+	osLoginSigner         ssh.Signer
+	teleportSigner        ssh.Signer
+	passwordMu            sync.Mutex
+	askedPassword         []byte
+	promptMu              sync.Mutex
+	kiCache               map[string][]byte
+	passphraseMu          sync.Mutex
+	passphrases           [][]byte
+	keysMu                sync.Mutex
+	keys                  map[string]ssh.Signer
+	secretsMu             sync.Mutex
+	secrets               map[string]map[string]any
+	jumpMu                sync.Mutex
+	jumps                 map[string]*jumpConn
+	agentMu               sync.Mutex
+	agents                map[string]agent.ExtendedAgent
+	agentConns            []io.Closer
+	vagrantConfig         *sshConfig
+	knownHostsMu          sync.Mutex
+	knownHostsCallbacks   map[string]ssh.HostKeyCallback
+	krbOnce               sync.Once
+	krbClient             *client.Client
+	krbErr                error
 }
 
 func NewPlan(plainHosts []string, command string, SSHKeyPath string, outputFile string, parallelLimit *int) (*Plan, error) {
-	p := &Plan{PlainHosts: plainHosts, Command: command, SSHKeyPath: SSHKeyPath, ParallelLimit: parallelLimit}
+	p := &Plan{PlainHosts: plainHosts, Command: command, SSHKeyPath: SSHKeyPath, ParallelLimit: parallelLimit, SSHConfigPath: defaultSSHConfigFile, stop: make(chan struct{}), interrupt: make(chan struct{})}
 
 	if outputFile != "" {
 		f, err := os.OpenFile(outputFile, os.O_WRONLY|os.O_CREATE, 0o600)
@@ -53,17 +331,101 @@ type SSHClient struct {
 }
 
 type Host struct {
+	// name is the host as given by the user, before ssh config is applied
+	name string
 	user string
 	host string
 
-	session *ssh.Session
+	// keyFile is a key set for this host alone, it wins over --key
+	keyFile       string
+	identityFiles []string
+	proxyJump     string
+	proxyCommand  string
+	// hostKeyAlgorithms are set by HostKeyAlgorithms in the ssh config
+	hostKeyAlgorithms []string
+	// hostKeyPolicy and knownHostsFiles are set by StrictHostKeyChecking and
+	// UserKnownHostsFile in vagrant's ssh-config
+	hostKeyPolicy   string
+	knownHostsFiles []string
+	// authOrder is set by PreferredAuthentications in the ssh config
+	authOrder []string
+	// authMethod is the auth method the host was last connected with
+	authMethod string
+	// retries is how many times connecting to the host was retried
+	retries int
+	// attempts is how many times the commands were run, when they are retried
+	attempts int
+	// canary is set for the hosts run on first with Canary, failed for hosts
+	// whose commands failed
+	canary bool
+	failed bool
+	// latency is how long connecting to and authenticating with the host
+	// took, dialTime how much of it opening the connection did
+	latency  time.Duration
+	dialTime time.Duration
+	// execTime is how long running the commands took
+	execTime     time.Duration
+	gssapi       bool
+	forwardAgent bool
+	// agentSocket, password, proxy and websocket are set per host in the
+	// inventory
+	agentSocket string
+	password    string
+	proxy       string
+	websocket   string
+	// commandTimeout replaces CommandTimeout if overridden is set, by the
+	// inventory or TimeoutOverrides
+	commandTimeout time.Duration
+	overridden     bool
+
+	// err is why the host could not be connected to, reported as its result
+	err error
+	// warnings are reported with the result of the host
+	warnings []string
+	// banner is what the host showed before authenticating, such as a legal
+	// notice
+	banner string
+
+	// groups, tags and vars are set for hosts read from an inventory
+	groups []string
+	tags   []string
+	vars   map[string]string
+	// command replaces Command for hosts in a group with its own command
+	command string
+	// facts are those gathered for When
+	facts map[string]string
+	// stderr is what the commands of the last run wrote to stderr
+	stderr []byte
+
+	client *ssh.Client
+	// connectedAt is when client was connected
+	connectedAt    time.Time
+	agentForwarded bool
+	// daemon is the socket of the daemon holding the connection to the host
+	daemon    string
+	session   *ssh.Session
+	keepalive *keepalive
 }
 
 var (
-	dialTimeout = time.Second * 10
-
 	ErrNoHosts        = errors.New("no hosts specified")
+	ErrNoHostsMatched = errors.New("no hosts left after applying exclusions and filters")
 	ErrNoSSHKeysFound = errors.New("no ssh keys found in default directory")
+	// ErrConnectionLost is the error class of hosts whose connection died
+	// while the command ran
+	ErrConnectionLost = errors.New("connection lost")
+	// ErrCanaryFailed is returned when the command failed on a canary host
+	// and wasn't run on the rest
+	ErrCanaryFailed = errors.New("canary failed")
+	// ErrInterrupted is returned when the run was interrupted before the
+	// command was started on every host
+	ErrInterrupted = errors.New("interrupted")
+	// ErrFailureLimit is returned when hosts were skipped after FailFast or
+	// MaxFailures stopped the run
+	ErrFailureLimit = errors.New("failure limit reached")
+	// ErrHostsFailed is returned by ExitCodeError when enough hosts failed
+	// for the run to fail under ExitCodePolicy
+	ErrHostsFailed = errors.New("command failed")
 
 	beginBytes = []byte(`-----BEGIN`)
 
@@ -74,96 +436,528 @@ var (
 	}
 
 	publicKeyRegex = regexp.MustCompile(`\.pub$`)
-
-	timeout = time.Second * 10
 )
 
 const (
 	defaultSSHConfigDir = "~/.ssh/"
+
+	defaultConnectTimeout = 10 * time.Second
 )
 
 func (p *Plan) OpenConns() error {
-	if len(p.PlainHosts) == 0 {
-		return ErrNoHosts
+	if err := p.checkOptions(); err != nil {
+		return err
 	}
-
-	for _, host := range p.PlainHosts {
-		parts := strings.Split(host, "@")
-		if len(parts) != 2 {
-			return fmt.Errorf("invalid host: %s, hosts must be in the format user@host", host)
+	if err := p.loadScript(); err != nil {
+		return err
+	}
+	if err := p.loadEnv(); err != nil {
+		return err
+	}
+	if err := p.loadGroupCommands(); err != nil {
+		return err
+	}
+	if p.Detach {
+		id, err := newJobID()
+		if err != nil {
+			return err
 		}
+		p.jobID = id
+	}
+	if p.HostKeyPolicy == hostKeyPolicyNone {
+		fmt.Fprintln(os.Stderr, "WARNING: host key checking is disabled, connections to hosts whose key changed are open to man-in-the-middle attacks")
+	}
 
-		signers, err := p.getSigners(p.SSHKeyPath)
-		if err != nil {
-			return fmt.Errorf("failed to get signers: %v", err)
+	password, err := p.resolveSecret(p.Password)
+	if err != nil {
+		return fmt.Errorf("failed to resolve password: %v", err)
+	}
+	p.Password = password
+
+	if err := p.setupSudo(); err != nil {
+		return err
+	}
+
+	if err := p.ResolveHosts(); err != nil {
+		return err
+	}
+	if err := p.assignGroupCommands(); err != nil {
+		return err
+	}
+	if err := p.loadTimeoutOverrides(); err != nil {
+		return err
+	}
+
+	allDaemon, err := p.useDaemon()
+	if err != nil {
+		return err
+	}
+	if !allDaemon {
+		if err := p.setupCredentials(); err != nil {
+			return err
 		}
+	}
 
-		h := Host{
-			user: parts[0],
-			host: parts[1],
+	// hosts are connected to at once, spaced out by MaxConnectsPerSecond
+	var connects errgroup.Group
+	connects.SetLimit(p.connectParallelism())
+	var failed atomic.Bool
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		if h.daemon != "" {
+			continue
 		}
 
-		cfg := &ssh.ClientConfig{
-			Config:         ssh.Config{},
-			User:           h.user,
-			Auth:           []ssh.AuthMethod{ssh.PublicKeys(signers...)},
-			BannerCallback: ssh.BannerDisplayStderr(),
-			Timeout:        timeout,
+		connects.Go(func() error {
+			if failed.Load() {
+				return nil
+			}
+			if err := p.connect(h); err != nil {
+				if p.RequireAll {
+					failed.Store(true)
+					return err
+				}
+				// the host is reported as failed, the others still run
+				h.err = err
+			}
+			return nil
+		})
+	}
+	if err := connects.Wait(); err != nil {
+		p.closeConns()
+		return err
+	}
+
+	go p.listenForClose()
+
+	return nil
+}
+
+// defaultConnectParallelism is how many hosts are connected to at once if
+// ParallelLimit isn't set.
+const defaultConnectParallelism = 32
+
+// connectParallelism returns how many hosts are connected to at once.
+func (p *Plan) connectParallelism() int {
+	if p.ParallelLimit != nil && *p.ParallelLimit > 0 {
+		return *p.ParallelLimit
+	}
+	return defaultConnectParallelism
+}
+
+// connectErrors writes why the hosts that couldn't be connected to weren't,
+// for commands that have no results to report it in, and returns how many
+// were connected to.
+func (p *Plan) connectErrors(w io.Writer) int {
+	connected := 0
+	for i := range p.hosts {
+		h := &p.hosts[i]
+		if h.err != nil {
+			fmt.Fprintf(w, "skipping %s: %v\n", h.name, h.err)
+			continue
 		}
+		connected++
+	}
+	return connected
+}
 
-		sshConn, err := ssh.Dial("tcp", h.host, cfg)
+// connect opens the connection and first session to h. Whatever was opened
+// is closed again if it fails.
+func (p *Plan) connect(h *Host) error {
+	cfg, err := p.clientConfig(h)
+	if err != nil {
+		return err
+	}
+
+	if err := p.pushInstanceConnectKey(h); err != nil {
+		return fmt.Errorf("failed to push EC2 Instance Connect key for host %s: %v", h.host, err)
+	}
+
+	sshConn, err := p.dialRetry(h, cfg)
+	var hostKeyErr *hostKeyError
+	if errors.As(err, &hostKeyErr) {
+		return hostKeyErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to dial SSH for host %s: %w", h.host, err)
+	}
+	if h.authMethod == "" {
+		// the server let us in without authenticating
+		h.authMethod = authNone
+	}
+
+	h.client = sshConn
+	h.connectedAt = time.Now()
+	p.debugf("connected to %s, %s", h.name, p.rekeyPolicy())
+	p.startKeepalive(h)
+
+	fail := func(err error) error {
+		_ = sshConn.Close()
+		h.client = nil
+		return err
+	}
+	if err := p.forwardAgent(h, sshConn); err != nil {
+		return fail(fmt.Errorf("failed to forward agent for host %s: %v", h.host, err))
+	}
+	if err := p.forwardRemotes(h); err != nil {
+		return fail(fmt.Errorf("failed to forward remote ports for host %s: %v", h.host, err))
+	}
+
+	session, err := p.newSession(h)
+	if err != nil {
+		return fail(fmt.Errorf("failed to start ssh session for host %s: %v", h.host, err))
+	}
+
+	h.session = session
+	return nil
+}
+
+// checkOptions validates the connection options before anything is dialed.
+func (p *Plan) checkOptions() error {
+	if err := checkHostKeyPolicy(p.HostKeyPolicy); err != nil {
+		return err
+	}
+	if err := p.Algorithms.validate(); err != nil {
+		return err
+	}
+	if err := checkAuthOrder(p.AuthOrder); err != nil {
+		return err
+	}
+	if err := p.ConnectRetry.validate(); err != nil {
+		return err
+	}
+	if err := p.CommandRetry.validate(); err != nil {
+		return err
+	}
+	if err := checkFamily(p.PreferFamily); err != nil {
+		return err
+	}
+	if err := checkConnectRate(p.MaxConnectsPerSecond); err != nil {
+		return err
+	}
+	if err := checkRemoteForwards(p.RemoteForwards); err != nil {
+		return err
+	}
+	if err := checkOrder(p.Order); err != nil {
+		return err
+	}
+	if err := checkHostCount("batch size", p.BatchSize); err != nil {
+		return err
+	}
+	if err := checkHostCount("canary", p.Canary); err != nil {
+		return err
+	}
+	if err := checkHostCount("max failures", p.MaxFailures); err != nil {
+		return err
+	}
+	if err := p.checkDetach(); err != nil {
+		return err
+	}
+	if err := p.checkWhen(); err != nil {
+		return err
+	}
+	if err := p.checkUntil(); err != nil {
+		return err
+	}
+	if err := p.checkExitCodePolicy(); err != nil {
+		return err
+	}
+	if err := checkOutputFormat(p.OutputFormat); err != nil {
+		return err
+	}
+	if p.Serial && p.Order != orderGiven {
+		return fmt.Errorf("serial runs can't be reordered, they go in the order the hosts were given")
+	}
+	if p.Stagger < 0 {
+		return fmt.Errorf("invalid stagger %s, must not be negative", p.Stagger)
+	}
+	if p.CanaryExpect != "" {
+		re, err := regexp.Compile(p.CanaryExpect)
 		if err != nil {
-			return fmt.Errorf("failed to dial SSH for host %s: %v", host, err)
+			return fmt.Errorf("invalid canary expect %s: %v", p.CanaryExpect, err)
+		}
+		p.canaryExpect = re
+	}
+	if err := checkLifetime(p.MaxConnectionLifetime); err != nil {
+		return err
+	}
+	if err := p.checkShell(); err != nil {
+		return err
+	}
+	if p.Compression {
+		return fmt.Errorf("compression isn't supported, x/crypto/ssh can't compress the ssh transport")
+	}
+	if p.ProxyJump != "" && p.ProxyCommand != "" {
+		return fmt.Errorf("a jump host and a proxy command can't be used together")
+	}
+	if p.WebSocket != "" {
+		if _, err := parseWebSocketURL(p.WebSocket); err != nil {
+			return err
+		}
+	}
+	if p.Proxy != "" {
+		if _, err := parseProxyURL(p.Proxy); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		session, err := sshConn.NewSession()
-		if err != nil {
-			return fmt.Errorf("failed to start ssh session for host %s: %v", host, err)
+// setupCredentials obtains the keys and certificates issued for this run.
+func (p *Plan) setupCredentials() error {
+	if err := p.signVaultCertificate(); err != nil {
+		return err
+	}
+	if err := p.setupInstanceConnect(); err != nil {
+		return err
+	}
+	if err := p.setupOSLogin(); err != nil {
+		return err
+	}
+	return p.setupTeleport()
+}
+
+// newSession opens a session on the connection to h, ready to run a command.
+func (p *Plan) newSession(h *Host) (*ssh.Session, error) {
+	return p.openSession(h, p.PTY)
+}
+
+// openSession opens a session on h, in a pty if pty is set.
+func (p *Plan) openSession(h *Host, pty bool) (*ssh.Session, error) {
+	session, err := h.client.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	if h.agentForwarded {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to forward agent: %v", err)
 		}
+	}
+
+	if !pty {
+		// commands are run over a plain exec channel, their output comes back
+		// byte for byte
+		return session, nil
+	}
+
+	// Set up terminal modes
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          0,     // disable echoing
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+	// Request pseudo terminal
+	if err := session.RequestPty("xterm", 40, 80, modes); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to set request terminal: %v", err)
+	}
+
+	return session, nil
+}
 
-		// Set up terminal modes
-		modes := ssh.TerminalModes{
-			ssh.ECHO:          0,     // disable echoing
-			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+// clientConfig builds the ssh client config used to connect to h.
+func (p *Plan) clientConfig(h *Host) (*ssh.ClientConfig, error) {
+	var signers []ssh.Signer
+	if h.keyFile != "" {
+		s, err := p.getSigners(h.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get signers for host %s: %v", h.name, err)
 		}
-		// Request pseudo terminal
-		if err := h.session.RequestPty("xterm", 40, 80, modes); err != nil {
-			return fmt.Errorf("failed to set request terminal for host %s: %v", h.host, err)
+		signers = s
+	}
+
+	if len(signers) == 0 && util.IsStringEmpty(p.SSHKeyPath) && len(h.identityFiles) > 0 {
+		for _, file := range h.identityFiles {
+			if _, err := os.Stat(file); err != nil {
+				// like ssh, silently skip identity files that don't exist
+				continue
+			}
+
+			s, err := p.getSigners(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get signers: %v", err)
+			}
+			signers = append(signers, s...)
 		}
-		// Start remote shell
-		if err := h.session.Shell(); err != nil {
-			return fmt.Errorf("failed to start shell for host %s: %v", h.host, err)
+	}
+
+	// like ssh, the agent is tried after explicitly given keys but before
+	// the keys found in ~/.ssh
+	a := p.sshAgent(h)
+	password := p.passwordAuth(h)
+	issued := p.issuedSigners()
+	var defaults []ssh.Signer
+	if len(signers) == 0 {
+		s, err := p.getSigners(p.SSHKeyPath)
+		switch {
+		case err == nil && util.IsStringEmpty(p.SSHKeyPath):
+			defaults = s
+		case err == nil:
+			signers = s
+		case (a == nil && password == nil && len(p.KIAnswers) == 0 && len(issued) == 0) || !util.IsStringEmpty(p.SSHKeyPath):
+			return nil, fmt.Errorf("failed to get signers: %v", err)
 		}
+	}
 
-		h.session = session
-		p.hosts = append(p.hosts)
+	// keys issued for this run are tried first
+	signers = append(issued, signers...)
+
+	gssapi, err := p.gssapiAuth(h)
+	if err != nil {
+		return nil, err
+	}
+	methods := &authMethods{
+		gssapi:   gssapi,
+		password: password,
+		ki:       p.keyboardInteractiveAuth(h),
+		signers:  signers,
+		agent:    a,
+		defaults: defaults,
 	}
 
-	go p.listenForClose()
+	config := p.Algorithms.config()
+	config.RekeyThreshold = p.RekeyThreshold
 
-	return nil
+	return &ssh.ClientConfig{
+		Config:            config,
+		User:              h.user,
+		Auth:              methods.ordered(h, p.authOrder(h)),
+		HostKeyCallback:   p.hostKeyCallback(h),
+		HostKeyAlgorithms: p.Algorithms.hostKeyAlgorithms(h.hostKeyAlgorithms, p.hostKeyAlgorithms(h)),
+		BannerCallback:    p.bannerCallback(h),
+		Timeout:           p.connectTimeout(),
+	}, nil
+}
+
+// bannerCallback keeps the banner h shows for its result, so it doesn't
+// interleave with the output of the other hosts.
+func (p *Plan) bannerCallback(h *Host) ssh.BannerCallback {
+	return func(message string) error {
+		h.banner += message
+		if p.ShowBanners {
+			return ssh.BannerDisplayStderr()(message)
+		}
+		return nil
+	}
+}
+
+// issuedSigners returns the keys and certificates issued for this run by
+// Vault, EC2 Instance Connect, OS Login or Teleport.
+func (p *Plan) issuedSigners() []ssh.Signer {
+	var signers []ssh.Signer
+	for _, s := range []ssh.Signer{p.vaultSigner, p.instanceConnectSigner, p.osLoginSigner, p.teleportSigner} {
+		if s != nil {
+			signers = append(signers, s)
+		}
+	}
+	return signers
+}
+
+// connectTimeout returns how long to wait for TCP connections.
+func (p *Plan) connectTimeout() time.Duration {
+	if p.ConnectTimeout > 0 {
+		return p.ConnectTimeout
+	}
+	return defaultConnectTimeout
 }
 
 func (p *Plan) Execute(ctx context.Context) (*Result, error) {
 	result := &Result{}
+	if p.OutputFormat == formatNDJSON {
+		streamResults(result, p.resultWriter())
+	}
 
-	if p.ParallelLimit != nil {
-		err := p.executeErrG(ctx, result)
-		return result, err
+	hosts := p.executionOrder()
+	if p.Canary != "" {
+		// checked by OpenConns
+		n, _ := hostCount(p.Canary, len(hosts))
+		canaries, rest := hosts[:min(n, len(hosts))], hosts[min(n, len(hosts)):]
+		for _, h := range canaries {
+			h.canary = true
+		}
+		if err := p.executeBatch(ctx, result, canaries); err != nil {
+			return result, err
+		}
+		for _, h := range canaries {
+			if h.failed {
+				skip(result, rest, "skipped, the canary failed")
+				return result, fmt.Errorf("%w on %s, not running on the other %d hosts", ErrCanaryFailed, h.name, len(rest))
+			}
+		}
+		hosts = rest
+	}
+
+	batches := p.batches(hosts)
+	for i, batch := range batches {
+		if reason := p.stopReason(); reason != "" {
+			for _, rest := range batches[i:] {
+				skip(result, rest, reason)
+			}
+			break
+		}
+
+		if i > 0 && p.BatchPause > 0 {
+			select {
+			case <-time.After(p.BatchPause):
+			case <-p.interrupt:
+				for _, rest := range batches[i:] {
+					skip(result, rest, "skipped, the run was interrupted")
+				}
+				return result, ErrInterrupted
+			case <-ctx.Done():
+				for _, rest := range batches[i:] {
+					skip(result, rest, "skipped, the run was stopped")
+				}
+				return result, ctx.Err()
+			}
+		}
+
+		if err := p.executeBatch(ctx, result, batch); err != nil {
+			return result, err
+		}
+	}
+
+	if p.interrupted() {
+		return result, ErrInterrupted
+	}
+	if p.stopReason() != "" {
+		return result, fmt.Errorf("%w (%d failed)", ErrFailureLimit, p.failures.Load())
+	}
+	return result, nil
+}
+
+// executeBatch runs the commands on hosts, all at once or ParallelLimit at a
+// time. CommandTimeout applies per batch, so later batches get all of it.
+func (p *Plan) executeBatch(ctx context.Context, result *Result, hosts []*Host) error {
+	if p.Serial {
+		return p.executeSerial(ctx, result, hosts)
 	}
 
-	err := p.executeWG(ctx, result)
-	return result, err
+	if p.ParallelLimit != nil {
+		return p.executeErrG(ctx, result, hosts)
+	}
+	return p.executeWG(ctx, result, hosts)
 }
 
+// WriteResult writes result to Output, or stdout if it isn't set, in
+// OutputFormat or the default for where it goes.
 func (p *Plan) WriteResult(result *Result) error {
-	b, err := result.MarshalJSON()
+	if p.OutputFormat == formatNDJSON {
+		// the hosts were written as they were done
+		if err := result.addedErr; err != nil {
+			return fmt.Errorf("failed to write result: %v", err)
+		}
+		return nil
+	}
+
+	b, err := marshalResult(result, p.resultFormat())
 	if err != nil {
 		return fmt.Errorf("failed to marshal result: %v", err)
 	}
 
-	_, err = p.Output.Write(b)
+	_, err = p.resultWriter().Write(b)
 	if err != nil {
 		return fmt.Errorf("failed to write result to file: %v", err)
 	}
@@ -172,18 +966,16 @@ func (p *Plan) WriteResult(result *Result) error {
 }
 
 // executes with a waitgroup
-func (p *Plan) executeWG(ctx context.Context, result *Result) error {
+func (p *Plan) executeWG(ctx context.Context, result *Result, hosts []*Host) error {
 	var wg sync.WaitGroup
 
-	for _, h := range p.hosts {
+	for i, h := range hosts {
+		p.stagger(ctx, i)
 		wg.Add(1)
-		go func(session *ssh.Session, host string, result *Result) {
+		go func(h *Host, result *Result) {
 			defer wg.Done()
-
-			start := time.Now()
-			out, err := session.Output(p.Command)
-			result.AddResult(start, time.Now(), host, out, err)
-		}(h.session, h.host, result)
+			p.runHost(ctx, result, h)
+		}(h, result)
 	}
 
 	wg.Wait()
@@ -191,23 +983,239 @@ func (p *Plan) executeWG(ctx context.Context, result *Result) error {
 }
 
 // executes with a errgroup  limiting concurrency
-func (p *Plan) executeErrG(ctx context.Context, result *Result) error {
+func (p *Plan) executeErrG(ctx context.Context, result *Result, hosts []*Host) error {
 	errg := &errgroup.Group{}
 	errg.SetLimit(*p.ParallelLimit)
 
-	for _, h := range p.hosts {
-		session := h.session
-		host := h.host
+	for i, h := range hosts {
+		p.stagger(ctx, i)
 		errg.Go(func() error {
-			start := time.Now()
-			out, err := session.Output(p.Command)
-			result.AddResult(start, time.Now(), host, out, err)
+			p.runHost(ctx, result, h)
 			return nil
 		})
 
 	}
 
-	return nil
+	return errg.Wait()
+}
+
+// runHost runs the commands on h and adds how it went to result.
+func (p *Plan) runHost(ctx context.Context, result *Result, h *Host) {
+	if reason := p.stopReason(); reason != "" {
+		result.AddSkipped(h, reason)
+		return
+	}
+	if len(p.commands(h)) == 0 {
+		result.AddSkipped(h, "skipped, no command for its groups")
+		return
+	}
+
+	// with until the timeout is for each run of the commands
+	if timeout := p.commandTimeout(h); timeout > 0 && p.until == nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	match, err := p.matchWhen(ctx, h)
+	if !match && err == nil {
+		result.AddSkipped(h, "skipped, doesn't match when")
+		return
+	}
+	var out []byte
+	execStart := time.Now()
+	switch {
+	case err != nil:
+	case p.until != nil:
+		out, err = p.runUntil(ctx, h)
+	default:
+		out, err = p.runRetry(ctx, h)
+	}
+	h.execTime = time.Since(execStart)
+	if err == nil && h.canary && p.canaryExpect != nil && !p.canaryExpect.Match(out) {
+		err = fmt.Errorf("canary output doesn't match %s", p.CanaryExpect)
+	}
+	if h.failed = err != nil; h.failed {
+		p.failures.Add(1)
+	}
+	result.AddResult(start, time.Now(), h, out, err)
+}
+
+// run executes the plan's commands on h, one after the other over the same
+// connection, and returns their output. It stops at the first command that
+// fails.
+func (p *Plan) run(ctx context.Context, h *Host) ([]byte, error) {
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	commands := p.commands(h)
+	var output []byte
+	h.stderr = nil
+	for i, command := range commands {
+		if p.connectionExpired(h) {
+			if err := p.renewConnection(h); err != nil {
+				return output, err
+			}
+		}
+
+		// the first session is only used once, runs after it open their own
+		session := h.session
+		h.session = nil
+		if (i > 0 || session == nil) && h.daemon == "" {
+			var err error
+			session, err = p.newSession(h)
+			if err != nil {
+				return output, fmt.Errorf("failed to start ssh session: %v", err)
+			}
+		}
+
+		out, err := p.runCommand(ctx, h, session, command)
+		if err != nil && p.Reconnect && p.connectionDropped(ctx, h, err) {
+			out, err = p.reconnectAndRun(ctx, h, command, err)
+		}
+		output = append(output, out...)
+		if err != nil {
+			if len(commands) > 1 {
+				return output, fmt.Errorf("step %d: %w", i+1, err)
+			}
+			return output, err
+		}
+	}
+	return output, nil
+}
+
+// commands returns Command followed by Steps.
+func (p *Plan) commands(h *Host) []string {
+	command := p.Command
+	if h.command != "" {
+		command = h.command
+	}
+	if p.scriptCommand == "" && len(p.groupCommands) == 0 {
+		return append([]string{command}, p.Steps...)
+	}
+
+	var commands []string
+	if p.scriptCommand != "" {
+		commands = append(commands, p.scriptCommand)
+	}
+	if command != "" {
+		commands = append(commands, command)
+	}
+	return append(commands, p.Steps...)
+}
+
+// runCommand runs command on h in session, or through the daemon holding its
+// connection, and returns its output.
+func (p *Plan) runCommand(ctx context.Context, h *Host, session *ssh.Session, command string) ([]byte, error) {
+	command, err := p.commandFor(h, command)
+	if err != nil {
+		return nil, err
+	}
+	command = p.shellCommand(p.envExports + p.chdirCommand(p.Chdir) + command)
+	if p.Detach {
+		command = detachCommand(p.jobID, command)
+	}
+	if p.sudo != nil {
+		command = p.sudo.command(command, p.BecomeUser)
+	}
+
+	var out, stderr []byte
+	stream, errStream := p.streamOutput(h)
+	// daemons send the output once the command is done
+	var live, liveErr io.Writer
+	if stream != nil && h.daemon == "" {
+		live, liveErr = stream, errStream
+	}
+	if h.daemon != "" {
+		out, stderr, err = p.runDaemon(ctx, h, command)
+	} else {
+		out, stderr, err = p.runSession(ctx, h, session, command, live, liveErr)
+		if errors.Is(err, errSudoNeedsTTY) && !p.PTY {
+			if session, err = p.openSession(h, true); err != nil {
+				return nil, fmt.Errorf("failed to start ssh session with a pty for sudo: %v", err)
+			}
+			out, stderr, err = p.runSession(ctx, h, session, command, live, liveErr)
+		}
+	}
+	h.stderr = append(h.stderr, stderr...)
+	if err != nil {
+		if lost := h.connectionLost(); lost != nil {
+			return out, lost
+		}
+	}
+	if stream != nil {
+		if live == nil {
+			_, _ = stream.Write(out)
+		}
+		if liveErr == nil {
+			_, _ = errStream.Write(stderr)
+		}
+		stream.flush()
+		errStream.flush()
+	}
+	return out, err
+}
+
+// runSession runs command in session, closing it if ctx is done first, and
+// returns what it wrote to stdout and stderr. They are also copied to stream
+// and errStream as they arrive if those aren't nil.
+func (p *Plan) runSession(ctx context.Context, h *Host, session *ssh.Session, command string, stream, errStream io.Writer) ([]byte, []byte, error) {
+	defer session.Close()
+
+	type output struct {
+		out, stderr []byte
+		err         error
+	}
+	done := make(chan output, 1)
+	go func() {
+		if p.sudo != nil {
+			out, stderr, err := p.sudo.run(session, command, stream, errStream)
+			done <- output{out, stderr, err}
+			return
+		}
+		var out, stderr bytes.Buffer
+		session.Stdout, session.Stderr = teeWriter(&out, stream), teeWriter(&stderr, errStream)
+		err := session.Run(command)
+		done <- output{out.Bytes(), stderr.Bytes(), err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.out, o.stderr, o.err
+	case <-ctx.Done():
+		exited := make(chan struct{})
+		go func() {
+			<-done
+			close(exited)
+		}()
+		stopSession(session, exited)
+		return nil, nil, fmt.Errorf("command stopped: %v", ctx.Err())
+	}
+}
+
+// killGrace is how long a stopped command gets to exit after SIGTERM before
+// it is sent SIGKILL.
+const killGrace = 5 * time.Second
+
+// stopSession stops the command running in session with SIGTERM, or SIGKILL
+// if it hasn't exited within killGrace, before the session is closed. Closing
+// it alone leaves commands without a pty running on the host. Servers that
+// don't take signals get the session closed right away.
+func stopSession(session *ssh.Session, exited <-chan struct{}) {
+	defer session.Close()
+
+	for _, sig := range []ssh.Signal{ssh.SIGTERM, ssh.SIGKILL} {
+		if err := session.Signal(sig); err != nil {
+			return
+		}
+		select {
+		case <-exited:
+			return
+		case <-time.After(killGrace):
+		}
+	}
 }
 
 func (p *Plan) Close(ctx context.Context) {
@@ -219,8 +1227,24 @@ func (p *Plan) Close(ctx context.Context) {
 
 func (p *Plan) listenForClose() {
 	<-p.stop
+	p.closeConns()
+	p.wipeSecrets()
+}
+
+// closeConns closes the sessions and connections to every host and jump
+// host, and the agents they used.
+func (p *Plan) closeConns() {
 	for i := range p.hosts {
-		_ = p.hosts[i].session.Close()
+		if session := p.hosts[i].session; session != nil {
+			_ = session.Close()
+		}
+		if client := p.hosts[i].client; client != nil {
+			_ = client.Close()
+		}
+	}
+	p.closeJumps()
+	for _, conn := range p.agentConns {
+		_ = conn.Close()
 	}
 }
 
@@ -231,16 +1255,26 @@ func (p *Plan) getSigners(keyFile string) ([]ssh.Signer, error) {
 			return nil, fmt.Errorf("failed to read key file: %v", err)
 		}
 
-		signer, err := ssh.ParsePrivateKey(f)
+		signer, err := p.parsePrivateKey(keyFile, f)
 		if err != nil {
-			log.Fatalf("parse ssh private key failed:%v", err)
+			return nil, fmt.Errorf("failed to parse key %s: %v", keyFile, err)
 		}
 
 		return []ssh.Signer{signer}, nil
 	}
 
 	var signers []ssh.Signer
-	err := filepath.Walk(defaultSSHConfigDir, func(path string, info fs.FileInfo, err error) error {
+	err := filepath.Walk(util.ExpandHome(defaultSSHConfigDir), func(path string, info fs.FileInfo, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
 		_, ok := ignoreFiles[info.Name()]
 		if ok || publicKeyRegex.MatchString(info.Name()) {
 			// skip config files
@@ -252,9 +1286,10 @@ func (p *Plan) getSigners(keyFile string) ([]ssh.Signer, error) {
 			return fmt.Errorf("failed to read key file: %v", err)
 		}
 
-		signer, err := ssh.ParsePrivateKey(f)
+		signer, err := p.parsePrivateKey(path, f)
 		if err != nil {
-			log.Fatalf("parse key failed:%v", err)
+			// not every file in ~/.ssh is a key, e.g. authorized_keys
+			return nil
 		}
 
 		signers = append(signers, signer)
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+)
+
+// maxCommandLength is the longest command a host's shell accepts, Linux caps
+// a single argument at 128KiB.
+const maxCommandLength = 128*1024 - 1
+
+// loadScript reads Script and builds the command that uploads and runs it.
+func (p *Plan) loadScript() error {
+	if p.Script == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(util.ExpandHome(p.Script))
+	if err != nil {
+		return fmt.Errorf("failed to read script: %v", err)
+	}
+
+	command := scriptCommand(string(b), p.ScriptArgs)
+	if len(command) > maxCommandLength {
+		return fmt.Errorf("script %s is too large to upload, %d bytes once quoted, the limit is %d", p.Script, len(command), maxCommandLength)
+	}
+	p.scriptCommand = command
+	return nil
+}
+
+// scriptCommand returns a command that writes script to a temporary file on
+// the host, runs it with args and removes it again, exiting with its status.
+// The script is passed in the command itself, so it is run however the
+// command is, through a daemon or compressed.
+func scriptCommand(script string, args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return fmt.Sprintf(`f=$(mktemp "${TMPDIR:-/tmp}/xsh.XXXXXX") || exit 1
+trap 'rm -f "$f"' EXIT
+trap 'exit 129' HUP INT TERM
+printf '%%s' %s > "$f" && chmod 700 "$f" && "$f" %s`, shellQuote(script), strings.Join(quoted, " "))
+}
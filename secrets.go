@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// resolveSecret returns the secret ref refers to. A ref of env:NAME reads
+// the environment variable NAME, vault:PATH#FIELD reads FIELD of the Vault
+// secret at PATH, anything else is the secret itself.
+func (p *Plan) resolveSecret(ref string) (string, error) {
+	if name, ok := strings.CutPrefix(ref, "env:"); ok {
+		v, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return v, nil
+	}
+
+	if path, ok := strings.CutPrefix(ref, "vault:"); ok {
+		path, field, found := strings.Cut(path, "#")
+		if !found || path == "" || field == "" {
+			return "", fmt.Errorf("invalid vault secret %s, must be vault:path#field", ref)
+		}
+		return p.vaultSecret(path, field)
+	}
+
+	return ref, nil
+}
+
+type vaultSecretResponse struct {
+	Data map[string]any `json:"data"`
+}
+
+// vaultSecret reads field of the Vault secret at path. Paths of KV version 2
+// engines can be given as they are to the vault kv cli, without data/. Each
+// secret is read once per run.
+func (p *Plan) vaultSecret(path, field string) (string, error) {
+	p.secretsMu.Lock()
+	defer p.secretsMu.Unlock()
+
+	data, ok := p.secrets[path]
+	if !ok {
+		var err error
+		data, err = p.readVaultSecret(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read vault secret %s: %v", path, err)
+		}
+		if p.secrets == nil {
+			p.secrets = map[string]map[string]any{}
+		}
+		p.secrets[path] = data
+	}
+
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s of vault secret %s is not a string", field, path)
+	}
+	return s, nil
+}
+
+func (p *Plan) readVaultSecret(path string) (map[string]any, error) {
+	path = strings.Trim(path, "/")
+
+	var out vaultSecretResponse
+	err := p.Vault.do(http.MethodGet, path, nil, &out)
+	if errors.Is(err, errVaultNotFound) {
+		// KV version 2 serves secrets under data/ after the mount
+		mount, rest, found := strings.Cut(path, "/")
+		if !found {
+			return nil, err
+		}
+		out = vaultSecretResponse{}
+		err = p.Vault.do(http.MethodGet, mount+"/data/"+rest, nil, &out)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// KV version 2 nests the secret under data and adds its metadata
+	if nested, ok := out.Data["data"].(map[string]any); ok {
+		if _, ok := out.Data["metadata"]; ok {
+			return nested, nil
+		}
+	}
+	return out.Data, nil
+}
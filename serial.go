@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// executeSerial runs the commands on one host at a time, in the order the
+// hosts were given, streaming their output as it arrives.
+func (p *Plan) executeSerial(ctx context.Context, result *Result, hosts []*Host) error {
+	for i, h := range hosts {
+		p.stagger(ctx, i)
+		if p.stopReason() == "" && !p.Stream {
+			fmt.Fprintf(p.liveOutput(), "==> %s <==\n", h.name)
+		}
+		p.runHost(ctx, result, h)
+	}
+	return nil
+}
+
+// liveOutput returns where output shown as it arrives goes, stdout unless
+// the result is written there too, where it would get in the way of parsing
+// the result.
+func (p *Plan) liveOutput() io.Writer {
+	if p.Output == nil {
+		return os.Stderr
+	}
+	return os.Stdout
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// Interpreters commands can be run with. The default, none, hands the command
+// to the login shell of the remote user as it is.
+const (
+	shellNone       = "none"
+	shellSh         = "sh"
+	shellBash       = "bash"
+	shellPowerShell = "powershell"
+	shellCmd        = "cmd"
+)
+
+// checkShell checks Shell, and that the features that wrap commands in POSIX
+// shell aren't used with the Windows interpreters.
+func (p *Plan) checkShell() error {
+	switch p.Shell {
+	case "", shellNone, shellSh, shellBash:
+		return nil
+	case shellPowerShell, shellCmd:
+		switch {
+		case p.Sudo || p.BecomeUser != "":
+			return fmt.Errorf("sudo can't be used with the %s shell", p.Shell)
+		case p.Script != "":
+			return fmt.Errorf("scripts can't be used with the %s shell", p.Shell)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid shell %s, must be %s, %s, %s, %s or %s", p.Shell, shellBash, shellSh, shellPowerShell, shellCmd, shellNone)
+	}
+}
+
+// shellCommand returns command as it is run with Shell.
+func (p *Plan) shellCommand(command string) string {
+	switch p.Shell {
+	case shellSh, shellBash:
+		return p.Shell + " -c " + shellQuote(command)
+	case shellPowerShell:
+		// the exit status of a failing program is passed on, that of a failing
+		// cmdlet is 1
+		script := command + "\nif ($LASTEXITCODE) { exit $LASTEXITCODE }"
+		return "powershell -NoProfile -NonInteractive -EncodedCommand " + encodePowerShell(script)
+	case shellCmd:
+		return "cmd /c " + command
+	default:
+		return command
+	}
+}
+
+// encodePowerShell encodes script for -EncodedCommand, which sidesteps
+// quoting it for whatever shell starts powershell.
+func encodePowerShell(script string) string {
+	units := utf16.Encode([]rune(script))
+	b := make([]byte, 0, len(units)*2)
+	for _, u := range units {
+		b = append(b, byte(u), byte(u>>8))
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// cmdUnsafe are the characters a value can't safely hold in cmd's
+// set "NAME=value": a quote ends the quoting, % expands variables even inside
+// quotes, ^ is cmd's escape character and a line break ends the command.
+const cmdUnsafe = "\"%^\r\n"
+
+// exportCommand returns the command setting the variable name to value for
+// the commands after it. Values for cmd must not contain cmdUnsafe.
+func (p *Plan) exportCommand(name, value string) string {
+	switch p.Shell {
+	case shellPowerShell:
+		return fmt.Sprintf("$env:%s = %s; ", name, powerShellQuote(value))
+	case shellCmd:
+		return fmt.Sprintf(`set "%s=%s" && `, name, value)
+	default:
+		return fmt.Sprintf("export %s=%s; ", name, shellQuote(value))
+	}
+}
+
+// chdirCommand returns the command changing to dir before a command, which
+// stops it if dir doesn't exist. A leading ~ is the remote user's home.
+func (p *Plan) chdirCommand(dir string) string {
+	if dir == "" {
+		return ""
+	}
+
+	rest, home := strings.CutPrefix(dir, "~")
+	home = home && (rest == "" || rest[0] == '/' || rest[0] == '\\')
+	rest = strings.TrimLeft(rest, `/\`)
+
+	switch p.Shell {
+	case shellPowerShell:
+		if home {
+			return fmt.Sprintf("Set-Location -LiteralPath (Join-Path $HOME %s) -ErrorAction Stop; ", powerShellQuote(rest))
+		}
+		return fmt.Sprintf("Set-Location -LiteralPath %s -ErrorAction Stop; ", powerShellQuote(dir))
+	case shellCmd:
+		if home {
+			return fmt.Sprintf(`cd /d "%%USERPROFILE%%\%s" && `, rest)
+		}
+		return fmt.Sprintf(`cd /d "%s" && `, dir)
+	default:
+		target := shellQuote(dir)
+		if home {
+			target = `"$HOME"/` + shellQuote(rest)
+		}
+		return "cd " + target + " || exit 1; "
+	}
+}
+
+// shellQuote quotes s as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func powerShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+)
+
+// SOCKS5 protocol values, from RFC 1928.
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+	socksConnect      = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksCommandNotSupported = 7
+	socksAddrNotSupported    = 8
+)
+
+// SOCKSProxy is a local SOCKS5 proxy whose connections are made from a host,
+// like ssh -D.
+type SOCKSProxy struct {
+	// Host is the name of the host connections are made from
+	Host string
+	// Local is the address listened on
+	Local string
+
+	host     *Host
+	listener net.Listener
+}
+
+// ListenSOCKS listens for SOCKS5 clients on addr, to tunnel their connections
+// through the only connected host. OpenConns must have been called.
+func (p *Plan) ListenSOCKS(addr string) (*SOCKSProxy, error) {
+	var h *Host
+	for i := range p.hosts {
+		if p.hosts[i].client == nil {
+			continue
+		}
+		if h != nil {
+			return nil, fmt.Errorf("a SOCKS proxy goes through one host, not several")
+		}
+		h = &p.hosts[i]
+	}
+	if h == nil {
+		return nil, ErrNoHosts
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return &SOCKSProxy{Host: h.name, Local: l.Addr().String(), host: h, listener: l}, nil
+}
+
+// socksListenAddr turns an ssh -D style [bind_address:]port into an address,
+// binding to localhost if no address is given.
+func socksListenAddr(spec string) (string, error) {
+	parts := splitForwardSpec(spec)
+	bind, port := "localhost", parts[len(parts)-1]
+	switch len(parts) {
+	case 1:
+	case 2:
+		bind = parts[0]
+	default:
+		return "", fmt.Errorf("invalid SOCKS address %s, must be [bind_address:]port", spec)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid SOCKS address %s, invalid port %s", spec, port)
+	}
+	return net.JoinHostPort(trimBrackets(bind), port), nil
+}
+
+func trimBrackets(s string) string {
+	if len(s) > 1 && s[0] == '[' && s[len(s)-1] == ']' {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
+
+// Serve tunnels SOCKS connections until the proxy is closed.
+func (s *SOCKSProxy) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			target, err := socksHandshake(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+
+			remote, err := s.host.client.Dial("tcp", target)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to connect to %s through %s: %v\n", target, s.Host, err)
+				_ = socksReply(conn, socksGeneralFailure)
+				conn.Close()
+				return
+			}
+			if err := socksReply(conn, socksSucceeded); err != nil {
+				conn.Close()
+				remote.Close()
+				return
+			}
+			pipe(conn, remote)
+		}()
+	}
+}
+
+// Close stops listening, connections already tunnelled are left open.
+func (s *SOCKSProxy) Close() error {
+	return s.listener.Close()
+}
+
+// socksHandshake reads a SOCKS5 CONNECT request and returns the address to
+// connect to. Only clients not asking to authenticate are accepted, as the
+// proxy listens locally.
+func socksHandshake(conn net.Conn) (string, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(conn, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+	method := byte(socksNoAcceptable)
+	for _, m := range methods {
+		if m == socksNoAuth {
+			method = socksNoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	if method == socksNoAcceptable {
+		return "", errors.New("SOCKS client wants to authenticate")
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socksConnect {
+		_ = socksReply(conn, socksCommandNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", req[1])
+	}
+
+	var host string
+	switch req[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == socksIPv6 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, n[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		_ = socksReply(conn, socksAddrNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", req[3])
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksReply answers a SOCKS request. The bound address isn't known for
+// connections made by the host, so it is left empty.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
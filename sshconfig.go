@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/danvixent/sshx/util"
+)
+
+const defaultSSHConfigFile = "~/.ssh/config"
+
+// sshConfig is the subset of an OpenSSH client config that xsh understands.
+// Only Host blocks are supported, Match blocks are skipped.
+type sshConfig struct {
+	blocks []sshConfigBlock
+}
+
+type sshConfigBlock struct {
+	patterns []string
+	options  map[string][]string
+}
+
+// loadSSHConfig parses the OpenSSH client config at path. An empty path or a
+// missing file is not an error and yields an empty config.
+func loadSSHConfig(path string) (*sshConfig, error) {
+	cfg := &sshConfig{}
+	if util.IsStringEmpty(path) {
+		return cfg, nil
+	}
+
+	if err := cfg.parseFile(util.ExpandHome(path), []string{"*"}, 0); err != nil {
+		return nil, fmt.Errorf("failed to load ssh config: %v", err)
+	}
+	return cfg, nil
+}
+
+// parseFile parses the config in file. Options before its first Host line
+// apply to the hosts matching patterns, those of the block including it.
+func (c *sshConfig) parseFile(file string, patterns []string, depth int) error {
+	if depth > 8 {
+		return fmt.Errorf("%s: too many nested includes", file)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	return c.parse(f, patterns, depth)
+}
+
+func (c *sshConfig) parse(r io.Reader, patterns []string, depth int) error {
+	c.blocks = append(c.blocks, sshConfigBlock{patterns: patterns, options: map[string][]string{}})
+	current := len(c.blocks) - 1
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value := splitSSHConfigLine(scanner.Text())
+		if key == "" {
+			continue
+		}
+
+		switch key {
+		case "host":
+			c.blocks = append(c.blocks, sshConfigBlock{patterns: strings.Fields(value), options: map[string][]string{}})
+			current = len(c.blocks) - 1
+		case "match":
+			// unsupported, options in the block apply to no host
+			c.blocks = append(c.blocks, sshConfigBlock{options: map[string][]string{}})
+			current = len(c.blocks) - 1
+		case "include":
+			enclosing := c.blocks[current].patterns
+			for _, pattern := range strings.Fields(value) {
+				pattern = util.ExpandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(util.ExpandHome("~/.ssh"), pattern)
+				}
+
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return err
+				}
+				for _, m := range matches {
+					if err := c.parseFile(m, enclosing, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+			// lines after the include still belong to the enclosing block
+			c.blocks = append(c.blocks, sshConfigBlock{patterns: enclosing, options: map[string][]string{}})
+			current = len(c.blocks) - 1
+		default:
+			c.blocks[current].options[key] = append(c.blocks[current].options[key], value)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// splitSSHConfigLine returns the lowercased keyword and value of a config
+// line, accepting both "Key value" and "Key=value".
+func splitSSHConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+
+	i := strings.IndexAny(line, " \t=")
+	if i < 0 {
+		return strings.ToLower(line), ""
+	}
+
+	key := strings.ToLower(line[:i])
+	value := strings.TrimSpace(line[i:])
+	value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+	value = strings.Trim(value, `"`)
+	return key, value
+}
+
+// Get returns the first value of key for host, as OpenSSH uses the first
+// obtained value for most options.
+func (c *sshConfig) Get(host, key string) string {
+	if c == nil {
+		return ""
+	}
+
+	for _, b := range c.blocks {
+		if !b.matches(host) {
+			continue
+		}
+		if v, ok := b.options[key]; ok && len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// GetAll returns every value of key for host, for options like IdentityFile
+// that accumulate.
+func (c *sshConfig) GetAll(host, key string) []string {
+	if c == nil {
+		return nil
+	}
+
+	var values []string
+	for _, b := range c.blocks {
+		if b.matches(host) {
+			values = append(values, b.options[key]...)
+		}
+	}
+	return values
+}
+
+func (b *sshConfigBlock) matches(host string) bool {
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		ok, _ := path.Match(strings.TrimPrefix(pattern, "!"), host)
+		if ok && negated {
+			return false
+		}
+		if ok {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// hosts returns the literal names of every Host block, skipping patterns.
+func (c *sshConfig) hosts() []string {
+	var names []string
+	for _, b := range c.blocks {
+		for _, p := range b.patterns {
+			if !strings.ContainsAny(p, "*?!") && !hasString(names, p) {
+				names = append(names, p)
+			}
+		}
+	}
+	return names
+}
+
+// prepend adds the blocks of other before c's own, so they take precedence.
+func (c *sshConfig) prepend(other *sshConfig) {
+	c.blocks = append(append([]sshConfigBlock{}, other.blocks...), c.blocks...)
+}
+
+// expandSSHConfigTokens replaces the %h, %p, %r, %u, %d and %% tokens OpenSSH
+// allows in IdentityFile and similar options.
+func expandSSHConfigTokens(s string, h *Host) string {
+	localUser := os.Getenv("USER")
+	home, _ := os.UserHomeDir()
+
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%h", h.hostname(),
+		"%p", h.port(),
+		"%r", h.user,
+		"%u", localUser,
+		"%d", home,
+	)
+	return util.ExpandHome(r.Replace(s))
+}
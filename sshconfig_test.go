@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitSSHConfigLine(t *testing.T) {
+	tests := []struct {
+		line, key, value string
+	}{
+		{line: "", key: "", value: ""},
+		{line: "  # comment", key: "", value: ""},
+		{line: "HostName example.com", key: "hostname", value: "example.com"},
+		{line: "\tPort=2222", key: "port", value: "2222"},
+		{line: "User = deploy", key: "user", value: "deploy"},
+		{line: `IdentityFile "~/.ssh/my key"`, key: "identityfile", value: "~/.ssh/my key"},
+		{line: "Compression", key: "compression", value: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			key, value := splitSSHConfigLine(tt.line)
+			if key != tt.key || value != tt.value {
+				t.Errorf("splitSSHConfigLine(%q) = %q, %q, want %q, %q", tt.line, key, value, tt.key, tt.value)
+			}
+		})
+	}
+}
+
+const testSSHConfig = `
+User everyone
+
+Host web-* !web-test
+    User deploy
+    Port 2222
+    IdentityFile ~/.ssh/web
+
+Host db
+    HostName 10.0.0.5
+    IdentityFile ~/.ssh/db
+
+Match host db
+    User nobody
+
+Host *
+    User fallback
+    IdentityFile ~/.ssh/id_ed25519
+`
+
+func TestSSHConfigGet(t *testing.T) {
+	var cfg sshConfig
+	if err := cfg.parse(strings.NewReader(testSSHConfig), []string{"*"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host, key string
+		want      string
+		wantAll   []string
+	}{
+		{host: "web-1", key: "user", want: "everyone"},
+		{host: "web-1", key: "port", want: "2222"},
+		{host: "web-test", key: "port", want: ""},
+		{host: "db", key: "hostname", want: "10.0.0.5"},
+		{host: "db", key: "identityfile", want: "~/.ssh/db", wantAll: []string{"~/.ssh/db", "~/.ssh/id_ed25519"}},
+		{host: "web-2", key: "identityfile", want: "~/.ssh/web", wantAll: []string{"~/.ssh/web", "~/.ssh/id_ed25519"}},
+		{host: "other", key: "hostname", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.key, func(t *testing.T) {
+			if got := cfg.Get(tt.host, tt.key); got != tt.want {
+				t.Errorf("Get() = %q, want %q", got, tt.want)
+			}
+			if tt.wantAll != nil {
+				if got := cfg.GetAll(tt.host, tt.key); !reflect.DeepEqual(got, tt.wantAll) {
+					t.Errorf("GetAll() = %q, want %q", got, tt.wantAll)
+				}
+			}
+		})
+	}
+
+	if got, want := cfg.hosts(), []string{"db"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hosts() = %q, want %q", got, want)
+	}
+}
+
+func TestSSHConfigInclude(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".ssh")
+	files := map[string]string{
+		"config": "Include conf.d/*.conf\n" +
+			"Host app\n" +
+			"    Include " + filepath.Join(dir, "app.inc") + "\n" +
+			"    Port 2200\n",
+		"conf.d/a.conf": "Host a\n    HostName a.example.com\n",
+		"conf.d/b.conf": "Host b\n    HostName b.example.com\n",
+		"app.inc":       "User app\n",
+		"loop":          "Include loop\n",
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := loadSSHConfig("~/.ssh/config")
+	if err != nil {
+		t.Fatalf("loadSSHConfig() = %v", err)
+	}
+	tests := []struct {
+		host, key, want string
+	}{
+		{host: "a", key: "hostname", want: "a.example.com"},
+		{host: "b", key: "hostname", want: "b.example.com"},
+		{host: "app", key: "user", want: "app"},
+		// so do the leading options of a file included in one
+		{host: "a", key: "user", want: ""},
+		// lines after an Include stay in the enclosing Host block
+		{host: "app", key: "port", want: "2200"},
+		{host: "a", key: "port", want: ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.Get(tt.host, tt.key); got != tt.want {
+			t.Errorf("Get(%q, %q) = %q, want %q", tt.host, tt.key, got, tt.want)
+		}
+	}
+
+	if _, err := loadSSHConfig("~/.ssh/loop"); err == nil {
+		t.Error("loadSSHConfig() of a config including itself succeeded, want error")
+	}
+	if cfg, err := loadSSHConfig("~/.ssh/missing"); err != nil || len(cfg.blocks) != 0 {
+		t.Errorf("loadSSHConfig() of a missing file = %v, %v, want an empty config", cfg, err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"time"
+)
+
+// stagger waits Stagger before the command is started on the host after the
+// first one started, or a random time up to Stagger with StaggerJitter. It
+// returns early if ctx is done or the run is interrupted.
+func (p *Plan) stagger(ctx context.Context, i int) {
+	if i == 0 || p.Stagger <= 0 {
+		return
+	}
+
+	d := p.Stagger
+	if p.StaggerJitter {
+		d = rand.N(d)
+	}
+
+	select {
+	case <-time.After(d):
+	case <-p.interrupt:
+	case <-ctx.Done():
+	}
+}
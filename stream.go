@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// streamOutput returns where the stdout and stderr of commands on h are
+// copied to as they arrive, liveOutput and our own stderr, or nils if they
+// aren't. With Stream each line is prefixed with the name of h, serial runs
+// show the output as is.
+func (p *Plan) streamOutput(h *Host) (*lineWriter, *lineWriter) {
+	var prefix string
+	switch {
+	case p.Stream:
+		p.prefixOnce.Do(func() {
+			for i := range p.hosts {
+				p.prefixWidth = max(p.prefixWidth, len(p.hosts[i].name))
+			}
+		})
+		prefix = fmt.Sprintf("%-*s | ", p.prefixWidth, h.name)
+	case !p.Serial:
+		return nil, nil
+	}
+	return &lineWriter{mu: &p.streamMu, w: p.liveOutput(), prefix: prefix},
+		&lineWriter{mu: &p.streamMu, w: os.Stderr, prefix: prefix}
+}
+
+// lineWriter writes the lines written to it to w with prefix, whole lines at
+// a time so those of hosts running at once don't interleave.
+type lineWriter struct {
+	mu      *sync.Mutex
+	w       io.Writer
+	prefix  string
+	pending []byte
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.pending = append(w.pending, b...)
+	end := bytes.LastIndexByte(w.pending, '\n')
+	if end < 0 {
+		return len(b), nil
+	}
+
+	w.write(w.pending[:end+1])
+	w.pending = append(w.pending[:0], w.pending[end+1:]...)
+	return len(b), nil
+}
+
+// flush writes the last line if it didn't end with a newline, ending it
+// with one if it is prefixed so the next host's lines start on their own.
+func (w *lineWriter) flush() {
+	if len(w.pending) > 0 {
+		if w.prefix != "" {
+			w.pending = append(w.pending, '\n')
+		}
+		w.write(w.pending)
+		w.pending = nil
+	}
+}
+
+func (w *lineWriter) write(lines []byte) {
+	if w.prefix != "" {
+		var b bytes.Buffer
+		for _, line := range bytes.SplitAfter(lines, []byte("\n")) {
+			if len(line) > 0 {
+				b.WriteString(w.prefix)
+				b.Write(line)
+			}
+		}
+		lines = b.Bytes()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, _ = w.w.Write(lines)
+}
+
+// teeWriter returns a writer writing to both w and stream, or only w if
+// stream is nil.
+func teeWriter(w, stream io.Writer) io.Writer {
+	if stream == nil {
+		return w
+	}
+	return io.MultiWriter(w, stream)
+}
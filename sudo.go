@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errSudoNeedsTTY is returned when sudo on a host only runs from a terminal,
+// the command is run again in a pty.
+var errSudoNeedsTTY = errors.New("sudo needs a tty on this host")
+
+// sudoExchange answers the password prompt of commands run through sudo. The
+// prompt and ready markers are random per run, so they can't be mistaken for
+// output.
+type sudoExchange struct {
+	// Prompt is what sudo asks for the password with
+	Prompt string `json:"prompt"`
+	// Ready is printed once sudo has let the command run
+	Ready    string `json:"ready"`
+	Password string `json:"password,omitempty"`
+}
+
+// setupSudo prepares running commands through sudo if Sudo or BecomeUser is
+// set, resolving or prompting for the sudo password.
+func (p *Plan) setupSudo() error {
+	if !p.Sudo && p.BecomeUser == "" {
+		return nil
+	}
+
+	prompt, err := randomMarker()
+	if err != nil {
+		return err
+	}
+	ready, err := randomMarker()
+	if err != nil {
+		return err
+	}
+
+	password, err := p.resolveSecret(p.SudoPassword)
+	if err != nil {
+		return fmt.Errorf("failed to resolve sudo password: %v", err)
+	}
+	if password == "" && p.AskSudoPass {
+		if password, err = readPassword("sudo password: "); err != nil {
+			return err
+		}
+	}
+
+	p.sudo = &sudoExchange{Prompt: prompt, Ready: ready, Password: password}
+	return nil
+}
+
+func randomMarker() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate sudo marker: %v", err)
+	}
+	return "[xsh-" + hex.EncodeToString(b) + "]", nil
+}
+
+// command wraps command to run through sudo, as user if it is set.
+func (s *sudoExchange) command(command, user string) string {
+	sudo := "sudo -S -p " + shellQuote(s.Prompt)
+	if user != "" {
+		sudo += " -u " + shellQuote(user)
+	}
+	return sudo + " -- sh -c " + shellQuote("printf '%s' '"+s.Ready+"' >&2; "+command)
+}
+
+// run runs a command wrapped by command on session and returns its output.
+// The password is sent when sudo asks for it, and stdin is closed once the
+// command runs or if sudo asks again, so a wrong password fails instead of
+// waiting. The output is also copied to stream as it arrives if it isn't nil.
+func (s *sudoExchange) run(session *ssh.Session, command string, stream, errStream io.Writer) ([]byte, []byte, error) {
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	x := &sudoWatcher{exchange: s, stdin: stdin}
+	outFilter := &sudoFilter{watcher: x, w: teeWriter(&stdout, stream)}
+	errFilter := &sudoFilter{watcher: x, w: teeWriter(&stderr, errStream)}
+	session.Stdout = outFilter
+	session.Stderr = errFilter
+
+	err = session.Run(command)
+	outFilter.flush()
+	errFilter.flush()
+	if err != nil && strings.Contains(stderr.String(), "must have a tty") {
+		return stdout.Bytes(), stderr.Bytes(), errSudoNeedsTTY
+	}
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// sudoWatcher reacts to the markers found in a command's output.
+type sudoWatcher struct {
+	exchange *sudoExchange
+	stdin    io.WriteCloser
+
+	mu       sync.Mutex
+	answered bool
+}
+
+func (x *sudoWatcher) found(marker string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if marker == x.exchange.Prompt && !x.answered && x.exchange.Password != "" {
+		x.answered = true
+		_, _ = io.WriteString(x.stdin, x.exchange.Password+"\n")
+		return
+	}
+	_ = x.stdin.Close()
+}
+
+// sudoFilter removes the markers from an output stream, holding back what
+// could be the start of one until the rest arrives.
+type sudoFilter struct {
+	watcher *sudoWatcher
+	w       io.Writer
+	pending []byte
+}
+
+func (f *sudoFilter) Write(b []byte) (int, error) {
+	f.pending = append(f.pending, b...)
+	markers := []string{f.watcher.exchange.Prompt, f.watcher.exchange.Ready}
+	for {
+		at, marker := -1, ""
+		for _, m := range markers {
+			if i := bytes.Index(f.pending, []byte(m)); i >= 0 && (at < 0 || i < at) {
+				at, marker = i, m
+			}
+		}
+		if at < 0 {
+			break
+		}
+
+		if _, err := f.w.Write(f.pending[:at]); err != nil {
+			return 0, err
+		}
+		f.pending = f.pending[at+len(marker):]
+		f.watcher.found(marker)
+	}
+
+	// the markers are the same length
+	keep := min(len(f.pending), len(markers[0])-1)
+	if _, err := f.w.Write(f.pending[:len(f.pending)-keep]); err != nil {
+		return 0, err
+	}
+	f.pending = append(f.pending[:0], f.pending[len(f.pending)-keep:]...)
+	return len(b), nil
+}
+
+func (f *sudoFilter) flush() {
+	_, _ = f.w.Write(f.pending)
+	f.pending = nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// fakeStdin records what is written to a command's stdin.
+type fakeStdin struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (s *fakeStdin) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestSudoFilter(t *testing.T) {
+	const prompt, ready = "[xsh-prompt-0000]", "[xsh-ready-00000]"
+	tests := []struct {
+		name       string
+		output     string
+		password   string
+		want       string
+		wantStdin  string
+		wantClosed bool
+	}{
+		{name: "no markers", output: "hello\nworld\n", want: "hello\nworld\n"},
+		{name: "password then ready", output: prompt + ready + "ok\n", password: "secret", want: "ok\n", wantStdin: "secret\n", wantClosed: true},
+		{name: "no password needed", output: ready + "ok\n", password: "secret", want: "ok\n", wantClosed: true},
+		{name: "wrong password", output: prompt + "Sorry, try again.\n" + prompt, password: "wrong", want: "Sorry, try again.\n", wantStdin: "wrong\n", wantClosed: true},
+		{name: "no password to give", output: prompt, want: "", wantClosed: true},
+		{name: "marker inside output", output: "a" + ready + "b", want: "ab", wantClosed: true},
+		{name: "partial marker at the end", output: "done [xsh-", want: "done [xsh-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// feed the output in chunks of every size, so markers are split
+			// across writes
+			for size := 1; size <= len(tt.output)+1; size++ {
+				stdin := &fakeStdin{}
+				x := &sudoWatcher{exchange: &sudoExchange{Prompt: prompt, Ready: ready, Password: tt.password}, stdin: stdin}
+				var out bytes.Buffer
+				f := &sudoFilter{watcher: x, w: &out}
+				for rest := tt.output; rest != ""; {
+					n := min(size, len(rest))
+					if _, err := f.Write([]byte(rest[:n])); err != nil {
+						t.Fatal(err)
+					}
+					rest = rest[n:]
+				}
+				f.flush()
+
+				if out.String() != tt.want {
+					t.Fatalf("chunks of %d: output %q, want %q", size, out.String(), tt.want)
+				}
+				if stdin.String() != tt.wantStdin || stdin.closed != tt.wantClosed {
+					t.Fatalf("chunks of %d: stdin %q closed %t, want %q closed %t", size, stdin.String(), stdin.closed, tt.wantStdin, tt.wantClosed)
+				}
+			}
+		})
+	}
+}
+
+func TestSudoCommand(t *testing.T) {
+	s := &sudoExchange{Prompt: "[p]", Ready: "[r]"}
+	tests := []struct {
+		user string
+		want string
+	}{
+		{want: `sudo -S -p '[p]' -- sh -c 'printf '\''%s'\'' '\''[r]'\'' >&2; id -u'`},
+		{user: "postgres", want: `sudo -S -p '[p]' -u 'postgres' -- sh -c 'printf '\''%s'\'' '\''[r]'\'' >&2; id -u'`},
+	}
+	for _, tt := range tests {
+		if got := s.command("id -u", tt.user); got != tt.want {
+			t.Errorf("command(%q) = %s, want %s", tt.user, got, tt.want)
+		}
+	}
+	if m, err := randomMarker(); err != nil || !strings.HasPrefix(m, "[xsh-") || len(m) != len("[xsh-]")+24 {
+		t.Errorf("randomMarker() = %q, %v", m, err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/danvixent/sshx/util"
+	"golang.org/x/crypto/ssh"
+)
+
+// TeleportOptions routes connections through a Teleport proxy using the
+// certificate of the current tsh login.
+type TeleportOptions struct {
+	Enabled bool
+	// Proxy and Cluster default to those of the active tsh profile
+	Proxy   string
+	Cluster string
+}
+
+func (o *TeleportOptions) enabled() bool { return o.Enabled || o.Proxy != "" || o.Cluster != "" }
+
+type tshStatus struct {
+	Active struct {
+		ProfileURL string `json:"profile_url"`
+		Username   string `json:"username"`
+		Cluster    string `json:"cluster"`
+	} `json:"active"`
+}
+
+// teleportHome is where tsh keeps its keys and known_hosts.
+func teleportHome() string {
+	if dir := os.Getenv("TELEPORT_HOME"); dir != "" {
+		return dir
+	}
+	return util.ExpandHome("~/.tsh")
+}
+
+// setupTeleport loads the certificate tsh issued at login. Run tsh login
+// first, xsh never logs in itself.
+func (p *Plan) setupTeleport() error {
+	if !p.Teleport.enabled() {
+		return nil
+	}
+
+	args := []string{"status", "--format=json"}
+	if p.Teleport.Proxy != "" {
+		args = append(args, "--proxy="+p.Teleport.Proxy)
+	}
+
+	var status tshStatus
+	if err := execJSON(&status, "tsh", args...); err != nil {
+		return fmt.Errorf("failed to get tsh status, are you logged in? %v", err)
+	}
+
+	u, err := url.Parse(status.Active.ProfileURL)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid tsh profile url %q", status.Active.ProfileURL)
+	}
+	cluster := p.Teleport.Cluster
+	if cluster == "" {
+		cluster = status.Active.Cluster
+	}
+
+	dir := filepath.Join(teleportHome(), "keys", u.Hostname())
+	keyFile := filepath.Join(dir, status.Active.Username)
+	certFile := filepath.Join(dir, status.Active.Username+"-ssh", cluster+"-cert.pub")
+
+	b, err := os.ReadFile(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to read tsh key: %v", err)
+	}
+	key, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse tsh key %s: %v", keyFile, err)
+	}
+
+	b, err = os.ReadFile(certFile)
+	if err != nil {
+		return fmt.Errorf("failed to read tsh certificate, run tsh login for cluster %s: %v", cluster, err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return fmt.Errorf("failed to parse tsh certificate %s: %v", certFile, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("%s is not a certificate", certFile)
+	}
+
+	p.teleportSigner, err = ssh.NewCertSigner(cert, key)
+	if err != nil {
+		return fmt.Errorf("failed to use tsh certificate: %v", err)
+	}
+	return nil
+}
+
+// dialTeleport connects to h through the Teleport proxy with tsh proxy ssh,
+// which tunnels to the node without authenticating to it.
+func (p *Plan) dialTeleport(h *Host) (net.Conn, error) {
+	args := []string{"proxy", "ssh"}
+	if p.Teleport.Proxy != "" {
+		args = append(args, "--proxy="+p.Teleport.Proxy)
+	}
+	if p.Teleport.Cluster != "" {
+		args = append(args, "--cluster="+p.Teleport.Cluster)
+	}
+	args = append(args, h.user+"@"+h.host)
+
+	return dialCommand(h.host, "tsh", args...)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// hostTemplateData is what a templated command can refer to, e.g.
+// {{.Vars.service}} or {{.Name}}. Values are inserted as they are, so those
+// the command doesn't trust, such as discovered tags, should go through
+// quote, e.g. {{quote .Vars.service}}, which makes them a single word for
+// Shell.
+type hostTemplateData struct {
+	Name   string
+	User   string
+	Host   string
+	Port   string
+	Groups []string
+	Tags   []string
+	Vars   map[string]string
+}
+
+// commandFor returns command as it is run on h. When templating is enabled the
+// command is rendered as a text/template with the host's details and
+// inventory variables.
+func (p *Plan) commandFor(h *Host, command string) (string, error) {
+	if !p.Template {
+		return command, nil
+	}
+
+	tmpl, err := template.New("command").Option("missingkey=error").Funcs(template.FuncMap{"quote": p.quote}).Parse(command)
+	if err != nil {
+		return "", fmt.Errorf("invalid command template: %v", err)
+	}
+
+	vars := h.vars
+	if vars == nil {
+		vars = map[string]string{}
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, hostTemplateData{
+		Name:   h.name,
+		User:   h.user,
+		Host:   h.hostname(),
+		Port:   h.port(),
+		Groups: h.groups,
+		Tags:   h.tags,
+		Vars:   vars,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to render command for host %s: %v", h.name, err)
+	}
+
+	return buf.String(), nil
+}
+
+// quote quotes s as a single word for Shell. cmd has no quoting that keeps
+// every value as it is, so values it can't take are refused.
+func (p *Plan) quote(s string) (string, error) {
+	switch p.Shell {
+	case shellPowerShell:
+		return powerShellQuote(s), nil
+	case shellCmd:
+		if strings.ContainsAny(s, cmdUnsafe) {
+			return "", fmt.Errorf("%q can't be quoted for the %s shell, it has quotes, %%, ^ or line breaks", s, shellCmd)
+		}
+		return `"` + s + `"`, nil
+	default:
+		return shellQuote(s), nil
+	}
+}
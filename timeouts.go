@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/danvixent/sshx/util"
+	"gopkg.in/yaml.v3"
+)
+
+// loadTimeoutOverrides reads TimeoutOverrides, a yaml mapping of host
+// patterns to the command timeout of the hosts they match, such as
+//
+//	db-*: 10m
+//	~^backup[0-9]+$: 1h
+//
+// and sets it on those hosts. When several patterns match a host, or the
+// inventory set one for it too, it gets the longest of the timeouts.
+func (p *Plan) loadTimeoutOverrides() error {
+	if p.TimeoutOverrides == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(util.ExpandHome(p.TimeoutOverrides))
+	if err != nil {
+		return fmt.Errorf("failed to read timeout overrides: %v", err)
+	}
+	var overrides map[string]string
+	if err := yaml.Unmarshal(b, &overrides); err != nil {
+		return fmt.Errorf("failed to parse timeout overrides %s: %v", p.TimeoutOverrides, err)
+	}
+
+	for pattern, timeout := range overrides {
+		hp, err := compileHostPattern(pattern)
+		if err != nil {
+			return err
+		}
+		d, err := parseTimeout(timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout for %s in %s: %v", pattern, p.TimeoutOverrides, err)
+		}
+
+		for i := range p.hosts {
+			if h := &p.hosts[i]; hp.matchesHost(h) && (!h.overridden || d > h.commandTimeout) {
+				h.commandTimeout, h.overridden = d, true
+			}
+		}
+	}
+	return nil
+}
+
+// parseTimeout parses a timeout such as 90s or 10m, 0 for no limit.
+func parseTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("%s must not be negative", s)
+	}
+	return d, nil
+}
+
+// commandTimeout returns how long the commands may run for on h, 0 for no
+// limit.
+func (p *Plan) commandTimeout(h *Host) time.Duration {
+	if h.overridden {
+		return h.commandTimeout
+	}
+	return p.CommandTimeout
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Defaults for polling with Until.
+const (
+	defaultPollInterval = 5 * time.Second
+	defaultMaxWait      = 5 * time.Minute
+)
+
+// untilNames are the names Until may use: the exit status of the commands and
+// their output.
+var untilNames = []string{"exit", "output"}
+
+// checkUntil parses Until.
+func (p *Plan) checkUntil() error {
+	if p.Until == "" {
+		return nil
+	}
+	switch {
+	case p.CommandRetry.Retries > 0:
+		return fmt.Errorf("retries can't be used with until, which runs the commands again itself")
+	case p.Detach:
+		return fmt.Errorf("until can't be used with detach, the commands don't finish while xsh waits")
+	case p.PollInterval < 0 || p.MaxWait < 0:
+		return fmt.Errorf("invalid until interval or max wait, must not be negative")
+	}
+
+	e, err := parseExpr(p.Until, untilNames)
+	if err != nil {
+		return fmt.Errorf("invalid until %q: %v", p.Until, err)
+	}
+	p.until = e
+	return nil
+}
+
+// runUntil runs the commands on h every PollInterval until their exit status
+// and output match Until, for up to MaxWait. The command timeout applies to
+// each run on its own. It gives up early if ctx is done or the run is
+// interrupted.
+func (p *Plan) runUntil(ctx context.Context, h *Host) ([]byte, error) {
+	interval, maxWait := p.PollInterval, p.MaxWait
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	if maxWait == 0 {
+		maxWait = defaultMaxWait
+	}
+	ctx, cancel := context.WithTimeout(ctx, maxWait)
+	defer cancel()
+
+	for attempt := 1; ; attempt++ {
+		runCtx, cancelRun := ctx, context.CancelFunc(func() {})
+		if timeout := p.commandTimeout(h); timeout > 0 {
+			runCtx, cancelRun = context.WithTimeout(ctx, timeout)
+		}
+		out, err := p.run(runCtx, h)
+		cancelRun()
+		h.attempts = attempt
+		if h.err != nil {
+			return out, err
+		}
+
+		vars := map[string]string{"output": string(out)}
+		var exitErr interface{ ExitStatus() int }
+		switch {
+		case err == nil:
+			vars["exit"] = "0"
+		case errors.As(err, &exitErr):
+			vars["exit"] = strconv.Itoa(exitErr.ExitStatus())
+		}
+		if vars["exit"] != "" {
+			met, cerr := evalCondition(p.until, vars)
+			if cerr != nil {
+				return out, fmt.Errorf("failed to check until: %v", cerr)
+			}
+			if met {
+				return out, nil
+			}
+		}
+
+		last := "exit " + vars["exit"]
+		if vars["exit"] == "" {
+			last = err.Error()
+		}
+		select {
+		case <-time.After(interval):
+		case <-p.interrupt:
+			return out, fmt.Errorf("interrupted before until was met, after %d runs, the last one %s", attempt, last)
+		case <-ctx.Done():
+			return out, fmt.Errorf("until not met within %s, after %d runs, the last one %s", maxWait, attempt, last)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import "testing"
+
+func TestCheckUntil(t *testing.T) {
+	tests := []struct {
+		name    string
+		plan    *Plan
+		vars    map[string]string
+		want    bool
+		wantErr bool
+	}{
+		{name: "exit status met", plan: &Plan{Until: "exit == 0"}, vars: map[string]string{"exit": "0", "output": ""}, want: true},
+		{name: "exit status not met", plan: &Plan{Until: "exit == 0"}, vars: map[string]string{"exit": "3", "output": ""}},
+		{name: "output", plan: &Plan{Until: `exit == 0 && output matches "(?m)^ready$"`}, vars: map[string]string{"exit": "0", "output": "starting\nready\n"}, want: true},
+		{name: "output not yet", plan: &Plan{Until: `output matches "ready"`}, vars: map[string]string{"exit": "0", "output": "starting\n"}},
+		{name: "unknown name", plan: &Plan{Until: "facts.os == 0"}, wantErr: true},
+		{name: "with retries", plan: &Plan{Until: "exit == 0", CommandRetry: RetryOptions{Retries: 2}}, wantErr: true},
+		{name: "with detach", plan: &Plan{Until: "exit == 0", Detach: true}, wantErr: true},
+		{name: "negative interval", plan: &Plan{Until: "exit == 0", PollInterval: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.plan.checkUntil()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkUntil() = %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, err := evalCondition(tt.plan.until, tt.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("evalCondition() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
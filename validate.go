@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// HostReport is the outcome of resolving a plan's hosts without connecting
+// to them.
+type HostReport struct {
+	Hosts        []Host
+	Duplicates   []string
+	Malformed    []string
+	Unresolvable []string
+
+	mu sync.Mutex
+}
+
+// malformed records err, or returns it if there is no report to record it on.
+func (r *HostReport) malformed(err error) error {
+	if r == nil {
+		return err
+	}
+	r.Malformed = append(r.Malformed, err.Error())
+	return nil
+}
+
+func (r *HostReport) duplicate(spec string) {
+	if r != nil {
+		r.Duplicates = append(r.Duplicates, spec)
+	}
+}
+
+// OK reports whether no problems were found.
+func (r *HostReport) OK() bool {
+	return len(r.Duplicates) == 0 && len(r.Malformed) == 0 && len(r.Unresolvable) == 0
+}
+
+// ValidateHosts resolves every host source like ResolveHosts does, but
+// collects malformed and duplicate entries instead of stopping at the first
+// one, and checks that every hostname resolves in DNS.
+func (p *Plan) ValidateHosts(ctx context.Context) (*HostReport, error) {
+	report := &HostReport{}
+
+	hosts, err := p.resolveHosts(report)
+	if err != nil && err != ErrNoHosts && err != ErrNoHostsMatched {
+		return nil, err
+	}
+	report.Hosts = hosts
+
+	var resolver net.Resolver
+	errg, ctx := errgroup.WithContext(ctx)
+	errg.SetLimit(32)
+	for i := range hosts {
+		h := &hosts[i]
+		if _, err := netip.ParseAddr(h.hostname()); err == nil {
+			continue
+		}
+		if h.proxyJump != "" && h.proxyJump != "none" {
+			// the jump host resolves the name, it may not resolve from here
+			continue
+		}
+
+		errg.Go(func() error {
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+
+			if _, err := resolver.LookupHost(ctx, h.hostname()); err != nil {
+				report.mu.Lock()
+				report.Unresolvable = append(report.Unresolvable, fmt.Sprintf("%s: %v", h.name, err))
+				report.mu.Unlock()
+			}
+			return nil
+		})
+	}
+	_ = errg.Wait()
+
+	return report, nil
+}
+
+// Print writes the report in a human readable form.
+func (r *HostReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "targets (%d):\n", len(r.Hosts))
+	for _, h := range r.Hosts {
+		fmt.Fprintf(w, "  %s\t%s@%s\n", h.name, h.user, h.host)
+	}
+
+	printSection(w, "duplicates", r.Duplicates)
+	printSection(w, "malformed", r.Malformed)
+	printSection(w, "unresolvable", r.Unresolvable)
+}
+
+func printSection(w io.Writer, title string, lines []string) {
+	if len(lines) == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "%s (%d):\n", title, len(lines))
+	for _, l := range lines {
+		fmt.Fprintf(w, "  %s\n", l)
+	}
+}
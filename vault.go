@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultVaultAddr     = "https://127.0.0.1:8200"
+	defaultVaultSSHMount = "ssh"
+)
+
+// VaultOptions selects a Vault SSH secrets engine role to sign a short lived
+// certificate with.
+type VaultOptions struct {
+	Role string
+	// Mount is the path the SSH secrets engine is mounted at
+	Mount string
+	// Addr is the Vault address, defaulting to VAULT_ADDR
+	Addr string
+}
+
+func (o *VaultOptions) enabled() bool { return o.Role != "" }
+
+type vaultSignResponse struct {
+	Data struct {
+		SignedKey string `json:"signed_key"`
+	} `json:"data"`
+}
+
+// signVaultCertificate generates a throwaway key and has Vault sign it for
+// the login users of the resolved hosts. The key only ever lives in memory.
+func (p *Plan) signVaultCertificate() error {
+	if !p.Vault.enabled() {
+		return nil
+	}
+
+	signer, err := ephemeralSigner()
+	if err != nil {
+		return fmt.Errorf("failed to generate key: %v", err)
+	}
+
+	users := map[string]bool{}
+	for _, h := range p.hosts {
+		users[h.user] = true
+	}
+	principals := sortedKeys(users)
+
+	signed, err := p.Vault.sign(signer.PublicKey(), principals)
+	if err != nil {
+		return fmt.Errorf("failed to sign key with vault: %v", err)
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed))
+	if err != nil {
+		return fmt.Errorf("failed to parse vault certificate: %v", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("vault returned a %s key instead of a certificate", pub.Type())
+	}
+
+	p.vaultSigner, err = ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return fmt.Errorf("failed to use vault certificate: %v", err)
+	}
+	return nil
+}
+
+// sign asks Vault to sign pub for the given principals.
+func (o *VaultOptions) sign(pub ssh.PublicKey, principals []string) (string, error) {
+	mount := o.Mount
+	if mount == "" {
+		mount = defaultVaultSSHMount
+	}
+
+	body := map[string]string{
+		"public_key":       string(ssh.MarshalAuthorizedKey(pub)),
+		"cert_type":        "user",
+		"valid_principals": strings.Join(principals, ","),
+	}
+
+	var out vaultSignResponse
+	if err := o.do(http.MethodPost, fmt.Sprintf("%s/sign/%s", strings.Trim(mount, "/"), o.Role), body, &out); err != nil {
+		return "", err
+	}
+	if out.Data.SignedKey == "" {
+		return "", fmt.Errorf("vault response has no signed key")
+	}
+
+	return out.Data.SignedKey, nil
+}
+
+// errVaultNotFound is returned by do when Vault has nothing at the path.
+var errVaultNotFound = errors.New("vault returned 404 Not Found")
+
+// do sends a request to the Vault API at path, relative to /v1, and decodes
+// the response into out. body is sent as JSON if it is not nil.
+func (o *VaultOptions) do(method, path string, body, out any) error {
+	addr := o.Addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		addr = defaultVaultAddr
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, fmt.Sprintf("%s/v1/%s", strings.TrimSuffix(addr, "/"), strings.TrimPrefix(path, "/")), r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := vaultToken(); token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		_ = json.Unmarshal(b, &errs)
+		if len(errs.Errors) > 0 {
+			return fmt.Errorf("vault returned %s: %s", resp.Status, strings.Join(errs.Errors, ", "))
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return errVaultNotFound
+		}
+		return fmt.Errorf("vault returned %s", resp.Status)
+	}
+
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("failed to decode vault response: %v", err)
+	}
+	return nil
+}
+
+// vaultToken returns VAULT_TOKEN, or the token the vault cli saved on login.
+func vaultToken() string {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	b, err := os.ReadFile(home + "/.vault-token")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
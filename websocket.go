@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// websocketFor returns the ws:// or wss:// gateway URL to reach h through,
+// the one set for it in the inventory or else WebSocket, or "" to dial it.
+func (p *Plan) websocketFor(h *Host) string {
+	switch h.websocket {
+	case "":
+		return p.WebSocket
+	case "none":
+		return ""
+	default:
+		return h.websocket
+	}
+}
+
+// parseWebSocketURL checks a ws:// or wss:// gateway URL.
+func parseWebSocketURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid websocket url %s: %v", raw, err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid websocket url %s, must be a ws:// or wss:// URL", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid websocket url %s, missing host", raw)
+	}
+	return u, nil
+}
+
+// dialWebSocket connects to h through a gateway that carries the ssh stream
+// over a WebSocket, like those of Cloudflare Access and some cloud consoles.
+// %h, %p and %r in the URL are replaced with the host, port and user.
+func (p *Plan) dialWebSocket(h *Host, raw string) (net.Conn, error) {
+	u, err := parseWebSocketURL(strings.NewReplacer("%h", url.QueryEscape(h.hostname()), "%p", h.port(), "%r", url.QueryEscape(h.user)).Replace(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	origin := "http://" + u.Host
+	if u.Scheme == "wss" {
+		origin = "https://" + u.Host
+	}
+	cfg, err := websocket.NewConfig(u.String(), origin)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Header = http.Header{}
+	for _, header := range p.WebSocketHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid websocket header %s, must be Name: value", header)
+		}
+		cfg.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	// the gateway is reached like any host, through its proxy if it has one
+	conn, err := p.dialTCP(h, addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "wss" {
+		ctx, cancel := context.WithTimeout(context.Background(), p.connectTimeout())
+		defer cancel()
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	ws, err := websocket.NewClient(cfg, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &websocketConn{Conn: ws, addr: h.host}, nil
+}
+
+// websocketConn is an ssh stream over a WebSocket. Its remote address is the
+// host's rather than the gateway's, as host key checks need one.
+type websocketConn struct {
+	*websocket.Conn
+	addr string
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr { return commandAddr(c.addr) }
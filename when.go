@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// factNames are the facts gathered for When, as they are named in it.
+var factNames = []string{
+	"facts.os", "facts.os_version", "facts.os_family", "facts.kernel", "facts.arch",
+	"facts.hostname", "facts.cpus", "facts.memory_gb",
+}
+
+// factsCommand prints the facts of a host as name=value lines. os is the ID
+// of /etc/os-release, or the lowercased kernel name where there is none such
+// as on macOS.
+const factsCommand = `. /etc/os-release 2>/dev/null; ` +
+	`k=$(uname -s | tr '[:upper:]' '[:lower:]'); ` +
+	`echo "os=${ID:-$k}"; echo "os_version=${VERSION_ID:-$(uname -r)}"; echo "os_family=${ID_LIKE:-${ID:-$k}}"; ` +
+	`echo "kernel=$(uname -r)"; echo "arch=$(uname -m)"; echo "hostname=$(uname -n)"; ` +
+	`echo "cpus=$(nproc 2>/dev/null || getconf _NPROCESSORS_ONLN 2>/dev/null || sysctl -n hw.ncpu)"; ` +
+	`if [ -r /proc/meminfo ]; then awk '/^MemTotal:/ { printf "memory_gb=%.1f\n", $2 / 1048576 }' /proc/meminfo; ` +
+	`else sysctl -n hw.memsize 2>/dev/null | awk '{ printf "memory_gb=%.1f\n", $1 / 1073741824 }'; fi`
+
+// checkWhen parses When.
+func (p *Plan) checkWhen() error {
+	if p.When == "" {
+		return nil
+	}
+	if p.Shell == shellPowerShell || p.Shell == shellCmd {
+		return fmt.Errorf("when can't be used with the %s shell, facts are gathered with sh", p.Shell)
+	}
+
+	e, err := parseExpr(p.When, factNames)
+	if err != nil {
+		return fmt.Errorf("invalid when %q: %v", p.When, err)
+	}
+	p.when = e
+	return nil
+}
+
+// gatherFacts runs factsCommand on h and returns the facts it printed.
+func (p *Plan) gatherFacts(ctx context.Context, h *Host) (map[string]string, error) {
+	var out []byte
+	var err error
+	if h.daemon != "" {
+		out, _, err = p.runDaemon(ctx, h, p.shellCommand(factsCommand))
+	} else {
+		session := h.session
+		h.session = nil
+		if session == nil {
+			if session, err = p.newSession(h); err != nil {
+				return nil, fmt.Errorf("failed to start ssh session: %v", err)
+			}
+		}
+		out, _, err = p.runSession(ctx, h, session, p.shellCommand(factsCommand), nil, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to gather facts: %v", err)
+	}
+
+	facts := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if name, value, found := strings.Cut(strings.TrimSpace(line), "="); found {
+			facts[name] = value
+		}
+	}
+	return facts, nil
+}
+
+// matchWhen gathers the facts of h and reports whether they match When.
+// Hosts that couldn't be connected to match, so their result reports why.
+func (p *Plan) matchWhen(ctx context.Context, h *Host) (bool, error) {
+	if p.when == nil || h.err != nil {
+		return true, nil
+	}
+
+	facts, err := p.gatherFacts(ctx, h)
+	if err != nil {
+		return false, err
+	}
+	h.facts = facts
+
+	vars := make(map[string]string, len(facts))
+	for name, value := range facts {
+		vars["facts."+name] = value
+	}
+	match, err := evalCondition(p.when, vars)
+	if err != nil {
+		return false, fmt.Errorf("failed to check when: %v", err)
+	}
+	return match, nil
+}